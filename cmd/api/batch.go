@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/datewu/xyz/internal/validator"
+)
+
+const batchMaxRequests = 50
+
+type batchRequest struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body is sent as is, except a JSON string, which is sent unquoted
+	// when the headers give a Content-Type other than JSON, e.g. CSV
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+type batchInput struct {
+	// Atomic runs every sub-request in one transaction, committed only
+	// if they all succeed
+	Atomic   bool           `json:"atomic"`
+	Requests []batchRequest `json:"requests"`
+}
+
+type batchResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body is the JSON the sub-request answered, or its body as a
+	// string when that isn't JSON
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// batchRecorder is the http.ResponseWriter a sub-request writes to.
+type batchRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *batchRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *batchRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *batchRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
+
+func (rec *batchRecorder) response() batchResponse {
+	res := batchResponse{Status: rec.status, Headers: make(map[string]string)}
+	if res.Status == 0 {
+		res.Status = http.StatusOK
+	}
+	for k := range rec.header {
+		// the batch response's own Vary covers these
+		if k == "Vary" {
+			continue
+		}
+		res.Headers[k] = rec.header.Get(k)
+	}
+	body := bytes.TrimSpace(rec.body.Bytes())
+	switch {
+	case len(body) == 0:
+	case json.Valid(body):
+		res.Body = body
+	default:
+		res.Body, _ = json.Marshal(string(body))
+	}
+	return res
+}
+
+func validateBatchRequest(v *validator.Validator, i int, br batchRequest) {
+	key := fmt.Sprintf("requests[%d]", i)
+	v.Check(validator.In(br.Method, http.MethodGet, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete), key+".method", "must be GET, POST, PUT, PATCH or DELETE")
+	u, err := url.Parse(br.Path)
+	v.Check(err == nil && u.Host == "" && strings.HasPrefix(u.Path, "/v1/"), key+".path", "must be a path under /v1/")
+	if err == nil {
+		v.Check(u.Path != "/v1/batch", key+".path", "must not be a batch request")
+	}
+	for k := range br.Headers {
+		v.Check(!strings.EqualFold(k, "Authorization"), key+".headers", "must not set Authorization, sub-requests are the caller's")
+	}
+}
+
+// batchHandler runs a list of sub-requests through the API in order,
+// as the caller, and answers with each one's response. Atomic batches
+// share one transaction and stop at the first failure, rolling back
+// what the sub-requests before it did.
+func (app *application) batchHandler(w http.ResponseWriter, r *http.Request) {
+	var input batchInput
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.CheckCode(len(input.Requests) > 0, "requests", validator.CodeRequired, "must be provided")
+	v.Check(len(input.Requests) <= batchMaxRequests, "requests", fmt.Sprintf("must not contain more than %d requests", batchMaxRequests))
+	for i, br := range input.Requests {
+		validateBatchRequest(v, i, br)
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	responses, committed, err := app.dispatchBatch(r, input)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"responses": responses, "committed": committed}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+// dispatchBatch runs the batch, in a transaction when it's atomic, and
+// reports whether what the sub-requests wrote was committed.
+func (app *application) dispatchBatch(r *http.Request, input batchInput) ([]batchResponse, bool, error) {
+	if !input.Atomic {
+		responses, _ := app.runBatch(r, input.Requests, nil)
+		return responses, true, nil
+	}
+	tx, err := app.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+	models := app.modelsFor(r).WithTx(tx)
+	responses, ok := app.runBatch(r, input.Requests, func(sub *http.Request) *http.Request {
+		return app.contextSetModels(sub, models)
+	})
+	if !ok {
+		return responses, false, nil
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, false, err
+	}
+	return responses, true, nil
+}
+
+// runBatch dispatches each of reqs through app.handler, with prepare
+// applied to the sub-request if given. With prepare, the batch is
+// atomic: it stops at the first sub-request answering 4xx or 5xx and
+// the rest are marked 424 Failed Dependency. ok reports that none
+// failed.
+func (app *application) runBatch(r *http.Request, reqs []batchRequest, prepare func(*http.Request) *http.Request) ([]batchResponse, bool) {
+	responses := make([]batchResponse, len(reqs))
+	failed := false
+	for i, br := range reqs {
+		if failed {
+			responses[i] = batchResponse{Status: http.StatusFailedDependency}
+			continue
+		}
+		sub, err := app.newBatchSubRequest(r, i, br)
+		if err != nil {
+			responses[i] = batchResponse{Status: http.StatusBadRequest}
+			responses[i].Body, _ = json.Marshal(err.Error())
+		} else {
+			if prepare != nil {
+				sub = prepare(sub)
+			}
+			rec := &batchRecorder{header: make(http.Header)}
+			app.handler.ServeHTTP(rec, sub)
+			responses[i] = rec.response()
+		}
+		if prepare != nil && responses[i].Status >= 400 {
+			failed = true
+		}
+	}
+	return responses, !failed
+}
+
+func (app *application) newBatchSubRequest(r *http.Request, i int, br batchRequest) (*http.Request, error) {
+	header := make(http.Header)
+	for k, v := range br.Headers {
+		header.Set(k, v)
+	}
+	body := []byte(br.Body)
+	if len(body) > 0 {
+		ct := header.Get("Content-Type")
+		if ct == "" {
+			header.Set("Content-Type", "application/json")
+		} else if !strings.Contains(ct, "json") && body[0] == '"' {
+			var s string
+			err := json.Unmarshal(body, &s)
+			if err != nil {
+				return nil, err
+			}
+			body = []byte(s)
+		}
+	}
+	sub, err := http.NewRequestWithContext(r.Context(), br.Method, br.Path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	sub.Header = header
+	if ah := r.Header.Get("Authorization"); ah != "" {
+		sub.Header.Set("Authorization", ah)
+	}
+	if sub.Header.Get("Accept") == "" && r.Header.Get("Accept") != "" {
+		sub.Header.Set("Accept", r.Header.Get("Accept"))
+	}
+	// tie the sub-request's logs to the batch's
+	if id := fmt.Sprintf("%s.%d", app.contextGetRequestID(r), i); requestIDRX.MatchString(id) {
+		sub.Header.Set("X-Request-ID", id)
+	}
+	sub.RemoteAddr = r.RemoteAddr
+	sub.Host = r.Host
+	return sub, nil
+}
@@ -9,7 +9,15 @@ import (
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey      = contextKey("user")
+	requestIDContextKey = contextKey("request_id")
+	modelsContextKey    = contextKey("models")
+	// graphqlRequestContextKey carries the request to GraphQL resolvers
+	graphqlRequestContextKey = contextKey("graphql_request")
+	// connContextKey carries the connection a request came in on
+	connContextKey = contextKey("conn")
+)
 
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -23,3 +31,39 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// contextGetRequestID returns "" outside the requestID middleware,
+// e.g. for work done by a background job.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// contextSetModels makes the request use models rather than app.models,
+// for batch sub-requests sharing a transaction.
+func (app *application) contextSetModels(r *http.Request, models data.Models) *http.Request {
+	ctx := context.WithValue(r.Context(), modelsContextKey, models)
+	return r.WithContext(ctx)
+}
+
+// inTx runs fn with a request whose models share one transaction, so
+// the writes fn makes through them commit or roll back together.
+func (app *application) inTx(r *http.Request, fn func(r *http.Request) error) error {
+	return app.modelsFor(r).Transaction(r.Context(), func(models data.Models) error {
+		return fn(app.contextSetModels(r, models))
+	})
+}
+
+// modelsFor returns the models r must use, app.models unless
+// contextSetModels has said otherwise.
+func (app *application) modelsFor(r *http.Request) data.Models {
+	if models, ok := r.Context().Value(modelsContextKey).(data.Models); ok {
+		return models
+	}
+	return app.models
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/datewu/xyz/internal/cron"
+)
+
+const day = 24 * time.Hour
+
+// cronTasks builds the maintenance tasks from the config, a task
+// with an empty schedule is left out.
+func (app *application) cronTasks() ([]cron.Task, error) {
+	cfg := app.config.cron
+	unactivatedAge := time.Duration(cfg.unactivatedDays) * day
+	retention := time.Duration(cfg.retentionDays) * day
+	moviesAge := time.Duration(cfg.moviesDays) * day
+	specs := []struct {
+		name     string
+		schedule string
+		run      func(ctx context.Context) (int64, error)
+	}{
+		{"purge-expired-tokens", cfg.tokenPurge, app.models.Tokens.DeleteExpired},
+		{"purge-idempotency-keys", cfg.idempotencyPurge, app.models.Idempotency.DeleteExpired},
+		{"trim-movie-events", cfg.movieEventsTrim, func(ctx context.Context) (int64, error) {
+			return app.models.MovieEvents.DeleteOlder(ctx, app.config.movieEvents.retention)
+		}},
+		{"delete-unactivated-users", cfg.unactivatedPurge, func(ctx context.Context) (int64, error) {
+			return app.models.Users.DeleteUnactivated(ctx, unactivatedAge)
+		}},
+		{"vacuum-email-outbox", cfg.outboxVacuum, func(ctx context.Context) (int64, error) {
+			return app.models.Outbox.DeleteFinished(ctx, retention)
+		}},
+		{"vacuum-jobs", cfg.jobsVacuum, func(ctx context.Context) (int64, error) {
+			return app.models.Jobs.DeleteFinished(ctx, retention)
+		}},
+		{"vacuum-webhook-deliveries", cfg.deliveriesVacuum, func(ctx context.Context) (int64, error) {
+			return app.models.Webhooks.DeleteDeliveries(ctx, retention)
+		}},
+		{"purge-deleted-movies", cfg.moviesPurge, func(ctx context.Context) (int64, error) {
+			return app.models.Movies.PurgeDeleted(ctx, moviesAge)
+		}},
+	}
+	var tasks []cron.Task
+	for _, s := range specs {
+		if s.schedule == "" {
+			continue
+		}
+		schedule, err := cron.Parse(s.schedule)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, cron.Task{
+			Name:     s.name,
+			Schedule: schedule,
+			Timeout:  time.Minute,
+			Run:      s.run,
+		})
+	}
+	return tasks, nil
+}
+
+// startCron runs the scheduler until ctx is done.
+func (app *application) startCron(ctx context.Context) {
+	if !app.config.cron.enabled {
+		return
+	}
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		app.scheduler.Run(ctx)
+	}()
+}
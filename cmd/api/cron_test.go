@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCronTasksHaveOwnSchedules(t *testing.T) {
+	app := &application{}
+	cfg := &app.config.cron
+	schedules := map[string]*string{
+		"purge-expired-tokens":      &cfg.tokenPurge,
+		"purge-idempotency-keys":    &cfg.idempotencyPurge,
+		"trim-movie-events":         &cfg.movieEventsTrim,
+		"delete-unactivated-users":  &cfg.unactivatedPurge,
+		"vacuum-email-outbox":       &cfg.outboxVacuum,
+		"vacuum-jobs":               &cfg.jobsVacuum,
+		"vacuum-webhook-deliveries": &cfg.deliveriesVacuum,
+		"purge-deleted-movies":      &cfg.moviesPurge,
+	}
+	minute := 0
+	for _, s := range schedules {
+		*s = fmt.Sprintf("%d * * * *", minute)
+		minute++
+	}
+	tasks, err := app.cronTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != len(schedules) {
+		t.Fatalf("got %d tasks, want %d", len(tasks), len(schedules))
+	}
+	for _, task := range tasks {
+		s, ok := schedules[task.Name]
+		if !ok {
+			t.Errorf("unexpected task %s", task.Name)
+			continue
+		}
+		if task.Schedule.String() != *s {
+			t.Errorf("%s runs on %q, want its own schedule %q", task.Name, task.Schedule, *s)
+		}
+	}
+
+	// emptying one schedule disables only its task
+	for name, s := range schedules {
+		saved := *s
+		*s = ""
+		tasks, err := app.cronTasks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tasks) != len(schedules)-1 {
+			t.Errorf("disabling %s left %d tasks", name, len(tasks))
+		}
+		for _, task := range tasks {
+			if task.Name == name {
+				t.Errorf("disabling %s didn't remove it", name)
+			}
+		}
+		*s = saved
+	}
+}
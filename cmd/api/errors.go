@@ -1,82 +1,197 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"mime"
 	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/datewu/xyz/internal/validator"
+)
+
+const (
+	// errorFormatProblem answers errors with RFC 7807 problem+json.
+	errorFormatProblem = "problem"
+	// errorFormatLegacy answers errors with {"error": ...}, as before
+	// problem+json was added.
+	errorFormatLegacy = "legacy"
 )
 
+// problem is an RFC 7807 problem details object. Code is the stable
+// name of the error for clients to switch on, Type is built from it.
+type problem struct {
+	Type     string         `json:"type"`
+	Title    string         `json:"title"`
+	Status   int            `json:"status"`
+	Detail   string         `json:"detail,omitempty"`
+	Instance string         `json:"instance,omitempty"`
+	Code     string         `json:"code"`
+	Errors   []fieldProblem `json:"errors,omitempty"`
+}
+
+// fieldProblem is what's wrong with one field of a request.
+type fieldProblem struct {
+	Field  string `json:"field"`
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+}
+
 func (app *application) logError(r *http.Request, err error) {
 	app.logger.PrintErr(err, map[string]string{
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
+		"request_id":     app.contextGetRequestID(r),
 	})
 }
 
-func (app *application) errResponse(w http.ResponseWriter, r *http.Request, status int, msg interface{}) {
-	data := envelope{"error": msg}
-	err := app.writeJSON(w, status, data, nil)
+// wantsProblem reports whether r gets problem+json. Asking for it, or
+// for plain application/json, by Accept header settles it, otherwise
+// the -error-format default applies.
+func (app *application) wantsProblem(r *http.Request) bool {
+	plain := false
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, _ := mime.ParseMediaType(strings.TrimSpace(part))
+		switch mt {
+		case "application/problem+json":
+			return true
+		case "application/json":
+			plain = true
+		}
+	}
+	if plain {
+		return false
+	}
+	return app.config.errors.format != errorFormatLegacy
+}
+
+// errResponse writes an error with the given status. code names the
+// error for problem+json clients, msg is a string, or a validator with
+// errors about the request's fields.
+func (app *application) errResponse(w http.ResponseWriter, r *http.Request, status int, code string, msg interface{}) {
+	w.Header().Add("Vary", "Accept")
+	if !app.wantsProblem(r) {
+		if v, ok := msg.(*validator.Validator); ok {
+			msg = v.Errors
+		}
+		err := app.writeJSON(w, status, envelope{"error": msg}, nil)
+		if err != nil {
+			app.logError(r, err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	p := problem{
+		Type:     app.config.errors.typeBase + code,
+		Title:    http.StatusText(status),
+		Status:   status,
+		Instance: app.contextGetRequestID(r),
+		Code:     code,
+	}
+	switch m := msg.(type) {
+	case string:
+		p.Detail = m
+	case *validator.Validator:
+		p.Detail = "the request has invalid fields"
+		fields := make([]string, 0, len(m.Errors))
+		for f := range m.Errors {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+		for _, f := range fields {
+			p.Errors = append(p.Errors, fieldProblem{Field: f, Code: m.Code(f), Detail: m.Errors[f]})
+		}
+	default:
+		p.Detail = fmt.Sprint(m)
+	}
+	js, err := json.Marshal(p)
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	w.Write(js)
 }
 
 func (app *application) serverErrResponse(w http.ResponseWriter,
 	r *http.Request, err error) {
 	app.logError(r, err)
 	msg := "the server encountered a problem and could not process your request"
-	app.errResponse(w, r, http.StatusInternalServerError, msg)
+	app.errResponse(w, r, http.StatusInternalServerError, "server_error", msg)
 }
 
 func (app *application) notFountResponse(w http.ResponseWriter, r *http.Request) {
 	msg := "the requested resource could not be found"
-	app.errResponse(w, r, http.StatusNotFound, msg)
+	app.errResponse(w, r, http.StatusNotFound, "not_found", msg)
 }
 
 func (app *application) methodNotAllowResponse(w http.ResponseWriter, r *http.Request) {
 	msg := fmt.Sprintf("the %s mehtod is not supported for this resource", r.Method)
-	app.errResponse(w, r, http.StatusMethodNotAllowed, msg)
+	app.errResponse(w, r, http.StatusMethodNotAllowed, "method_not_allowed", msg)
 }
 
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.errResponse(w, r, http.StatusBadRequest, err.Error())
+	app.errResponse(w, r, http.StatusBadRequest, "bad_request", err.Error())
 }
 
-func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errs map[string]string) {
-	app.errResponse(w, r, http.StatusUnprocessableEntity, errs)
+func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, v *validator.Validator) {
+	app.errResponse(w, r, http.StatusUnprocessableEntity, "validation_failed", v)
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	msg := "unable to update the record due to an edit conflict, please try later"
-	app.errResponse(w, r, http.StatusConflict, msg)
+	app.errResponse(w, r, http.StatusConflict, "edit_conflict", msg)
 }
 
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	msg := "rate limit exceeded"
-	app.errResponse(w, r, http.StatusTooManyRequests, msg)
+	app.errResponse(w, r, http.StatusTooManyRequests, "rate_limit_exceeded", msg)
 }
 
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	msg := "invalid authentication credentials"
-	app.errResponse(w, r, http.StatusBadRequest, msg)
+	app.errResponse(w, r, http.StatusBadRequest, "invalid_credentials", msg)
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
 	msg := "invalid or missing authentication token"
-	app.errResponse(w, r, http.StatusBadRequest, msg)
+	app.errResponse(w, r, http.StatusBadRequest, "invalid_authentication_token", msg)
 }
 
 func (app *application) authenticationRequireResponse(w http.ResponseWriter, r *http.Request) {
 	msg := "you must be authenticated to access this resource"
-	app.errResponse(w, r, http.StatusUnauthorized, msg)
+	app.errResponse(w, r, http.StatusUnauthorized, "authentication_required", msg)
 }
 
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
 	msg := "your user account must be activated to access this resource"
-	app.errResponse(w, r, http.StatusForbidden, msg)
+	app.errResponse(w, r, http.StatusForbidden, "inactive_account", msg)
 }
 
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	msg := "your user account doesn't have the necessary permissions to access this resource"
-	app.errResponse(w, r, http.StatusForbidden, msg)
+	app.errResponse(w, r, http.StatusForbidden, "not_permitted", msg)
+}
+
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, supported ...string) {
+	msg := "the request body must be one of: " + strings.Join(supported, ", ")
+	app.errResponse(w, r, http.StatusUnsupportedMediaType, "unsupported_media_type", msg)
+}
+
+func (app *application) idempotencyKeyReusedResponse(w http.ResponseWriter, r *http.Request) {
+	msg := "this Idempotency-Key was already used for a request to another endpoint"
+	app.errResponse(w, r, http.StatusConflict, "idempotency_key_reused", msg)
+}
+
+func (app *application) idempotencyMismatchResponse(w http.ResponseWriter, r *http.Request) {
+	msg := "this Idempotency-Key was already used with a different request body"
+	app.errResponse(w, r, http.StatusUnprocessableEntity, "idempotency_key_mismatch", msg)
+}
+
+func (app *application) idempotencyInProgressResponse(w http.ResponseWriter, r *http.Request) {
+	msg := "a request with this Idempotency-Key is still running, retry it later"
+	app.errResponse(w, r, http.StatusConflict, "idempotency_key_in_progress", msg)
 }
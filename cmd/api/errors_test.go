@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/datewu/xyz/internal/data"
+	"github.com/datewu/xyz/internal/validator"
+)
+
+func TestFailedValidationCodes(t *testing.T) {
+	app := &application{}
+	app.config.errors.format = errorFormatProblem
+
+	v := validator.New()
+	data.ValidateMovie(v, &data.Movie{Year: 1800, Runtime: -1, Genres: []string{"a", "a"}})
+	v.AddErrCode("email", validator.CodeAlreadyExists, "a user with this emal address already exists")
+	v.AddErr("token", "invalid or expired activation token")
+
+	rr := httptest.NewRecorder()
+	app.failedValidationResponse(rr, httptest.NewRequest(http.MethodPost, "/v1/movies", nil), v)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d", rr.Code)
+	}
+	var p problem
+	if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, fp := range p.Errors {
+		got[fp.Field] = fp.Code
+	}
+	want := map[string]string{
+		"title":   validator.CodeRequired,
+		"year":    validator.CodeTooSmall,
+		"runtime": validator.CodeTooSmall,
+		"genres":  validator.CodeDuplicate,
+		"email":   validator.CodeAlreadyExists,
+		"token":   validator.CodeInvalid,
+	}
+	if len(got) != len(want) {
+		t.Errorf("got fields %v, want %v", got, want)
+	}
+	for f, code := range want {
+		if got[f] != code {
+			t.Errorf("%s: got code %q, want %q", f, got[f], code)
+		}
+	}
+}
+
+func TestFailedValidationLegacy(t *testing.T) {
+	app := &application{}
+	app.config.errors.format = errorFormatLegacy
+
+	v := validator.New()
+	v.CheckCode(false, "title", validator.CodeRequired, "must be provided")
+
+	rr := httptest.NewRecorder()
+	app.failedValidationResponse(rr, httptest.NewRequest(http.MethodPost, "/v1/movies", nil), v)
+	var body struct {
+		Error map[string]string `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Error) != 1 || body.Error["title"] != "must be provided" {
+		t.Errorf("got %v", body.Error)
+	}
+}
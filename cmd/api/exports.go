@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/datewu/xyz/internal/data"
+	"github.com/datewu/xyz/internal/validator"
+)
+
+// exportFlushRows is how many movies are written between flushes, so a
+// client sees the export arrive while it's being read.
+const exportFlushRows = 100
+
+// exportContentTypes maps every export format to its media type.
+var exportContentTypes = map[string]string{
+	"ndjson": "application/x-ndjson",
+	"csv":    "text/csv",
+	"json":   "application/json",
+}
+
+// readExportFormat picks ndjson, csv or json from ?format, falling back
+// to the Accept header and then to ndjson.
+func (app *application) readExportFormat(r *http.Request) string {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return strings.ToLower(f)
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, _ := mime.ParseMediaType(strings.TrimSpace(part))
+		for format, ct := range exportContentTypes {
+			if mt == ct {
+				return format
+			}
+		}
+	}
+	return "ndjson"
+}
+
+// movieEncoder writes one movie of an export, and whatever must come
+// before the first or after the last.
+type movieEncoder interface {
+	begin() error
+	encode(m *data.Movie) error
+	end() error
+}
+
+type ndjsonMovieEncoder struct {
+	enc *json.Encoder
+}
+
+func (e *ndjsonMovieEncoder) begin() error { return nil }
+
+func (e *ndjsonMovieEncoder) encode(m *data.Movie) error { return e.enc.Encode(m) }
+
+func (e *ndjsonMovieEncoder) end() error { return nil }
+
+type jsonMovieEncoder struct {
+	w     io.Writer
+	count int
+}
+
+func (e *jsonMovieEncoder) begin() error {
+	_, err := io.WriteString(e.w, "[")
+	return err
+}
+
+func (e *jsonMovieEncoder) encode(m *data.Movie) error {
+	js, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if e.count > 0 {
+		js = append([]byte(",\n"), js...)
+	}
+	e.count++
+	_, err = e.w.Write(js)
+	return err
+}
+
+func (e *jsonMovieEncoder) end() error {
+	_, err := io.WriteString(e.w, "]\n")
+	return err
+}
+
+// csvMovieEncoder writes the columns an import reads back, runtime in
+// minutes and genres separated by "|", plus id and version.
+type csvMovieEncoder struct {
+	w *csv.Writer
+}
+
+func (e *csvMovieEncoder) begin() error {
+	return e.w.Write([]string{"id", "title", "year", "runtime", "genres", "version"})
+}
+
+func (e *csvMovieEncoder) encode(m *data.Movie) error {
+	return e.w.Write([]string{
+		strconv.FormatInt(m.ID, 10),
+		m.Title,
+		strconv.FormatInt(int64(m.Year), 10),
+		strconv.FormatInt(int64(m.Runtime), 10),
+		strings.Join(m.Genres, "|"),
+		strconv.FormatInt(int64(m.Version), 10),
+	})
+}
+
+func (e *csvMovieEncoder) end() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// exportMoviesHandler streams every movie matching the filters the list
+// endpoint takes, without paging. Each flush moves the write deadline
+// on, so an export runs for as long as the client keeps reading it.
+// Once the first bytes are out there's no error response left to send,
+// so a failure is logged and the body cut short, the Export-Status
+// trailer then says "error", or is missing when the connection went.
+func (app *application) exportMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title  string
+		Genres []string
+		data.Filters
+	}
+
+	includeDeleted, ok := app.readIncludeDeleted(w, r)
+	if !ok {
+		return
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	format := app.readExportFormat(r)
+	input.Title = app.readString(qs, "title", "")
+	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.Sort = app.readString(qs, "sort", "id")
+	input.SortSafelist = []string{"id", "title", "year", "runtime",
+		"-id", "-title", "-year", "-runtime"}
+	v.Check(validator.In(input.Sort, input.SortSafelist...), "sort", "invalid sort value")
+	v.Check(validator.In(format, "ndjson", "csv", "json"), "format", "must be ndjson, csv or json")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	bw := bufio.NewWriter(w)
+	var enc movieEncoder
+	switch format {
+	case "csv":
+		enc = &csvMovieEncoder{w: csv.NewWriter(bw)}
+	case "json":
+		enc = &jsonMovieEncoder{w: bw}
+	default:
+		enc = &ndjsonMovieEncoder{enc: json.NewEncoder(bw)}
+	}
+	flusher, _ := w.(http.Flusher)
+	flush := func() error {
+		if c, ok := enc.(*csvMovieEncoder); ok {
+			c.w.Flush()
+		}
+		extendWriteDeadline(r)
+		err := bw.Flush()
+		if err == nil && flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	}
+
+	w.Header().Set("Content-Type", exportContentTypes[format])
+	w.Header().Set("Content-Disposition", `attachment; filename="movies.`+format+`"`)
+	w.Header().Set("Trailer", "Export-Status")
+	extendWriteDeadline(r)
+	w.WriteHeader(http.StatusOK)
+
+	err := enc.begin()
+	rows := 0
+	if err == nil {
+		err = app.modelsFor(r).Movies.Stream(r.Context(), input.Title, input.Genres, includeDeleted, input.Filters, func(m *data.Movie) error {
+			err := enc.encode(m)
+			if err != nil {
+				return err
+			}
+			rows++
+			if rows%exportFlushRows == 0 {
+				return flush()
+			}
+			return nil
+		})
+	}
+	if err == nil {
+		err = enc.end()
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		w.Header().Set("Export-Status", "error")
+	} else {
+		w.Header().Set("Export-Status", "complete")
+	}
+	// an aborted download isn't worth logging
+	if err != nil && r.Context().Err() == nil {
+		app.logError(r, err)
+	}
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/datewu/xyz/internal/data"
+	"github.com/datewu/xyz/internal/graphql"
+	"github.com/datewu/xyz/internal/validator"
+)
+
+// graphqlInput is a GraphQL request. extensions, sent by some clients
+// for persisted queries, is ignored.
+type graphqlInput struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+	Extensions    map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// graphqlHandler runs a GraphQL request, posted as JSON or, for
+// queries only, sent as GET parameters. Errors of the query are
+// reported in the response's errors with a 200, like GraphQL servers
+// do, only a body that can't be read is a 400.
+func (app *application) graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	var input graphqlInput
+	opts := graphql.Options{
+		MaxDepth:      app.config.graphql.maxDepth,
+		MaxComplexity: app.config.graphql.maxComplexity,
+	}
+	if r.Method == http.MethodGet {
+		qs := r.URL.Query()
+		input.Query = app.readString(qs, "query", "")
+		input.OperationName = app.readString(qs, "operationName", "")
+		if vars := qs.Get("variables"); vars != "" {
+			err := json.Unmarshal([]byte(vars), &input.Variables)
+			if err != nil {
+				app.badRequestResponse(w, r, errors.New("variables must be a JSON object"))
+				return
+			}
+		}
+		opts.QueryOnly = true
+	} else {
+		err := app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	}
+	v := validator.New()
+	if v.CheckCode(input.Query != "", "query", validator.CodeRequired, "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), graphqlRequestContextKey, r)
+	resp := graphql.Execute(ctx, app.graphqlSchema, graphql.Request{
+		Query:         input.Query,
+		OperationName: input.OperationName,
+		Variables:     input.Variables,
+	}, opts)
+	env := envelope{}
+	if resp.Data != nil {
+		env["data"] = resp.Data
+	}
+	if len(resp.Errors) > 0 {
+		env["errors"] = resp.Errors
+	}
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+// graphqlRequest returns the request a resolver runs for.
+func graphqlRequest(ctx context.Context) *http.Request {
+	r, ok := ctx.Value(graphqlRequestContextKey).(*http.Request)
+	if !ok {
+		panic("missing request value in graphql context")
+	}
+	return r
+}
+
+// gqlError is an error of a resolver, code being the same stable name
+// the REST endpoints give it.
+func gqlError(code, msg string) *graphql.Error {
+	return &graphql.Error{Message: msg, Extensions: map[string]interface{}{"code": code}}
+}
+
+func (app *application) gqlServerError(r *http.Request, err error) *graphql.Error {
+	app.logError(r, err)
+	return gqlError("server_error", "the server encountered a problem and could not process your request")
+}
+
+func gqlNotFound() *graphql.Error {
+	return gqlError("not_found", "the requested resource could not be found")
+}
+
+func gqlEditConflict() *graphql.Error {
+	return gqlError("edit_conflict", "unable to update the record due to an edit conflict, please try later")
+}
+
+// gqlValidationError reports the validator's errors under the names of
+// the GraphQL arguments they're about.
+func gqlValidationError(errs map[string]string) *graphql.Error {
+	fields := make(map[string]string, len(errs))
+	for k, msg := range errs {
+		if k == "page_size" {
+			k = "pageSize"
+		}
+		fields[k] = msg
+	}
+	e := gqlError("validation_failed", "the request has invalid fields")
+	e.Extensions["fields"] = fields
+	return e
+}
+
+// gqlRequirePermission checks the request's user the way the
+// requirePermission middleware does, for a resolver to stop with the
+// error it returns.
+func (app *application) gqlRequirePermission(r *http.Request, code string) error {
+	user := app.contextGetUser(r)
+	switch {
+	case user.IsAnonymous():
+		return gqlError("authentication_required", "you must be authenticated to access this resource")
+	case !user.Activated:
+		return gqlError("inactive_account", "your user account must be activated to access this resource")
+	}
+	ps, err := app.modelsFor(r).Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return app.gqlServerError(r, err)
+	}
+	if !ps.Include(code) {
+		return gqlError("not_permitted", "your user account doesn't have the necessary permissions to access this resource")
+	}
+	return nil
+}
+
+// gqlID reads an ID argument, 0 for one that can't be a record's.
+func gqlID(arg interface{}) int64 {
+	s, _ := arg.(string)
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 1 {
+		return 0
+	}
+	return id
+}
+
+func gqlStrings(arg interface{}) []string {
+	items, ok := arg.([]interface{})
+	if !ok {
+		return nil
+	}
+	ss := make([]string, len(items))
+	for i, item := range items {
+		ss[i], _ = item.(string)
+	}
+	return ss
+}
+
+// newGraphQLSchema builds the schema of /v1/graphql over the movie and
+// user models.
+func (app *application) newGraphQLSchema() *graphql.Schema {
+	nonNull := func(t graphql.Type) graphql.Type { return &graphql.NonNull{Of: t} }
+	listOf := func(t graphql.Type) graphql.Type { return &graphql.List{Of: t} }
+	movieField := func(t graphql.Type, get func(m *data.Movie) interface{}) *graphql.Field {
+		return &graphql.Field{Type: t, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(*data.Movie)), nil
+		}}
+	}
+	userField := func(t graphql.Type, get func(u *data.User) interface{}) *graphql.Field {
+		return &graphql.Field{Type: t, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(*data.User)), nil
+		}}
+	}
+	metadataField := func(get func(m data.Metadata) int) *graphql.Field {
+		return &graphql.Field{Type: nonNull(graphql.Int), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(movieConnection).metadata), nil
+		}}
+	}
+
+	movie := &graphql.Object{Name: "Movie", Fields: map[string]*graphql.Field{
+		"id":      movieField(nonNull(graphql.ID), func(m *data.Movie) interface{} { return m.ID }),
+		"title":   movieField(nonNull(graphql.String), func(m *data.Movie) interface{} { return m.Title }),
+		"year":    movieField(nonNull(graphql.Int), func(m *data.Movie) interface{} { return int(m.Year) }),
+		"runtime": movieField(nonNull(graphql.Int), func(m *data.Movie) interface{} { return int(m.Runtime) }),
+		"genres": movieField(nonNull(listOf(nonNull(graphql.String))), func(m *data.Movie) interface{} {
+			if m.Genres == nil {
+				return []string{}
+			}
+			return m.Genres
+		}),
+		"version": movieField(nonNull(graphql.Int), func(m *data.Movie) interface{} { return int(m.Version) }),
+		"deletedAt": movieField(graphql.String, func(m *data.Movie) interface{} {
+			if m.DeletedAt == nil {
+				return nil
+			}
+			return m.DeletedAt.Format(time.RFC3339)
+		}),
+	}}
+	metadata := &graphql.Object{Name: "Metadata", Fields: map[string]*graphql.Field{
+		"currentPage":  metadataField(func(m data.Metadata) int { return m.CurrentPage }),
+		"pageSize":     metadataField(func(m data.Metadata) int { return m.PageSize }),
+		"firstPage":    metadataField(func(m data.Metadata) int { return m.FirstPage }),
+		"lastPage":     metadataField(func(m data.Metadata) int { return m.LastPage }),
+		"totalRecords": metadataField(func(m data.Metadata) int { return m.TotalRecords }),
+	}}
+	moviePage := &graphql.Object{Name: "MoviePage", Fields: map[string]*graphql.Field{
+		"movies": {Type: nonNull(listOf(nonNull(movie))), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(movieConnection).movies, nil
+		}},
+		"metadata": {Type: nonNull(metadata), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source, nil
+		}},
+	}}
+	user := &graphql.Object{Name: "User", Fields: map[string]*graphql.Field{
+		"id":          userField(nonNull(graphql.ID), func(u *data.User) interface{} { return u.ID }),
+		"name":        userField(nonNull(graphql.String), func(u *data.User) interface{} { return u.Name }),
+		"email":       userField(nonNull(graphql.String), func(u *data.User) interface{} { return u.Email }),
+		"activated":   userField(nonNull(graphql.Boolean), func(u *data.User) interface{} { return u.Activated }),
+		"locale":      userField(nonNull(graphql.String), func(u *data.User) interface{} { return u.Locale }),
+		"createdAt":   userField(nonNull(graphql.String), func(u *data.User) interface{} { return u.CreatedAt.Format(time.RFC3339) }),
+		"permissions": {Type: nonNull(listOf(nonNull(graphql.String))), Resolve: app.resolveUserPermissions},
+	}}
+
+	movieArgs := []*graphql.Arg{
+		{Name: "title", Type: graphql.String},
+		{Name: "year", Type: graphql.Int},
+		{Name: "runtime", Type: graphql.Int},
+		{Name: "genres", Type: listOf(nonNull(graphql.String))},
+	}
+	return &graphql.Schema{
+		Query: &graphql.Object{Name: "Query", Fields: map[string]*graphql.Field{
+			"movie": {
+				Type: movie,
+				Args: []*graphql.Arg{
+					{Name: "id", Type: nonNull(graphql.ID)},
+					{Name: "includeDeleted", Type: graphql.Boolean, Default: false},
+				},
+				Resolve: app.resolveMovie,
+			},
+			"movies": {
+				Type: nonNull(moviePage),
+				Args: []*graphql.Arg{
+					{Name: "title", Type: graphql.String, Default: ""},
+					{Name: "genres", Type: listOf(nonNull(graphql.String))},
+					{Name: "includeDeleted", Type: graphql.Boolean, Default: false},
+					{Name: "page", Type: graphql.Int, Default: 1},
+					{Name: "pageSize", Type: graphql.Int, Default: 20},
+					{Name: "sort", Type: graphql.String, Default: "id"},
+				},
+				Resolve: app.resolveMovies,
+				Multiplier: func(args map[string]interface{}) int {
+					n, _ := args["pageSize"].(int)
+					return n
+				},
+			},
+			"me": {Type: nonNull(user), Resolve: app.resolveMe},
+		}},
+		Mutation: &graphql.Object{Name: "Mutation", Fields: map[string]*graphql.Field{
+			"createMovie": {
+				Type:    nonNull(movie),
+				Args:    movieArgs,
+				Resolve: app.resolveCreateMovie,
+			},
+			"updateMovie": {
+				Type: nonNull(movie),
+				Args: append([]*graphql.Arg{
+					{Name: "id", Type: nonNull(graphql.ID)},
+					{Name: "expectedVersion", Type: graphql.Int},
+				}, movieArgs...),
+				Resolve: app.resolveUpdateMovie,
+			},
+			"deleteMovie": {
+				Type:    nonNull(movie),
+				Args:    []*graphql.Arg{{Name: "id", Type: nonNull(graphql.ID)}},
+				Resolve: app.resolveDeleteMovie,
+			},
+		}},
+	}
+}
+
+// movieConnection is a page of movies, the source of MoviePage and of
+// its metadata.
+type movieConnection struct {
+	movies   []*data.Movie
+	metadata data.Metadata
+}
+
+// gqlIncludeDeleted checks the user may see deleted movies, when they
+// ask to.
+func (app *application) gqlIncludeDeleted(r *http.Request, args map[string]interface{}) (bool, error) {
+	includeDeleted, _ := args["includeDeleted"].(bool)
+	if !includeDeleted {
+		return false, nil
+	}
+	return true, app.gqlRequirePermission(r, "movies:deleted")
+}
+
+func (app *application) resolveMovie(p graphql.ResolveParams) (interface{}, error) {
+	r := graphqlRequest(p.Context)
+	err := app.gqlRequirePermission(r, "movies:read")
+	if err != nil {
+		return nil, err
+	}
+	includeDeleted, err := app.gqlIncludeDeleted(r, p.Args)
+	if err != nil {
+		return nil, err
+	}
+	m, err := app.modelsFor(r).Movies.GetFields(gqlID(p.Args["id"]), includeDeleted, nil)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, nil
+		default:
+			return nil, app.gqlServerError(r, err)
+		}
+	}
+	return m, nil
+}
+
+func (app *application) resolveMovies(p graphql.ResolveParams) (interface{}, error) {
+	r := graphqlRequest(p.Context)
+	err := app.gqlRequirePermission(r, "movies:read")
+	if err != nil {
+		return nil, err
+	}
+	includeDeleted, err := app.gqlIncludeDeleted(r, p.Args)
+	if err != nil {
+		return nil, err
+	}
+	title, _ := p.Args["title"].(string)
+	genres := gqlStrings(p.Args["genres"])
+	if genres == nil {
+		genres = []string{}
+	}
+	filters := data.Filters{
+		Page:         p.Args["page"].(int),
+		PageSize:     p.Args["pageSize"].(int),
+		Sort:         p.Args["sort"].(string),
+		SortSafelist: movieSorts,
+	}
+	v := validator.New()
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		return nil, gqlValidationError(v.Errors)
+	}
+	movies, metadata, err := app.modelsFor(r).Movies.GetAll(title, genres, includeDeleted, nil, filters)
+	if err != nil {
+		return nil, app.gqlServerError(r, err)
+	}
+	return movieConnection{movies: movies, metadata: metadata}, nil
+}
+
+func (app *application) resolveMe(p graphql.ResolveParams) (interface{}, error) {
+	r := graphqlRequest(p.Context)
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		return nil, gqlError("authentication_required", "you must be authenticated to access this resource")
+	}
+	return user, nil
+}
+
+func (app *application) resolveUserPermissions(p graphql.ResolveParams) (interface{}, error) {
+	r := graphqlRequest(p.Context)
+	ps, err := app.modelsFor(r).Permissions.GetAllForUser(p.Source.(*data.User).ID)
+	if err != nil {
+		return nil, app.gqlServerError(r, err)
+	}
+	if ps == nil {
+		return []string{}, nil
+	}
+	return []string(ps), nil
+}
+
+// setMovieArgs copies the movie fields given as arguments onto m.
+func setMovieArgs(m *data.Movie, args map[string]interface{}) {
+	if title, ok := args["title"].(string); ok {
+		m.Title = title
+	}
+	if year, ok := args["year"].(int); ok {
+		m.Year = int32(year)
+	}
+	if runtime, ok := args["runtime"].(int); ok {
+		m.Runtime = data.Runtime(runtime)
+	}
+	if genres := gqlStrings(args["genres"]); genres != nil {
+		m.Genres = genres
+	}
+}
+
+func (app *application) resolveCreateMovie(p graphql.ResolveParams) (interface{}, error) {
+	r := graphqlRequest(p.Context)
+	err := app.gqlRequirePermission(r, "movies:write")
+	if err != nil {
+		return nil, err
+	}
+	m := &data.Movie{}
+	setMovieArgs(m, p.Args)
+
+	v := validator.New()
+	if data.ValidateMovie(v, m); !v.Valid() {
+		return nil, gqlValidationError(v.Errors)
+	}
+	err = app.inTx(r, func(r *http.Request) error {
+		err := app.modelsFor(r).Movies.Insert(m, app.contextGetUser(r).ID)
+		if err != nil {
+			return err
+		}
+		err = app.audit(r, auditEvent{
+			Action:       "movie.create",
+			ResourceType: "movie",
+			ResourceID:   strconv.FormatInt(m.ID, 10),
+			After:        m,
+		})
+		if err != nil {
+			return err
+		}
+		return app.publish(r, eventMovieCreated, m)
+	})
+	if err != nil {
+		return nil, app.gqlServerError(r, err)
+	}
+	return m, nil
+}
+
+func (app *application) resolveUpdateMovie(p graphql.ResolveParams) (interface{}, error) {
+	r := graphqlRequest(p.Context)
+	err := app.gqlRequirePermission(r, "movies:write")
+	if err != nil {
+		return nil, err
+	}
+	m, err := app.modelsFor(r).Movies.Get(gqlID(p.Args["id"]))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, gqlNotFound()
+		default:
+			return nil, app.gqlServerError(r, err)
+		}
+	}
+	before := *m
+	if version, ok := p.Args["expectedVersion"].(int); ok && int32(version) != m.Version {
+		return nil, gqlEditConflict()
+	}
+	setMovieArgs(m, p.Args)
+
+	v := validator.New()
+	if data.ValidateMovie(v, m); !v.Valid() {
+		return nil, gqlValidationError(v.Errors)
+	}
+	err = app.inTx(r, func(r *http.Request) error {
+		err := app.modelsFor(r).Movies.Update(m, app.contextGetUser(r).ID)
+		if err != nil {
+			return err
+		}
+		err = app.audit(r, auditEvent{
+			Action:       "movie.update",
+			ResourceType: "movie",
+			ResourceID:   strconv.FormatInt(m.ID, 10),
+			Before:       before,
+			After:        m,
+		})
+		if err != nil {
+			return err
+		}
+		return app.publish(r, eventMovieUpdated, m)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return nil, gqlEditConflict()
+		default:
+			return nil, app.gqlServerError(r, err)
+		}
+	}
+	return m, nil
+}
+
+func (app *application) resolveDeleteMovie(p graphql.ResolveParams) (interface{}, error) {
+	r := graphqlRequest(p.Context)
+	err := app.gqlRequirePermission(r, "movies:write")
+	if err != nil {
+		return nil, err
+	}
+	id := gqlID(p.Args["id"])
+	m, err := app.modelsFor(r).Movies.Get(id)
+	var deleted *data.Movie
+	if err == nil {
+		err = app.inTx(r, func(r *http.Request) error {
+			var err error
+			deleted, err = app.modelsFor(r).Movies.Delete(id, app.contextGetUser(r).ID)
+			if err != nil {
+				return err
+			}
+			err = app.audit(r, auditEvent{
+				Action:       "movie.delete",
+				ResourceType: "movie",
+				ResourceID:   strconv.FormatInt(id, 10),
+				Before:       m,
+				After:        deleted,
+			})
+			if err != nil {
+				return err
+			}
+			return app.publish(r, eventMovieDeleted, deleted)
+		})
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, gqlNotFound()
+		default:
+			return nil, app.gqlServerError(r, err)
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/datewu/xyz/internal/data"
+)
+
+// gqlDo runs query against the GraphQL handler as user, and returns
+// the status and the decoded body.
+func gqlDo(t *testing.T, app *application, method string, user *data.User, query string) (int, map[string]interface{}) {
+	t.Helper()
+	var r *http.Request
+	if method == http.MethodGet {
+		r = httptest.NewRequest(method, "/v1/graphql?query="+url.QueryEscape(query), nil)
+	} else {
+		js, _ := json.Marshal(map[string]string{"query": query})
+		r = httptest.NewRequest(method, "/v1/graphql", strings.NewReader(string(js)))
+	}
+	r = app.contextSetUser(r, user)
+	w := httptest.NewRecorder()
+	app.graphqlHandler(w, r)
+	var body map[string]interface{}
+	err := json.Unmarshal(w.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	return w.Code, body
+}
+
+// gqlCodes lists the codes of a response's errors.
+func gqlCodes(body map[string]interface{}) []string {
+	errs, _ := body["errors"].([]interface{})
+	codes := make([]string, len(errs))
+	for i, e := range errs {
+		ext, _ := e.(map[string]interface{})["extensions"].(map[string]interface{})
+		codes[i], _ = ext["code"].(string)
+	}
+	return codes
+}
+
+func TestGraphQLPermissions(t *testing.T) {
+	app := &application{}
+	app.graphqlSchema = app.newGraphQLSchema()
+	inactive := &data.User{ID: 7, Name: "Alice", Email: "alice@example.com", Activated: false}
+
+	tests := []struct {
+		name  string
+		user  *data.User
+		query string
+		code  string
+	}{
+		{"anonymous movie", data.AnonymousUser, `{ movie(id: 1) { id } }`, "authentication_required"},
+		{"anonymous movies", data.AnonymousUser, `{ movies { movies { id } } }`, "authentication_required"},
+		{"anonymous me", data.AnonymousUser, `{ me { id } }`, "authentication_required"},
+		{"anonymous create", data.AnonymousUser,
+			`mutation { createMovie(title: "x", year: 2000, runtime: 90, genres: ["drama"]) { id } }`, "authentication_required"},
+		{"anonymous update", data.AnonymousUser, `mutation { updateMovie(id: 1, title: "x") { id } }`, "authentication_required"},
+		{"anonymous delete", data.AnonymousUser, `mutation { deleteMovie(id: 1) { id } }`, "authentication_required"},
+		{"inactive movie", inactive, `{ movie(id: 1) { id } }`, "inactive_account"},
+		{"inactive delete", inactive, `mutation { deleteMovie(id: 1) { id } }`, "inactive_account"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := gqlDo(t, app, http.MethodPost, tt.user, tt.query)
+			if status != http.StatusOK {
+				t.Errorf("got status %d", status)
+			}
+			codes := gqlCodes(body)
+			if len(codes) != 1 || codes[0] != tt.code {
+				t.Errorf("got codes %v, want [%s]", codes, tt.code)
+			}
+		})
+	}
+
+	_, body := gqlDo(t, app, http.MethodPost, inactive, `{ me { id name activated } }`)
+	want := map[string]interface{}{"me": map[string]interface{}{"id": "7", "name": "Alice", "activated": false}}
+	if js, _ := json.Marshal(body["data"]); string(js) != mustJSON(t, want) {
+		t.Errorf("got %s, want %s", js, mustJSON(t, want))
+	}
+}
+
+func TestGraphQLMutationOverGet(t *testing.T) {
+	app := &application{}
+	app.graphqlSchema = app.newGraphQLSchema()
+	_, body := gqlDo(t, app, http.MethodGet, data.AnonymousUser, `mutation { deleteMovie(id: 1) { id } }`)
+	if codes := gqlCodes(body); len(codes) != 1 || codes[0] != "operation_not_allowed" {
+		t.Errorf("got codes %v", codes)
+	}
+	if _, ok := body["data"]; ok {
+		t.Error("the mutation ran")
+	}
+}
+
+func TestGraphQLLimits(t *testing.T) {
+	tests := []struct {
+		maxDepth, maxComplexity int
+		query                   string
+		code                    string
+	}{
+		{2, 0, `{ movies { movies { id } } }`, "query_too_deep"},
+		{0, 50, `{ movies(pageSize: 100) { movies { id title } } }`, "query_too_complex"},
+		{3, 50, `{ movies(pageSize: 10) { movies { id title } } }`, "authentication_required"},
+	}
+	for _, tt := range tests {
+		app := &application{}
+		app.config.graphql.maxDepth = tt.maxDepth
+		app.config.graphql.maxComplexity = tt.maxComplexity
+		app.graphqlSchema = app.newGraphQLSchema()
+		_, body := gqlDo(t, app, http.MethodPost, data.AnonymousUser, tt.query)
+		if codes := gqlCodes(body); len(codes) != 1 || codes[0] != tt.code {
+			t.Errorf("%s: got codes %v, want [%s]", tt.query, codes, tt.code)
+		}
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	js, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(js)
+}
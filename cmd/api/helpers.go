@@ -7,9 +7,12 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/datewu/xyz/internal/data"
 	"github.com/datewu/xyz/internal/validator"
 	"github.com/julienschmidt/httprouter"
 )
@@ -40,9 +43,11 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 	return nil
 }
 
+// jsonMaxBytes caps a JSON request body.
+const jsonMaxBytes = 3 * 1_048_576
+
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
-	maxBytes := 3 * 1_048_576 // 3MB
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+	r.Body = http.MaxBytesReader(w, r.Body, jsonMaxBytes)
 	dec := json.NewDecoder(r.Body)
 	dec.DisallowUnknownFields()
 	err := dec.Decode(dst)
@@ -71,7 +76,7 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 
 			// an open issue at https://github.com/golang/go/issues/30715
 		case err.Error() == "http: request body too large":
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+			return fmt.Errorf("body must not be larger than %d bytes", jsonMaxBytes)
 
 		case errors.As(err, &invalidUnmarshalErr):
 			panic(err)
@@ -110,22 +115,91 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	}
 	i, err := strconv.Atoi(s)
 	if err != nil {
-		v.AddErr(key, "must be an integer value")
+		v.AddErrCode(key, validator.CodeInvalidFormat, "must be an integer value")
 		return defaultValue
 	}
 	return i
 }
 
-func (app *application) background(fn func()) {
-	rcv := func() {
-		if r := recover(); r != nil {
-			app.logger.PrintErr(fmt.Errorf("%s", r), nil)
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddErrCode(key, validator.CodeInvalidFormat, "must be a boolean value")
+		return defaultValue
+	}
+	return b
+}
+
+// readTime parses an RFC 3339 timestamp, the zero time means unset.
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		v.AddErrCode(key, validator.CodeInvalidFormat, "must be an RFC 3339 timestamp")
+		return time.Time{}
+	}
+	return t
+}
+
+// hasPermission reports whether the request's user holds code.
+func (app *application) hasPermission(r *http.Request, code string) (bool, error) {
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		return false, nil
+	}
+	ps, err := app.modelsFor(r).Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return false, err
+	}
+	return ps.Include(code), nil
+}
+
+// readLocale picks the supported mail locale the client prefers most
+// according to its Accept-Language header, or the default one.
+func (app *application) readLocale(r *http.Request) string {
+	type tag struct {
+		name string
+		q    float64
+	}
+	var tags []tag
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" || name == "*" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				v, err := strconv.ParseFloat(f[2:], 64)
+				if err == nil {
+					q = v
+				}
+			}
+		}
+		tags = append(tags, tag{name: name, q: q})
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	supported := app.mailer.Locales()
+	for _, t := range tags {
+		if t.q <= 0 {
+			continue
+		}
+		if validator.In(t.name, supported...) {
+			return t.name
+		}
+		if base := strings.SplitN(t.name, "-", 2)[0]; validator.In(base, supported...) {
+			return base
 		}
 	}
-	app.wg.Add(1)
-	go func() {
-		defer app.wg.Done()
-		defer rcv()
-		fn()
-	}()
+	return data.DefaultLocale
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/datewu/xyz/internal/data"
+)
+
+var idempotencyKeyRX = regexp.MustCompile(`^[\x21-\x7e]{1,255}$`)
+
+// idempotencyRecorder passes a response through while keeping a copy
+// of it to store.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	res data.StoredResponse
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.res.Status == 0 {
+		rec.res.Status = status
+		rec.res.Header = rec.Header().Clone()
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.res.Status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.res.Body = append(rec.res.Body, b...)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotencyLease is how long a request holds its Idempotency-Key. A
+// request can't write its response past the server's write timeout, so
+// an attempt still holding the key by then has crashed or hung.
+const idempotencyLease = serverWriteTimeout
+
+// idempotent makes a request carrying an Idempotency-Key header run at
+// most once per user and key within the configured window. A retry gets
+// the first attempt's response replayed, marked by Idempotent-Replayed,
+// or a conflict while that's still running. Server errors aren't stored,
+// so those requests can be retried for real. Anonymous requests have
+// their keys scoped to the client's IP instead, so one client can't
+// replay another's response. The body, up to maxBody bytes, is hashed
+// as the handler streams it rather than buffered.
+func (app *application) idempotent(maxBody int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		user := app.contextGetUser(r)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if !idempotencyKeyRX.MatchString(key) {
+			app.badRequestResponse(w, r, errors.New("Idempotency-Key must be 1 to 255 printable ASCII characters"))
+			return
+		}
+		client := ""
+		if user.IsAnonymous() {
+			ip, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				app.serverErrResponse(w, r, err)
+				return
+			}
+			client = ip
+		}
+		body := http.MaxBytesReader(w, r.Body, maxBody)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		req, err := app.modelsFor(r).Idempotency.Begin(ctx, user.ID, client, key,
+			r.Method, r.URL.RequestURI(), app.config.idempotency.ttl, idempotencyLease)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrIdempotencyKeyReused):
+				app.idempotencyKeyReusedResponse(w, r)
+			case errors.Is(err, data.ErrIdempotencyInProgress):
+				app.idempotencyInProgressResponse(w, r)
+			default:
+				app.serverErrResponse(w, r, err)
+			}
+			return
+		}
+		if req.Response != nil {
+			sum := sha256.New()
+			_, err := io.Copy(sum, body)
+			if err != nil {
+				app.badRequestResponse(w, r, fmt.Errorf("body must not be larger than %d bytes", maxBody))
+				return
+			}
+			if !req.Matches(sum.Sum(nil)) {
+				app.idempotencyMismatchResponse(w, r)
+				return
+			}
+			for k, v := range req.Response.Header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(req.Response.Status)
+			w.Write(req.Response.Body)
+			return
+		}
+
+		sum := sha256.New()
+		r.Body = ioutil.NopCloser(io.TeeReader(body, sum))
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		defer func() {
+			// the response is stored even when the client has gone,
+			// so the request's own context can't be used
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			if rec.res.Status == 0 || rec.res.Status >= 500 {
+				err := req.Abort(ctx)
+				if err != nil {
+					app.logError(r, err)
+				}
+				return
+			}
+			// hash what the handler left unread, a body over the limit
+			// hashes the same way on every attempt
+			io.Copy(ioutil.Discard, r.Body)
+			err := req.Complete(ctx, sum.Sum(nil), &rec.res)
+			if err != nil {
+				app.logError(r, err)
+			}
+		}()
+		next(rec, r)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/datewu/xyz/internal/data"
+	"github.com/datewu/xyz/internal/validator"
+)
+
+// idempotencyDriver is a database/sql driver keeping idempotency_keys
+// in memory, answering just the queries IdempotencyModel runs.
+type idempotencyDriver struct {
+	mu   sync.Mutex
+	rows map[[3]string]*idempotencyRow
+}
+
+type idempotencyRow struct {
+	method, path string
+	fingerprint  []byte
+	status       interface{}
+	header, body []byte
+	lockedUntil  interface{}
+}
+
+func (d *idempotencyDriver) Open(string) (driver.Conn, error) { return idempotencyConn{d}, nil }
+
+type idempotencyConn struct{ d *idempotencyDriver }
+
+func (c idempotencyConn) Prepare(query string) (driver.Stmt, error) {
+	return idempotencyStmt{c.d, query}, nil
+}
+func (c idempotencyConn) Close() error              { return nil }
+func (c idempotencyConn) Begin() (driver.Tx, error) { return c, nil }
+func (c idempotencyConn) Commit() error             { return nil }
+func (c idempotencyConn) Rollback() error           { return nil }
+
+type idempotencyStmt struct {
+	d     *idempotencyDriver
+	query string
+}
+
+func (s idempotencyStmt) Close() error  { return nil }
+func (s idempotencyStmt) NumInput() int { return -1 }
+
+func rowKey(args []driver.Value) [3]string {
+	return [3]string{fmt.Sprint(args[0]), args[1].(string), args[2].(string)}
+}
+
+func leaseEnd(ms driver.Value) time.Time {
+	return time.Now().Add(time.Duration(ms.(int64)) * time.Millisecond)
+}
+
+func (s idempotencyStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	switch {
+	case strings.Contains(s.query, "expires_at < NOW()"):
+		return driver.RowsAffected(0), nil
+	case strings.Contains(s.query, "SET status"):
+		row := s.d.rows[rowKey(args[4:])]
+		if row == nil || row.status != nil || !row.lockedUntil.(time.Time).Equal(args[7].(time.Time)) {
+			return driver.RowsAffected(0), nil
+		}
+		row.status, row.header, row.body, row.fingerprint = args[0], args[1].([]byte), args[2].([]byte), args[3].([]byte)
+		row.lockedUntil = nil
+		return driver.RowsAffected(1), nil
+	case strings.Contains(s.query, "DELETE"):
+		k := rowKey(args)
+		row := s.d.rows[k]
+		if row == nil || row.status != nil || !row.lockedUntil.(time.Time).Equal(args[3].(time.Time)) {
+			return driver.RowsAffected(0), nil
+		}
+		delete(s.d.rows, k)
+		return driver.RowsAffected(1), nil
+	}
+	return nil, errors.New("unexpected exec: " + s.query)
+}
+
+func (s idempotencyStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	k := rowKey(args)
+	row := s.d.rows[k]
+	switch {
+	case strings.Contains(s.query, "INSERT"):
+		if row != nil {
+			return &idempotencyRows{}, nil
+		}
+		row = &idempotencyRow{method: args[4].(string), path: args[5].(string), lockedUntil: leaseEnd(args[6])}
+		s.d.rows[k] = row
+		return &idempotencyRows{vals: [][]driver.Value{{row.lockedUntil}}}, nil
+	case strings.Contains(s.query, "SELECT"):
+		return &idempotencyRows{vals: [][]driver.Value{{
+			row.method, row.path, row.fingerprint, row.status, row.header, row.body, row.lockedUntil,
+		}}}, nil
+	case strings.Contains(s.query, "UPDATE"):
+		row.lockedUntil = leaseEnd(args[3])
+		return &idempotencyRows{vals: [][]driver.Value{{row.lockedUntil}}}, nil
+	}
+	return nil, errors.New("unexpected query: " + s.query)
+}
+
+type idempotencyRows struct {
+	vals [][]driver.Value
+}
+
+func (r *idempotencyRows) Columns() []string {
+	if len(r.vals) == 0 {
+		return []string{"locked_until"}
+	}
+	return make([]string, len(r.vals[0]))
+}
+func (r *idempotencyRows) Close() error { return nil }
+func (r *idempotencyRows) Next(dest []driver.Value) error {
+	if len(r.vals) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.vals[0])
+	r.vals = r.vals[1:]
+	return nil
+}
+
+var registerIdempotencyDriver sync.Once
+
+func TestIdempotentAnonymousRegistration(t *testing.T) {
+	registerIdempotencyDriver.Do(func() {
+		sql.Register("idempotencytest", &idempotencyDriver{rows: make(map[[3]string]*idempotencyRow)})
+	})
+	db, err := sql.Open("idempotencytest", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	app := &application{}
+	app.config.idempotency.ttl = time.Hour
+	app.models.Idempotency = data.IdempotencyModel{DB: db}
+
+	// registers each email once, the way registerUserHandler does
+	registered := make(map[string]bool)
+	register := app.idempotent(jsonMaxBytes, func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Email string `json:"email"`
+		}
+		if err := app.readJSON(w, r, &input); err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		if registered[input.Email] {
+			v := validator.New()
+			v.AddErrCode("email", validator.CodeAlreadyExists, "a user with this emal address already exists")
+			app.failedValidationResponse(w, r, v)
+			return
+		}
+		registered[input.Email] = true
+		app.writeJSON(w, http.StatusAccepted, envelope{"user": input}, nil)
+	})
+	do := func(remoteAddr, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(`{"email": "alice@example.com"}`))
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("Idempotency-Key", key)
+		r = app.contextSetUser(r, data.AnonymousUser)
+		rr := httptest.NewRecorder()
+		register(rr, r)
+		return rr
+	}
+
+	first := do("192.0.2.1:1234", "signup-1")
+	if first.Code != http.StatusAccepted {
+		t.Fatalf("first attempt got %d: %s", first.Code, first.Body)
+	}
+	replay := do("192.0.2.1:5678", "signup-1")
+	if replay.Code != http.StatusAccepted || replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry got %d, replayed %q, want the stored 202", replay.Code, replay.Header().Get("Idempotent-Replayed"))
+	}
+	if replay.Body.String() != first.Body.String() {
+		t.Errorf("retry got body %s, want %s", replay.Body, first.Body)
+	}
+	// the key is another client's, so this runs for real
+	other := do("198.51.100.7:1234", "signup-1")
+	if other.Code != http.StatusUnprocessableEntity || other.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("another client got %d, replayed %q, want a 422", other.Code, other.Header().Get("Idempotent-Replayed"))
+	}
+}
+
+func TestRegistrationIsIdempotent(t *testing.T) {
+	app := &application{}
+	for _, rt := range app.routeTable() {
+		if rt.method == http.MethodPost && rt.path == "/v1/users" {
+			if !rt.idempotent {
+				t.Error("POST /v1/users doesn't honour Idempotency-Key")
+			}
+			return
+		}
+	}
+	t.Error("no POST /v1/users route")
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/datewu/xyz/internal/data"
+	"github.com/datewu/xyz/internal/validator"
+)
+
+const (
+	// jobImportMovies runs an import too large to do in the request.
+	jobImportMovies = "movies.import"
+	// importSyncRows is the most rows an import may have to be run
+	// while the client waits, bigger ones become a job.
+	importSyncRows = 500
+	// importMaxBytes caps the upload size.
+	importMaxBytes = 32 * 1_048_576
+)
+
+type importMoviesPayload struct {
+	ImportID int64 `json:"import_id"`
+}
+
+// importRow is one parsed line of an import, Err is set when the
+// line couldn't even be decoded.
+type importRow struct {
+	line  int
+	movie *data.Movie
+	err   string
+}
+
+// readImportFormat picks csv or ndjson from ?format, falling back to
+// the Content-Type.
+func (app *application) readImportFormat(r *http.Request) string {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return strings.ToLower(f)
+	}
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mt {
+	case "text/csv":
+		return "csv"
+	case "application/x-ndjson", "application/jsonl", "application/json-lines":
+		return "ndjson"
+	}
+	return ""
+}
+
+// errImportTooLarge stops parsing an upload that has more rows than
+// may be imported while the client waits.
+var errImportTooLarge = errors.New("import too large to run synchronously")
+
+// parseImport decodes r one row at a time, handing each to fn, and
+// stops at the first error fn returns. CSV needs a header naming the
+// title, year, runtime and genres columns, with runtime in minutes and
+// genres separated by "|". NDJSON takes one movie object per line, in
+// the same shape POST /v1/movies accepts.
+func parseImport(format string, r io.Reader, fn func(importRow) error) error {
+	switch format {
+	case "csv":
+		return parseImportCSV(r, fn)
+	case "ndjson":
+		return parseImportNDJSON(r, fn)
+	}
+	return fmt.Errorf("unsupported import format %q", format)
+}
+
+func parseImportCSV(r io.Reader, fn func(importRow) error) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("csv header: %w", err)
+	}
+	cols := make(map[string]int)
+	for i, name := range header {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"title", "year", "runtime", "genres"} {
+		if _, ok := cols[name]; !ok {
+			return fmt.Errorf("csv header: missing %q column", name)
+		}
+	}
+
+	// line counts records, the header being 1, which is the line
+	// number unless a quoted field spans several lines
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return err
+			}
+			err = fn(importRow{line: parseErr.StartLine, err: parseErr.Err.Error()})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		field := func(name string) string {
+			if i := cols[name]; i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		row := importRow{line: line, movie: &data.Movie{Title: field("title")}}
+		if y := field("year"); y != "" {
+			n, err := strconv.ParseInt(y, 10, 32)
+			if err != nil {
+				row.err = "year must be an integer"
+			}
+			row.movie.Year = int32(n)
+		}
+		if rt := strings.TrimSuffix(field("runtime"), " mins"); rt != "" {
+			n, err := strconv.ParseInt(rt, 10, 32)
+			if err != nil {
+				row.err = "runtime must be a number of minutes"
+			}
+			row.movie.Runtime = data.Runtime(n)
+		}
+		if g := field("genres"); g != "" {
+			row.movie.Genres = strings.Split(g, "|")
+			for i := range row.movie.Genres {
+				row.movie.Genres[i] = strings.TrimSpace(row.movie.Genres[i])
+			}
+		}
+		err = fn(row)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func parseImportNDJSON(r io.Reader, fn func(importRow) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1_048_576)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := bytes.TrimSpace(sc.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var input struct {
+			Title   string       `json:"title"`
+			Year    int32        `json:"year"`
+			Runtime data.Runtime `json:"runtime"`
+			Genres  []string     `json:"genres"`
+		}
+		dec := json.NewDecoder(bytes.NewReader(text))
+		dec.DisallowUnknownFields()
+		row := importRow{line: line}
+		err := dec.Decode(&input)
+		if err != nil {
+			row.err = err.Error()
+		} else {
+			row.movie = &data.Movie{
+				Title:   input.Title,
+				Year:    input.Year,
+				Runtime: input.Runtime,
+				Genres:  input.Genres,
+			}
+		}
+		err = fn(row)
+		if err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// runImport validates every row and, unless dryRun, inserts the valid
+// ones in a single transaction and queues a movie.created event for
+// each through models. Invalid rows are reported by line.
+func (app *application) runImport(ctx context.Context, models data.Models, rows []importRow, dryRun bool, userID int64) (*data.ImportReport, error) {
+	report := &data.ImportReport{
+		DryRun: dryRun,
+		Rows:   len(rows),
+		Errors: []data.ImportRowError{},
+	}
+	var valid []*data.Movie
+	for _, row := range rows {
+		if row.err != "" {
+			report.Errors = append(report.Errors, data.ImportRowError{
+				Line:   row.line,
+				Errors: map[string]string{"row": row.err},
+			})
+			continue
+		}
+		v := validator.New()
+		if data.ValidateMovie(v, row.movie); !v.Valid() {
+			report.Errors = append(report.Errors, data.ImportRowError{Line: row.line, Errors: v.Errors})
+			continue
+		}
+		valid = append(valid, row.movie)
+	}
+	report.Valid = len(valid)
+	if dryRun || len(valid) == 0 {
+		return report, nil
+	}
+	inserted, err := models.Movies.InsertBatch(ctx, valid, userID)
+	if err != nil {
+		return nil, err
+	}
+	report.Inserted = len(inserted)
+	payloads := make([]interface{}, len(inserted))
+	for i, m := range inserted {
+		payloads[i] = m
+	}
+	err = app.enqueueEvent(models, eventMovieCreated, payloads...)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// importMoviesHandler runs small imports right away and answers with
+// the report, larger ones are stored and handed to a job, answered
+// with 202 and the import to poll. ?async=true forces a job.
+func (app *application) importMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	format := app.readImportFormat(r)
+	dryRun := app.readBool(qs, "dry_run", false, v)
+	async := app.readBool(qs, "async", false, v)
+	v.Check(validator.In(format, "csv", "ndjson"), "format", "must be csv or ndjson, by ?format or Content-Type")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	// rows are parsed as the body streams in, a copy of it is only
+	// kept to hand an import too large to run here to a job
+	var payload bytes.Buffer
+	body := io.TeeReader(http.MaxBytesReader(w, r.Body, importMaxBytes), &payload)
+	var rows []importRow
+	err := parseImport(format, body, func(row importRow) error {
+		if len(rows) == importSyncRows {
+			return errImportTooLarge
+		}
+		rows = append(rows, row)
+		return nil
+	})
+	if errors.Is(err, errImportTooLarge) {
+		async = true
+		rows = nil
+		_, err = io.Copy(ioutil.Discard, body)
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "http: request body too large") {
+			err = fmt.Errorf("body must not be larger than %d bytes", importMaxBytes)
+		}
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	user := app.contextGetUser(r)
+
+	if async {
+		imp := &data.MovieImport{
+			UserID:  user.ID,
+			Format:  format,
+			DryRun:  dryRun,
+			Payload: payload.Bytes(),
+		}
+		err = app.inTx(r, func(r *http.Request) error {
+			err := app.modelsFor(r).Imports.Insert(imp)
+			if err != nil {
+				return err
+			}
+			job := &data.Job{
+				Kind:        jobImportMovies,
+				UniqueKey:   "movie-import:" + strconv.FormatInt(imp.ID, 10),
+				MaxAttempts: 3,
+			}
+			err = app.enqueueJob(app.modelsFor(r), job, importMoviesPayload{ImportID: imp.ID})
+			if err != nil {
+				return err
+			}
+			return app.audit(r, auditEvent{
+				Action:       "movie_import.create",
+				ResourceType: "movie_import",
+				ResourceID:   strconv.FormatInt(imp.ID, 10),
+				After:        imp,
+			})
+		})
+		if err != nil {
+			app.serverErrResponse(w, r, err)
+			return
+		}
+		hs := make(http.Header)
+		hs.Set("Location", fmt.Sprintf("/v1/movies/import/%d", imp.ID))
+		err = app.writeJSON(w, http.StatusAccepted, envelope{"import": imp}, hs)
+		if err != nil {
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+
+	var report *data.ImportReport
+	err = app.inTx(r, func(r *http.Request) error {
+		var err error
+		report, err = app.runImport(r.Context(), app.modelsFor(r), rows, dryRun, user.ID)
+		if err != nil || report.Inserted == 0 {
+			return err
+		}
+		return app.audit(r, auditEvent{
+			Action:       "movie.import",
+			ResourceType: "movie",
+			After:        map[string]interface{}{"format": format, "rows": report.Rows, "inserted": report.Inserted},
+		})
+	})
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"report": report}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+// importMoviesJob runs a stored import. The movies are inserted in the
+// transaction that marks the import done, so an attempt that fails
+// leaves nothing behind and a retry after a done import is a no-op.
+func (app *application) importMoviesJob(ctx context.Context, job *data.Job) error {
+	var payload importMoviesPayload
+	err := decodePayload(job, &payload)
+	if err != nil {
+		return err
+	}
+	imp, err := app.models.Imports.Get(payload.ImportID, true)
+	if err != nil {
+		return err
+	}
+	if imp.Status == data.ImportDone || imp.Status == data.ImportFailed {
+		return nil
+	}
+	err = app.models.Imports.SetStatus(imp.ID, data.ImportRunning)
+	if err != nil {
+		return err
+	}
+	var rows []importRow
+	err = parseImport(imp.Format, bytes.NewReader(imp.Payload), func(row importRow) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		// a payload that doesn't parse won't on a retry either
+		imp.Status = data.ImportFailed
+		imp.Error = err.Error()
+		return app.models.Imports.Finish(imp)
+	}
+	err = app.models.Transaction(ctx, func(models data.Models) error {
+		var err error
+		imp.Report, err = app.runImport(ctx, models, rows, imp.DryRun, imp.UserID)
+		if err != nil {
+			return err
+		}
+		imp.Status = data.ImportDone
+		return models.Imports.Finish(imp)
+	})
+	if err != nil && job.Attempts >= job.MaxAttempts {
+		imp.Status = data.ImportFailed
+		imp.Report = nil
+		imp.Error = err.Error()
+		if ferr := app.models.Imports.Finish(imp); ferr != nil {
+			app.logger.PrintErr(ferr, map[string]string{"import_id": strconv.FormatInt(imp.ID, 10)})
+		}
+	}
+	return err
+}
+
+func (app *application) showMovieImportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFountResponse(w, r)
+		return
+	}
+	imp, err := app.modelsFor(r).Imports.Get(id, false)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFountResponse(w, r)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+	// an import, and its report of the rows it was sent, is only
+	// visible to the user who started it
+	if imp.UserID != app.contextGetUser(r).ID {
+		app.notFountResponse(w, r)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"import": imp}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
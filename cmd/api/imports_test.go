@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/datewu/xyz/internal/data"
+)
+
+func collectImport(t *testing.T, format, payload string) []importRow {
+	t.Helper()
+	var rows []importRow
+	err := parseImport(format, strings.NewReader(payload), func(row importRow) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestParseImportCSV(t *testing.T) {
+	rows := collectImport(t, "csv", "Title,Year,Runtime,Genres\n"+
+		"Moana,2016,107 mins,animation|adventure\n"+
+		"Black Panther,twenty,134,action\n"+
+		"\"broken,2018\n")
+	if len(rows) != 3 {
+		t.Fatalf("got %d rows, want 3", len(rows))
+	}
+	want := &data.Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}}
+	if rows[0].err != "" || !reflect.DeepEqual(rows[0].movie, want) {
+		t.Errorf("row 1 = %+v, %q, want %+v", rows[0].movie, rows[0].err, want)
+	}
+	if rows[1].line != 3 || rows[1].err != "year must be an integer" {
+		t.Errorf("row 2 = line %d, %q", rows[1].line, rows[1].err)
+	}
+	if rows[2].line != 4 || rows[2].err == "" {
+		t.Errorf("row 3 = line %d, %q, want a parse error", rows[2].line, rows[2].err)
+	}
+}
+
+func TestParseImportCSVHeader(t *testing.T) {
+	err := parseImport("csv", strings.NewReader("title,year,genres\n"), func(importRow) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), `missing "runtime" column`) {
+		t.Errorf("err = %v, want a missing runtime column", err)
+	}
+}
+
+func TestParseImportNDJSON(t *testing.T) {
+	rows := collectImport(t, "ndjson", `{"title":"Moana","year":2016,"runtime":"107 mins","genres":["animation"]}`+"\n\n"+
+		`{"title":"x","rating":5}`+"\n")
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(rows))
+	}
+	if rows[0].err != "" || rows[0].movie.Title != "Moana" || rows[0].movie.Runtime != 107 {
+		t.Errorf("row 1 = %+v, %q", rows[0].movie, rows[0].err)
+	}
+	if rows[1].line != 3 || !strings.Contains(rows[1].err, "unknown field") {
+		t.Errorf("row 2 = line %d, %q", rows[1].line, rows[1].err)
+	}
+}
+
+func TestParseImportStops(t *testing.T) {
+	payload := "title,year,runtime,genres\n" + strings.Repeat("Moana,2016,107,animation\n", 10)
+	n := 0
+	err := parseImport("csv", strings.NewReader(payload), func(importRow) error {
+		if n == 3 {
+			return errImportTooLarge
+		}
+		n++
+		return nil
+	})
+	if !errors.Is(err, errImportTooLarge) || n != 3 {
+		t.Errorf("err = %v after %d rows, want errImportTooLarge after 3", err, n)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/datewu/xyz/internal/data"
+	"github.com/datewu/xyz/internal/validator"
+)
+
+// movieIncluder loads one related resource for a page of movies, in a
+// single query, and embeds it in each of them.
+type movieIncluder func(r *http.Request, movies []*data.Movie) error
+
+// movieIncludes maps every name ?include= takes to its includer.
+func (app *application) movieIncludes() map[string]movieIncluder {
+	return map[string]movieIncluder{
+		"latest_revision": app.includeLatestRevision,
+		"creator":         app.includeCreator,
+	}
+}
+
+// movieIncludeNames lists what ?include= accepts, sorted.
+func (app *application) movieIncludeNames() []string {
+	includes := app.movieIncludes()
+	names := make([]string, 0, len(includes))
+	for name := range includes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readMovieShape reads ?fields=, the sparse fieldset, and ?include=,
+// the related resources to embed, checking both against what movies
+// have.
+func (app *application) readMovieShape(qs url.Values, v *validator.Validator) (fields, include []string) {
+	fields = app.readCSV(qs, "fields", nil)
+	include = app.readCSV(qs, "include", nil)
+	data.ValidateFields(v, fields, data.MovieFields...)
+	names := app.movieIncludeNames()
+	for _, name := range include {
+		v.Check(validator.In(name, names...), "include", fmt.Sprintf("unknown include %q", name))
+	}
+	v.CheckCode(validator.Unique(include), "include", validator.CodeDuplicate, "must not contain duplicate values")
+	return fields, include
+}
+
+// embedMovieIncludes runs the includers named by include on movies.
+func (app *application) embedMovieIncludes(r *http.Request, include []string, movies []*data.Movie) error {
+	if len(movies) == 0 {
+		return nil
+	}
+	includes := app.movieIncludes()
+	for _, name := range include {
+		err := includes[name](r, movies)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func movieIDs(movies []*data.Movie) []int64 {
+	ids := make([]int64, len(movies))
+	for i, m := range movies {
+		ids[i] = m.ID
+	}
+	return ids
+}
+
+func (app *application) includeLatestRevision(r *http.Request, movies []*data.Movie) error {
+	revs, err := app.modelsFor(r).Revisions.GetLatest(r.Context(), movieIDs(movies))
+	if err != nil {
+		return err
+	}
+	for _, m := range movies {
+		m.Embed("latest_revision", revs[m.ID])
+	}
+	return nil
+}
+
+func (app *application) includeCreator(r *http.Request, movies []*data.Movie) error {
+	authors, err := app.modelsFor(r).Revisions.GetCreators(r.Context(), movieIDs(movies))
+	if err != nil {
+		return err
+	}
+	for _, m := range movies {
+		m.Embed("creator", authors[m.ID])
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/datewu/xyz/internal/data"
+	"github.com/datewu/xyz/internal/validator"
+)
+
+const invitationTTL = 7 * 24 * time.Hour
+
+type createInvitationInput struct {
+	Email       string   `json:"email"`
+	Permissions []string `json:"permissions"`
+	Locale      string   `json:"locale"`
+}
+
+func (app *application) createInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var input createInvitationInput
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Locale == "" {
+		input.Locale = data.DefaultLocale
+	}
+	input.Locale = strings.ToLower(input.Locale)
+
+	v := validator.New()
+	data.ValidateEmail(v, input.Email)
+	data.ValidateLocale(v, input.Locale)
+	v.CheckCode(validator.Unique(input.Permissions), "permissions", validator.CodeDuplicate, "must not contain duplicate values")
+	known, err := app.modelsFor(r).Permissions.GetAll()
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+		return
+	}
+	// an inviter can only pass on permissions they hold themselves
+	inviter := app.contextGetUser(r)
+	held, err := app.modelsFor(r).Permissions.GetAllForUser(inviter.ID)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+		return
+	}
+	for _, code := range input.Permissions {
+		v.Check(known.Include(code), "permissions", "unknown permission "+code)
+		v.Check(held.Include(code), "permissions", "can't grant "+code+" without holding it")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	user := &data.User{
+		Email:     input.Email,
+		Activated: false,
+		Locale:    input.Locale,
+	}
+	user.Password.SetUnusable()
+	inv := &data.Invitation{
+		Email:       user.Email,
+		InvitedBy:   inviter.ID,
+		Permissions: input.Permissions,
+		Expiry:      time.Now().Add(invitationTTL),
+	}
+	if inv.Permissions == nil {
+		inv.Permissions = data.Permissions{}
+	}
+	err = app.inTx(r, func(r *http.Request) error {
+		models := app.modelsFor(r)
+		err := models.Users.Insert(user)
+		if err != nil {
+			return err
+		}
+		err = app.audit(r, auditEvent{
+			Action:       "user.create",
+			ResourceType: "user",
+			ResourceID:   strconv.FormatInt(user.ID, 10),
+			After:        user,
+		})
+		if err != nil {
+			return err
+		}
+		if len(input.Permissions) > 0 {
+			err = models.Permissions.AddForUser(user.ID, input.Permissions...)
+			if err != nil {
+				return err
+			}
+			err = app.audit(r, auditEvent{
+				Action:       "permissions.grant",
+				ResourceType: "user",
+				ResourceID:   strconv.FormatInt(user.ID, 10),
+				After:        input.Permissions,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		inv.UserID = user.ID
+		err = models.Invitations.Insert(inv)
+		if err != nil {
+			return err
+		}
+		err = app.audit(r, auditEvent{
+			Action:       "invitation.create",
+			ResourceType: "invitation",
+			ResourceID:   strconv.FormatInt(inv.ID, 10),
+			After:        inv,
+		})
+		if err != nil {
+			return err
+		}
+		token, err := models.Tokens.New(user.ID, invitationTTL, data.ScopeInvitation)
+		if err != nil {
+			return err
+		}
+		return app.sendEmail(models, user.Email, user.Locale, "user_invitation.tmpl", map[string]interface{}{
+			"invitationToken": token.Plaintext,
+			"tokenExpiry":     token.Expiry,
+			"inviterName":     inviter.Name,
+		})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddErrCode("email", validator.CodeAlreadyExists, "a user with this emal address already exists")
+			app.failedValidationResponse(w, r, v)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"invitation": inv}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+func (app *application) listInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status string
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+	input.Status = app.readString(qs, "status", "")
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Sort = app.readString(qs, "sort", "-id")
+	input.SortSafelist = []string{"id", "email", "expiry", "-id", "-email", "-expiry"}
+	v.Check(input.Status == "" || validator.In(input.Status,
+		data.InvitationPending, data.InvitationAccepted,
+		data.InvitationRevoked, data.InvitationExpired), "status", "invalid status value")
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	invs, metadata, err := app.modelsFor(r).Invitations.GetAll(input.Status, input.Filters)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"invitations": invs, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+func (app *application) revokeInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFountResponse(w, r)
+		return
+	}
+	inv, err := app.modelsFor(r).Invitations.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFountResponse(w, r)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+	if inv.Status != data.InvitationPending && inv.Status != data.InvitationExpired {
+		v := validator.New()
+		v.AddErr("status", "only pending or expired invitations can be revoked")
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	before := *inv
+	err = app.inTx(r, func(r *http.Request) error {
+		err := app.modelsFor(r).Invitations.Revoke(inv)
+		if err != nil {
+			return err
+		}
+		return app.audit(r, auditEvent{
+			Action:       "invitation.revoke",
+			ResourceType: "invitation",
+			ResourceID:   strconv.FormatInt(inv.ID, 10),
+			Before:       before,
+			After:        inv,
+		})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"invitation": inv}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+type acceptInvitationInput struct {
+	TokenPlaintext string `json:"token"`
+	Name           string `json:"name"`
+	Password       string `json:"password"`
+}
+
+func (app *application) acceptInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var input acceptInvitationInput
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	data.ValidatePasswordPlaintext(v, input.Password)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	user, err := app.modelsFor(r).Users.GetForToken(data.ScopeInvitation, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddErr("token", "invalid or expired invitation token")
+			app.failedValidationResponse(w, r, v)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+	inv, err := app.modelsFor(r).Invitations.GetPendingForUser(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddErr("token", "invalid or expired invitation token")
+			app.failedValidationResponse(w, r, v)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+
+	before := *user
+	user.Name = input.Name
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+		return
+	}
+	data.ValidateUser(v, user)
+	data.ValidatePasswordPolicy(v, input.Password, user.Name, user.Email)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	user.Activated = true
+	err = app.inTx(r, func(r *http.Request) error {
+		models := app.modelsFor(r)
+		err := models.Users.Update(user)
+		if err != nil {
+			return err
+		}
+		err = models.Invitations.Accept(inv)
+		if err != nil {
+			return err
+		}
+		err = models.Tokens.DeleteAllForUser(data.ScopeInvitation, user.ID)
+		if err != nil {
+			return err
+		}
+		err = app.audit(r, auditEvent{
+			Action:       "invitation.accept",
+			ResourceType: "user",
+			ResourceID:   strconv.FormatInt(user.ID, 10),
+			ActorID:      user.ID,
+			Before:       before,
+			After:        user,
+		})
+		if err != nil {
+			return err
+		}
+		return app.publish(r, eventUserActivated, user)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
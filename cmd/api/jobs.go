@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/datewu/xyz/internal/data"
+	"github.com/datewu/xyz/internal/validator"
+)
+
+// jobLease is how long a claimed job is hidden from other workers,
+// it's also the deadline a handler gets to finish. A job still
+// running after that is considered abandoned and run again.
+const jobLease = 5 * time.Minute
+
+// jobHandler runs one job. Returning an error schedules a retry
+// until the job has used up its attempts.
+type jobHandler func(ctx context.Context, job *data.Job) error
+
+// jobHandlers maps every job kind to the handler that runs it.
+func (app *application) jobHandlers() map[string]jobHandler {
+	return map[string]jobHandler{
+		jobSendEmail:      app.sendEmailJob,
+		jobImportMovies:   app.importMoviesJob,
+		jobDeliverWebhook: app.deliverWebhookJob,
+	}
+}
+
+// enqueueJob adds a job of kind with payload to the queue through
+// models, so a job queued in a transaction only runs once it commits.
+// A job sharing job.UniqueKey with one that's pending or running is
+// silently dropped.
+func (app *application) enqueueJob(models data.Models, job *data.Job, payload interface{}) error {
+	if _, ok := app.jobHandlers()[job.Kind]; !ok {
+		return fmt.Errorf("no handler for job kind %q", job.Kind)
+	}
+	err := models.Jobs.Enqueue(job, payload)
+	if errors.Is(err, data.ErrDuplicateJob) {
+		return nil
+	}
+	return err
+}
+
+// decodePayload unmarshals job.Payload into dst.
+func decodePayload(job *data.Job, dst interface{}) error {
+	err := json.Unmarshal(job.Payload, dst)
+	if err != nil {
+		return fmt.Errorf("job %d: invalid %s payload: %w", job.ID, job.Kind, err)
+	}
+	return nil
+}
+
+// startJobs runs the job worker pool until ctx is done. Workers stop
+// claiming jobs then, but finish the one they're running.
+func (app *application) startJobs(ctx context.Context) {
+	handlers := app.jobHandlers()
+	kinds := make([]string, 0, len(handlers))
+	for kind := range handlers {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for i := 0; i < app.config.jobs.workers; i++ {
+		app.wg.Add(1)
+		go func() {
+			defer app.wg.Done()
+			app.jobWorker(ctx, kinds, handlers)
+		}()
+	}
+}
+
+func (app *application) jobWorker(ctx context.Context, kinds []string, handlers map[string]jobHandler) {
+	for {
+		ran, err := app.runNextJob(kinds, handlers)
+		if err != nil {
+			app.logger.PrintErr(err, map[string]string{"worker": "jobs"})
+		}
+		if ran && ctx.Err() == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(app.config.jobs.pollInterval):
+		}
+	}
+}
+
+// runNextJob runs at most one due job, it reports whether a job was
+// claimed so the worker can keep going without sleeping.
+func (app *application) runNextJob(kinds []string, handlers map[string]jobHandler) (bool, error) {
+	job, err := app.models.Jobs.Claim(kinds, jobLease)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), jobLease)
+	defer cancel()
+	runErr := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return handlers[job.Kind](ctx, job)
+	}()
+	if runErr == nil {
+		return true, app.models.Jobs.Complete(job)
+	}
+
+	err = app.models.Jobs.Fail(job, runErr, time.Now().Add(jobBackoff(job.Attempts)))
+	app.logger.PrintErr(runErr, map[string]string{
+		"job_id":   strconv.FormatInt(job.ID, 10),
+		"kind":     job.Kind,
+		"attempts": strconv.Itoa(job.Attempts),
+		"status":   job.Status,
+	})
+	return true, err
+}
+
+// jobBackoff doubles the delay from 30s for each attempt, up to an hour.
+func jobBackoff(attempts int) time.Duration {
+	d := 30 * time.Second
+	for i := 1; i < attempts && d < time.Hour; i++ {
+		d *= 2
+	}
+	if d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
+
+// drainJobs waits up to timeout for running jobs to finish. Jobs
+// still running after that are picked up again once their lease ends.
+func (app *application) drainJobs(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		app.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		app.logger.PrintInfo("background tasks still running, leaving them to be reclaimed", map[string]string{
+			"timeout": timeout.String(),
+		})
+	}
+}
+
+func (app *application) listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status string
+		Kind   string
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+	input.Status = app.readString(qs, "status", "")
+	input.Kind = app.readString(qs, "kind", "")
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Sort = app.readString(qs, "sort", "-id")
+	input.SortSafelist = []string{"id", "run_at", "attempts",
+		"-id", "-run_at", "-attempts"}
+	v.Check(input.Status == "" || validator.In(input.Status,
+		data.JobPending, data.JobRunning, data.JobDone, data.JobFailed), "status", "invalid status value")
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	jobs, metadata, err := app.modelsFor(r).Jobs.GetAll(input.Status, input.Kind, input.Filters)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"jobs": jobs, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+func (app *application) showJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFountResponse(w, r)
+		return
+	}
+	job, err := app.modelsFor(r).Jobs.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFountResponse(w, r)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"job": job}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+func (app *application) retryJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFountResponse(w, r)
+		return
+	}
+	job, err := app.modelsFor(r).Jobs.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFountResponse(w, r)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+	if job.Status != data.JobFailed {
+		v := validator.New()
+		v.AddErr("status", "only failed jobs can be retried")
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	err = app.inTx(r, func(r *http.Request) error {
+		err := app.modelsFor(r).Jobs.Retry(job)
+		if err != nil {
+			return err
+		}
+		return app.audit(r, auditEvent{
+			Action:       "job.retry",
+			ResourceType: "job",
+			ResourceID:   strconv.FormatInt(job.ID, 10),
+			After:        job,
+		})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"job": job}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
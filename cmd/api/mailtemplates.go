@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/datewu/xyz/internal/data"
+	"github.com/datewu/xyz/internal/mailer"
+	"github.com/datewu/xyz/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+func (app *application) readTemplateParam(r *http.Request) (string, bool) {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("name")
+	return name, app.mailer.HasTemplate(name)
+}
+
+// renderErrResponse reports a template that failed to render with
+// the template, block and cause kept apart so they're easy to read.
+func (app *application) renderErrResponse(w http.ResponseWriter, r *http.Request, err error) {
+	var renderErr *mailer.RenderError
+	if !errors.As(err, &renderErr) {
+		app.serverErrResponse(w, r, err)
+		return
+	}
+	msg := map[string]string{
+		"template": renderErr.Template,
+		"error":    renderErr.Err.Error(),
+	}
+	if renderErr.Block != "" {
+		msg["block"] = renderErr.Block
+	}
+	app.errResponse(w, r, http.StatusUnprocessableEntity, "template_render_failed", msg)
+}
+
+func (app *application) listMailTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"templates": app.mailer.Templates()}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+type previewMailTemplateInput struct {
+	Locale string                 `json:"locale"`
+	Data   map[string]interface{} `json:"data"`
+}
+
+func (app *application) previewMailTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := app.readTemplateParam(r)
+	if !ok {
+		app.notFountResponse(w, r)
+		return
+	}
+	var input previewMailTemplateInput
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.Locale == "" {
+		input.Locale = data.DefaultLocale
+	}
+	input.Locale = strings.ToLower(input.Locale)
+	v := validator.New()
+	if data.ValidateLocale(v, input.Locale); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	if input.Data == nil {
+		input.Data = app.mailer.SampleData(name)
+	}
+	msg, err := app.mailer.Render("", input.Locale, name, input.Data)
+	if err != nil {
+		app.renderErrResponse(w, r, err)
+		return
+	}
+	preview := map[string]string{
+		"subject":   msg.Subject,
+		"plainBody": msg.PlainBody,
+		"htmlBody":  msg.HTMLBody,
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"preview": preview}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+type testSendMailTemplateInput struct {
+	Recipient string                 `json:"recipient"`
+	Locale    string                 `json:"locale"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+func (app *application) testSendMailTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := app.readTemplateParam(r)
+	if !ok {
+		app.notFountResponse(w, r)
+		return
+	}
+	var input testSendMailTemplateInput
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.Locale == "" {
+		input.Locale = data.DefaultLocale
+	}
+	input.Locale = strings.ToLower(input.Locale)
+	v := validator.New()
+	v.CheckCode(input.Recipient != "", "recipient", validator.CodeRequired, "must be provided")
+	v.CheckCode(validator.Matches(input.Recipient, validator.EmailRX), "recipient", validator.CodeInvalidFormat, "must be a valid email address")
+	data.ValidateLocale(v, input.Locale)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	if input.Data == nil {
+		input.Data = app.mailer.SampleData(name)
+	}
+	msg, err := app.mailer.Render(input.Recipient, input.Locale, name, input.Data)
+	if err != nil {
+		app.renderErrResponse(w, r, err)
+		return
+	}
+	err = app.mailer.Deliver(msg)
+	if err != nil {
+		app.logError(r, err)
+		app.errResponse(w, r, http.StatusBadGateway, "mail_transport_failed", "the mail transport failed to send the message: "+err.Error())
+		return
+	}
+	err = app.audit(r, auditEvent{
+		Action:       "mail.test_send",
+		ResourceType: "mail_template",
+		ResourceID:   name,
+		After:        map[string]string{"recipient": input.Recipient, "locale": input.Locale},
+	})
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "test email sent to " + input.Recipient}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
@@ -5,15 +5,21 @@ import (
 	"database/sql"
 	"expvar"
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/datewu/xyz/internal/cron"
 	"github.com/datewu/xyz/internal/data"
+	"github.com/datewu/xyz/internal/graphql"
 	"github.com/datewu/xyz/internal/jsonlog"
 	"github.com/datewu/xyz/internal/mailer"
+	"github.com/datewu/xyz/internal/webhook"
 	_ "github.com/lib/pq"
 )
 
@@ -31,6 +37,15 @@ type config struct {
 		burst   int
 		enabled bool
 	}
+	mailer struct {
+		transport string
+		dir       string
+	}
+	dkim struct {
+		keyFile  string
+		domain   string
+		selector string
+	}
 	smtp struct {
 		host     string
 		port     int
@@ -38,9 +53,62 @@ type config struct {
 		password string
 		sender   string
 	}
+	outbox struct {
+		maxAttempts int
+	}
+	jobs struct {
+		workers      int
+		pollInterval time.Duration
+		drainTimeout time.Duration
+	}
+	cron struct {
+		enabled          bool
+		tokenPurge       string
+		idempotencyPurge string
+		movieEventsTrim  string
+		unactivatedPurge string
+		unactivatedDays  int
+		outboxVacuum     string
+		jobsVacuum       string
+		deliveriesVacuum string
+		retentionDays    int
+		moviesPurge      string
+		moviesDays       int
+	}
 	cors struct {
 		trustedOrigins []string
 	}
+	password struct {
+		algorithm         string
+		bcryptCost        int
+		argon2Memory      uint
+		argon2Iterations  uint
+		argon2Parallelism uint
+		minLength         int
+		minCharClasses    int
+		disallowPersonal  bool
+		minScore          int
+		breachedFile      string
+	}
+	errors struct {
+		format   string
+		typeBase string
+	}
+	idempotency struct {
+		ttl time.Duration
+	}
+	webhooks struct {
+		maxAttempts  int
+		timeout      time.Duration
+		allowPrivate bool
+	}
+	movieEvents struct {
+		retention time.Duration
+	}
+	graphql struct {
+		maxDepth      int
+		maxComplexity int
+	}
 	metrics bool
 }
 
@@ -52,9 +120,22 @@ var (
 type application struct {
 	config config
 	logger *jsonlog.Logger
+	db     *sql.DB
 	models data.Models
 	mailer mailer.Mailer
 	wg     sync.WaitGroup
+
+	webhookClient *http.Client
+	movieEvents   *movieEventHub
+
+	scheduler *cron.Scheduler
+	// openapi is the API's OpenAPI document, built by routes()
+	openapi []byte
+	// graphqlSchema is the schema of /v1/graphql, built by routes()
+	graphqlSchema *graphql.Schema
+	// handler is the middleware chain and router, built by routes(), that
+	// batch sub-requests go through
+	handler http.Handler
 }
 
 func main() {
@@ -71,18 +152,75 @@ func main() {
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", false, "Enable rate limiter")
 
-	flag.StringVar(&cfg.smtp.host, "smtp-host", "smtp.mailtrap.io", "SMTP host")
+	flag.StringVar(&cfg.mailer.transport, "mailer", "smtp", "Mail transport (smtp|file|stdout|memory)")
+	flag.StringVar(&cfg.mailer.dir, "mailer-dir", "./tmp/mail", "Directory the file mail transport writes .eml files to")
+	flag.StringVar(&cfg.dkim.keyFile, "dkim-key", "", "PEM encoded RSA or Ed25519 private key to DKIM sign mail with, signing is off when empty")
+	flag.StringVar(&cfg.dkim.domain, "dkim-domain", "greenlight.alexedwards.net", "DKIM signing domain (d=)")
+	flag.StringVar(&cfg.dkim.selector, "dkim-selector", "default", "DKIM selector (s=)")
+	flag.StringVar(&cfg.smtp.host, "smtp-host", "localhost", "SMTP host")
 	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
-	flag.StringVar(&cfg.smtp.username, "smtp-username", "a3e7d95345e9ef", "SMTP username")
-	flag.StringVar(&cfg.smtp.password, "smtp-password", "202ec0eaa7e43d", "SMTP password")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.alexedwards.net>", "SMTP sender")
 
+	flag.IntVar(&cfg.outbox.maxAttempts, "outbox-max-attempts", 8, "Email send attempts before a message is dead-lettered")
+
+	flag.IntVar(&cfg.jobs.workers, "jobs-workers", 2, "Number of background job workers")
+	flag.DurationVar(&cfg.jobs.pollInterval, "jobs-poll-interval", 5*time.Second, "Job queue poll interval when idle")
+	flag.DurationVar(&cfg.jobs.drainTimeout, "jobs-drain-timeout", 30*time.Second, "How long shutdown waits for running jobs to finish")
+
+	flag.BoolVar(&cfg.cron.enabled, "cron-enabled", true, "Run scheduled maintenance tasks, on one replica at a time")
+	flag.StringVar(&cfg.cron.tokenPurge, "cron-token-purge", "@hourly", "Cron schedule for purging expired tokens, empty to disable")
+	flag.StringVar(&cfg.cron.idempotencyPurge, "cron-idempotency-purge", "@hourly", "Cron schedule for purging expired idempotency keys, empty to disable")
+	flag.StringVar(&cfg.cron.movieEventsTrim, "cron-movie-events-trim", "@hourly", "Cron schedule for trimming movie events older than -movie-events-retention, empty to disable")
+	flag.StringVar(&cfg.cron.unactivatedPurge, "cron-unactivated-purge", "30 3 * * *", "Cron schedule for deleting stale unactivated users, empty to disable")
+	flag.IntVar(&cfg.cron.unactivatedDays, "cron-unactivated-days", 30, "Age in days after which unactivated users are deleted")
+	flag.StringVar(&cfg.cron.outboxVacuum, "cron-outbox-vacuum", "0 4 * * *", "Cron schedule for vacuuming the email outbox, empty to disable")
+	flag.StringVar(&cfg.cron.jobsVacuum, "cron-jobs-vacuum", "10 4 * * *", "Cron schedule for vacuuming finished jobs, empty to disable")
+	flag.StringVar(&cfg.cron.deliveriesVacuum, "cron-webhook-deliveries-vacuum", "20 4 * * *", "Cron schedule for vacuuming webhook deliveries, empty to disable")
+	flag.IntVar(&cfg.cron.retentionDays, "cron-retention-days", 14, "Days sent or dead emails, finished jobs and webhook deliveries are kept")
+	flag.StringVar(&cfg.cron.moviesPurge, "cron-movies-purge", "15 4 * * *", "Cron schedule for purging soft deleted movies, empty to disable")
+	flag.IntVar(&cfg.cron.moviesDays, "cron-movies-days", 30, "Days a deleted movie can be restored before it is purged")
+
 	// -cors-trusted-origins="http://localhost:9000 http://localhost:9001"
 	flag.Func("cors-trusted-origins", "Tursted CORS origins (space separated)", func(v string) error {
 		cfg.cors.trustedOrigins = strings.Fields(v)
 		return nil
 	})
 
+	flag.StringVar(&cfg.password.algorithm, "password-algorithm", data.AlgorithmArgon2id, "Password hashing algorithm (argon2id|bcrypt)")
+	flag.IntVar(&cfg.password.bcryptCost, "password-bcrypt-cost", 12, "bcrypt cost")
+	flag.UintVar(&cfg.password.argon2Memory, "password-argon2-memory", 64*1024, "argon2id memory in KiB")
+	flag.UintVar(&cfg.password.argon2Iterations, "password-argon2-iterations", 3, "argon2id iterations")
+	flag.UintVar(&cfg.password.argon2Parallelism, "password-argon2-parallelism", 2, "argon2id parallelism")
+
+	flag.IntVar(&cfg.password.minLength, "password-min-length", 8, "Minimum password length in bytes")
+	flag.IntVar(&cfg.password.minCharClasses, "password-min-char-classes", 0, "Minimum number of character classes (lower, upper, digit, symbol) in a password")
+	flag.BoolVar(&cfg.password.disallowPersonal, "password-disallow-personal", true, "Reject passwords containing the user's name or email")
+	flag.IntVar(&cfg.password.minScore, "password-min-score", 2, "Minimum password strength score (0-4)")
+	flag.StringVar(&cfg.password.breachedFile, "password-breached-file", "", "File of breached password SHA-1 hashes")
+
+	cfg.errors.format = errorFormatProblem
+	flag.Func("error-format", "Error body for clients that don't ask for one by Accept header (problem|legacy)", func(v string) error {
+		if v != errorFormatProblem && v != errorFormatLegacy {
+			return fmt.Errorf("must be %s or %s", errorFormatProblem, errorFormatLegacy)
+		}
+		cfg.errors.format = v
+		return nil
+	})
+	flag.StringVar(&cfg.errors.typeBase, "error-type-base", "urn:greenlight:problem:", "Prefix of the type URI of problem+json errors, the error code is appended")
+
+	flag.IntVar(&cfg.webhooks.maxAttempts, "webhook-max-attempts", 8, "Delivery attempts for a webhook event before giving up")
+	flag.DurationVar(&cfg.webhooks.timeout, "webhook-timeout", 10*time.Second, "How long a webhook receiver gets to answer a delivery")
+	flag.BoolVar(&cfg.webhooks.allowPrivate, "webhook-allow-private", false, "Deliver webhooks to loopback and private addresses, for development")
+
+	flag.DurationVar(&cfg.movieEvents.retention, "movie-events-retention", 24*time.Hour, "How far back clients of the movie event stream can resume from")
+
+	flag.IntVar(&cfg.graphql.maxDepth, "graphql-max-depth", 8, "Deepest nesting of fields a GraphQL query may have, 0 for no limit")
+	flag.IntVar(&cfg.graphql.maxComplexity, "graphql-max-complexity", 1000, "Highest cost a GraphQL query may have, list fields counting once per item of a page, 0 for no limit")
+
+	flag.DurationVar(&cfg.idempotency.ttl, "idempotency-ttl", 24*time.Hour, "How long an Idempotency-Key's response is kept for replay")
+
 	flag.BoolVar(&cfg.metrics, "metrics", false, "Enable expvar metrics")
 
 	flag.Parse()
@@ -93,6 +231,62 @@ func main() {
 		"buildTime": buildTime,
 	})
 
+	err := data.SetPasswordHashing(data.PasswordHashing{
+		Algorithm:  cfg.password.algorithm,
+		BcryptCost: cfg.password.bcryptCost,
+		Argon2: data.Argon2Params{
+			Memory:      uint32(cfg.password.argon2Memory),
+			Iterations:  uint32(cfg.password.argon2Iterations),
+			Parallelism: uint8(cfg.password.argon2Parallelism),
+			SaltLength:  16,
+			KeyLength:   32,
+		},
+	})
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	policy := data.PasswordPolicy{
+		MinLength:        cfg.password.minLength,
+		MinCharClasses:   cfg.password.minCharClasses,
+		DisallowPersonal: cfg.password.disallowPersonal,
+		MinScore:         cfg.password.minScore,
+	}
+	if cfg.password.breachedFile != "" {
+		policy.Breached, err = data.LoadBreachedPasswords(cfg.password.breachedFile)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		logger.PrintInfo("breached password list loaded", map[string]string{
+			"hashes": strconv.Itoa(policy.Breached.Len()),
+		})
+	}
+	data.SetPasswordPolicy(policy)
+
+	transport, err := newMailTransport(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	var signer *mailer.DKIMSigner
+	if cfg.dkim.keyFile != "" {
+		signer, err = mailer.NewDKIMSigner(cfg.dkim.keyFile, cfg.dkim.domain, cfg.dkim.selector)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		record, err := signer.DNSRecord()
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		logger.PrintInfo("dkim signing enabled", map[string]string{
+			"txt_name":   cfg.dkim.selector + "._domainkey." + cfg.dkim.domain,
+			"txt_record": record,
+		})
+	}
+	mail, err := mailer.New(transport, cfg.smtp.sender, signer)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
 	db, err := openDB(cfg)
 	if err != nil {
 		logger.PrintFatal(err, nil)
@@ -115,10 +309,20 @@ func main() {
 	app := &application{
 		config: cfg,
 		logger: logger,
+		db:     db,
 		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host,
-			cfg.smtp.port, cfg.smtp.username, cfg.smtp.password,
-			cfg.smtp.sender),
+		mailer: mail,
+
+		webhookClient: webhook.NewClient(cfg.webhooks.timeout, cfg.webhooks.allowPrivate),
+		movieEvents:   newMovieEventHub(),
+	}
+	tasks, err := app.cronTasks()
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	app.scheduler = cron.New(db, logger, tasks)
+	if cfg.metrics {
+		expvar.Publish("cron", expvar.Func(app.scheduler.Metrics))
 	}
 
 	err = app.serve()
@@ -127,6 +331,22 @@ func main() {
 	}
 }
 
+func newMailTransport(cfg config) (mailer.Transport, error) {
+	switch cfg.mailer.transport {
+	case "smtp":
+		return mailer.NewSMTPTransport(cfg.smtp.host, cfg.smtp.port,
+			cfg.smtp.username, cfg.smtp.password), nil
+	case "file":
+		return mailer.NewFileTransport(cfg.mailer.dir)
+	case "stdout":
+		return mailer.NewWriterTransport(os.Stdout), nil
+	case "memory":
+		return mailer.NewMemoryTransport(), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer transport %q", cfg.mailer.transport)
+	}
+}
+
 func openDB(cfg config) (*sql.DB, error) {
 	db, err := sql.Open("postgres", cfg.db.dsn)
 	if err != nil {
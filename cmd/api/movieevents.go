@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/datewu/xyz/internal/data"
+	"github.com/lib/pq"
+)
+
+const (
+	// movieEventsPage is how many events are read from the log at once.
+	movieEventsPage = 500
+	// movieEventsBuffer is how far a stream may fall behind before it's
+	// closed, to catch up from the log when the client reconnects.
+	movieEventsBuffer = 256
+	// sseHeartbeat keeps idle streams from being cut by proxies.
+	sseHeartbeat = 15 * time.Second
+	// sseMaxDuration ends a stream before the server's write timeout
+	// does, the client reconnects with Last-Event-ID and loses nothing.
+	sseMaxDuration = serverWriteTimeout - 5*time.Second
+)
+
+// movieEventHub fans the events of the log out to the open streams of
+// this replica. Every replica listens for the notifications of all of
+// them, and reads the events themselves from the log.
+type movieEventHub struct {
+	mu   sync.Mutex
+	subs map[chan *data.MovieEvent]struct{}
+}
+
+func newMovieEventHub() *movieEventHub {
+	return &movieEventHub{subs: make(map[chan *data.MovieEvent]struct{})}
+}
+
+func (h *movieEventHub) subscribe() chan *data.MovieEvent {
+	ch := make(chan *data.MovieEvent, movieEventsBuffer)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *movieEventHub) unsubscribe(ch chan *data.MovieEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// broadcast hands ev to every stream, closing those too far behind to
+// take it.
+func (h *movieEventHub) broadcast(ev *data.MovieEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// closeAll ends every stream, at shutdown.
+func (h *movieEventHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// startMovieEvents listens for movie event notifications until ctx is
+// done, broadcasting each new event of the log to the hub.
+func (app *application) startMovieEvents(ctx context.Context) {
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		defer app.movieEvents.closeAll()
+		app.listenMovieEvents(ctx)
+	}()
+}
+
+func (app *application) listenMovieEvents(ctx context.Context) {
+	listener := pq.NewListener(app.config.db.dsn, time.Second, time.Minute,
+		func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				app.logger.PrintErr(err, map[string]string{"listener": data.MovieEventsChannel})
+			}
+		})
+	defer listener.Close()
+	err := listener.Listen(data.MovieEventsChannel)
+	if err != nil {
+		app.logger.PrintErr(err, map[string]string{"listener": data.MovieEventsChannel})
+	}
+	_, last, err := app.models.MovieEvents.Bounds(ctx)
+	if err != nil {
+		app.logger.PrintErr(err, map[string]string{"listener": data.MovieEventsChannel})
+	}
+
+	// a notification lost to a reconnect is made up for by the tick
+	tick := time.NewTicker(30 * time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-listener.Notify:
+		case <-tick.C:
+			go listener.Ping()
+		}
+		last, err = app.broadcastMovieEvents(ctx, last)
+		if err != nil && ctx.Err() == nil {
+			app.logger.PrintErr(err, map[string]string{"listener": data.MovieEventsChannel})
+		}
+	}
+}
+
+// broadcastMovieEvents sequences the events committed since it last
+// ran, sends the hub every event after last, and returns the ID of the
+// last one sent. Every replica sequences on each notification, the
+// first to get there does the work.
+func (app *application) broadcastMovieEvents(ctx context.Context, last int64) (int64, error) {
+	_, err := app.models.MovieEvents.Sequence(ctx)
+	if err != nil {
+		return last, err
+	}
+	for {
+		events, err := app.models.MovieEvents.GetSince(ctx, last, movieEventsPage)
+		if err != nil {
+			return last, err
+		}
+		for _, ev := range events {
+			app.movieEvents.broadcast(ev)
+			last = ev.ID
+		}
+		if len(events) < movieEventsPage {
+			return last, nil
+		}
+	}
+}
+
+// readLastEventID reads where a reconnecting client left off, from the
+// Last-Event-ID header or, for clients that can't set it, ?last_event_id.
+func readLastEventID(r *http.Request) (int64, bool, error) {
+	s := r.Header.Get("Last-Event-ID")
+	if s == "" {
+		s = r.URL.Query().Get("last_event_id")
+	}
+	if s == "" {
+		return 0, false, nil
+	}
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 0 {
+		return 0, false, errors.New("Last-Event-ID must be an event id")
+	}
+	return id, true, nil
+}
+
+// writeMovieEvent writes ev as a server-sent event.
+func writeMovieEvent(w http.ResponseWriter, ev *data.MovieEvent) error {
+	js, err := json.Marshal(ev.Movie)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, js)
+	return err
+}
+
+// movieEventsHandler streams movie changes as server-sent events. A
+// client resuming with Last-Event-ID first gets what it missed from the
+// log, or a reset event when the log no longer goes back that far and
+// it has to reload the movies instead.
+func (app *application) movieEventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		app.serverErrResponse(w, r, errors.New("response writer can't stream"))
+		return
+	}
+	last, resume, err := readLastEventID(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	ctx := r.Context()
+	models := app.modelsFor(r)
+
+	// subscribe before reading the bounds and the backlog so nothing
+	// falls in between, events seen twice are skipped by their ID
+	sub := app.movieEvents.subscribe()
+	defer app.movieEvents.unsubscribe(sub)
+	first, newest, err := models.MovieEvents.Bounds(ctx)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: 1000\n\n")
+
+	switch {
+	case !resume:
+		last = newest
+	case first > 0 && last < first-1:
+		fmt.Fprintf(w, "id: %d\nevent: reset\ndata: {}\n\n", newest)
+		last = newest
+	}
+	for resume {
+		events, err := models.MovieEvents.GetSince(ctx, last, movieEventsPage)
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+		for _, ev := range events {
+			if writeMovieEvent(w, ev) != nil {
+				return
+			}
+			last = ev.ID
+		}
+		flusher.Flush()
+		if len(events) < movieEventsPage {
+			break
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	deadline := time.NewTimer(sseMaxDuration)
+	defer deadline.Stop()
+	for {
+		select {
+		case ev, ok := <-sub:
+			if !ok {
+				return
+			}
+			if ev.ID <= last {
+				continue
+			}
+			err = writeMovieEvent(w, ev)
+			last = ev.ID
+		case <-heartbeat.C:
+			_, err = fmt.Fprintf(w, ": keep-alive\n\n")
+		case <-deadline.C:
+			return
+		case <-ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/datewu/xyz/internal/data"
+)
+
+func TestMovieEventHub(t *testing.T) {
+	hub := newMovieEventHub()
+	fast := hub.subscribe()
+	slow := hub.subscribe()
+
+	for i := 1; i <= movieEventsBuffer; i++ {
+		hub.broadcast(&data.MovieEvent{ID: int64(i)})
+		if i%2 == 0 {
+			<-fast
+			<-fast
+		}
+	}
+	// slow never reads, so the next event overflows it
+	hub.broadcast(&data.MovieEvent{ID: movieEventsBuffer + 1})
+	if ev := <-fast; ev.ID != movieEventsBuffer+1 {
+		t.Errorf("fast got event %d", ev.ID)
+	}
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != movieEventsBuffer {
+		t.Errorf("slow got %d events before being closed, want %d", n, movieEventsBuffer)
+	}
+
+	// unsubscribing a closed stream is fine, and only closes once
+	hub.unsubscribe(slow)
+	hub.unsubscribe(fast)
+	hub.unsubscribe(fast)
+	hub.broadcast(&data.MovieEvent{ID: movieEventsBuffer + 2})
+
+	last := hub.subscribe()
+	hub.closeAll()
+	if _, ok := <-last; ok {
+		t.Error("closeAll left a stream open")
+	}
+}
+
+func TestReadLastEventID(t *testing.T) {
+	tests := []struct {
+		header, query string
+		id            int64
+		resume, fail  bool
+	}{
+		{},
+		{header: "42", id: 42, resume: true},
+		{query: "7", id: 7, resume: true},
+		{header: "42", query: "7", id: 42, resume: true},
+		{header: "0", id: 0, resume: true},
+		{header: "-1", fail: true},
+		{query: "abc", fail: true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/v1/movies/events?last_event_id="+tt.query, nil)
+		if tt.header != "" {
+			r.Header.Set("Last-Event-ID", tt.header)
+		}
+		id, resume, err := readLastEventID(r)
+		if (err != nil) != tt.fail || id != tt.id || resume != tt.resume {
+			t.Errorf("header %q query %q: got %d, %v, %v", tt.header, tt.query, id, resume, err)
+		}
+	}
+}
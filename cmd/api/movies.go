@@ -1,22 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"strconv"
 
 	"github.com/datewu/xyz/internal/data"
+	"github.com/datewu/xyz/internal/patch"
 	"github.com/datewu/xyz/internal/validator"
 )
 
+type createMovieInput struct {
+	Title   string       `json:"title"`
+	Year    int32        `json:"year"`
+	Runtime data.Runtime `json:"runtime"`
+	Genres  []string     `json:"genres"`
+}
+
 func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		Title   string       `json:"title"`
-		Year    int32        `json:"year"`
-		Runtime data.Runtime `json:"runtime"`
-		Genres  []string     `json:"genres"`
-	}
+	var input createMovieInput
 	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
@@ -31,11 +38,26 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	v := validator.New()
 	if data.ValidateMovie(v, m); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
-	err = app.models.Movies.Insert(m)
+	err = app.inTx(r, func(r *http.Request) error {
+		err := app.modelsFor(r).Movies.Insert(m, app.contextGetUser(r).ID)
+		if err != nil {
+			return err
+		}
+		err = app.audit(r, auditEvent{
+			Action:       "movie.create",
+			ResourceType: "movie",
+			ResourceID:   strconv.FormatInt(m.ID, 10),
+			After:        m,
+		})
+		if err != nil {
+			return err
+		}
+		return app.publish(r, eventMovieCreated, m)
+	})
 	if err != nil {
 		app.serverErrResponse(w, r, err)
 		return
@@ -49,13 +71,48 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+// readIncludeDeleted reads ?include_deleted, which only users with
+// the movies:deleted permission may set. It writes the error response
+// itself and returns ok false when the request can't go on.
+func (app *application) readIncludeDeleted(w http.ResponseWriter, r *http.Request) (includeDeleted, ok bool) {
+	v := validator.New()
+	includeDeleted = app.readBool(r.URL.Query(), "include_deleted", false, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return false, false
+	}
+	if !includeDeleted {
+		return false, true
+	}
+	permitted, err := app.hasPermission(r, "movies:deleted")
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+		return false, false
+	}
+	if !permitted {
+		app.notPermittedResponse(w, r)
+		return false, false
+	}
+	return true, true
+}
+
 func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
 		app.notFountResponse(w, r)
 		return
 	}
-	m, err := app.models.Movies.Get(id)
+	includeDeleted, ok := app.readIncludeDeleted(w, r)
+	if !ok {
+		return
+	}
+	v := validator.New()
+	fields, include := app.readMovieShape(r.URL.Query(), v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	m, err := app.modelsFor(r).Movies.GetFields(id, includeDeleted, fields)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -65,19 +122,112 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		}
 		return
 	}
+	err = app.embedMovieIncludes(r, include, []*data.Movie{m})
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+		return
+	}
 	err = app.writeJSON(w, http.StatusOK, envelope{"movie": m}, nil)
 	if err != nil {
 		app.serverErrResponse(w, r, err)
 	}
 }
 
+type updateMovieInput struct {
+	Title   *string       `json:"title"`
+	Year    *int32        `json:"year"`
+	Runtime *data.Runtime `json:"runtime"`
+	Genres  []string      `json:"genres"`
+}
+
+const (
+	mediaMergePatch = "application/merge-patch+json"
+	mediaJSONPatch  = "application/json-patch+json"
+)
+
+// moviePatchDoc is the document patches apply to. id and version are
+// there for test operations and can't be changed.
+type moviePatchDoc struct {
+	ID      int64        `json:"id"`
+	Title   string       `json:"title"`
+	Year    int32        `json:"year"`
+	Runtime data.Runtime `json:"runtime"`
+	Genres  []string     `json:"genres"`
+	Version int32        `json:"version"`
+}
+
+// patchMovie applies the merge patch or JSON patch in the body to m.
+// A field the patch removes or nulls ends up zero, for ValidateMovie
+// to report. It writes the error response itself and returns false
+// when the patch can't be applied.
+func (app *application) patchMovie(w http.ResponseWriter, r *http.Request, mediaType string, m *data.Movie) bool {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1_048_576))
+	if err != nil {
+		app.badRequestResponse(w, r, errors.New("body must not be larger than 1MB"))
+		return false
+	}
+	doc, err := json.Marshal(moviePatchDoc{
+		ID:      m.ID,
+		Title:   m.Title,
+		Year:    m.Year,
+		Runtime: m.Runtime,
+		Genres:  m.Genres,
+		Version: m.Version,
+	})
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+		return false
+	}
+	if mediaType == mediaMergePatch {
+		doc, err = patch.Merge(doc, body)
+	} else {
+		doc, err = patch.Apply(doc, body)
+	}
+	var opErr *patch.OpError
+	switch {
+	case errors.Is(err, patch.ErrTestFailed):
+		app.editConflictResponse(w, r)
+		return false
+	case errors.As(err, &opErr):
+		v := validator.New()
+		v.AddErr("patch", opErr.Error())
+		app.failedValidationResponse(w, r, v)
+		return false
+	case err != nil:
+		app.badRequestResponse(w, r, err)
+		return false
+	}
+
+	var patched moviePatchDoc
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&patched)
+	v := validator.New()
+	if err != nil {
+		v.AddErr("patch", "patched movie is invalid: "+err.Error())
+		app.failedValidationResponse(w, r, v)
+		return false
+	}
+	v.Check(patched.ID == m.ID, "id", "must not be changed")
+	v.Check(patched.Version == m.Version, "version", "must not be changed")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return false
+	}
+	m.Title = patched.Title
+	m.Year = patched.Year
+	m.Runtime = patched.Runtime
+	m.Genres = patched.Genres
+	return true
+}
+
 func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
 		app.notFountResponse(w, r)
 		return
 	}
-	m, err := app.models.Movies.Get(id)
+	m, err := app.modelsFor(r).Movies.Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -88,42 +238,65 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	before := *m
 	if cliVer := r.Header.Get("X-Expected-Version"); cliVer != "" {
 		if strconv.FormatInt(int64(m.Version), 32) != cliVer {
 			app.editConflictResponse(w, r)
 			return
 		}
 	}
-	var input struct {
-		Title   *string       `json:"title"`
-		Year    *int32        `json:"year"`
-		Runtime *data.Runtime `json:"runtime"`
-		Genres  []string      `json:"genres"`
-	}
-	err = app.readJSON(w, r, &input)
-	if err != nil {
-		app.badRequestResponse(w, r, err)
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mt {
+	case "", "application/json":
+		var input updateMovieInput
+		err = app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		if input.Title != nil {
+			m.Title = *input.Title
+		}
+		if input.Year != nil {
+			m.Year = *input.Year
+		}
+		if input.Runtime != nil {
+			m.Runtime = *input.Runtime
+		}
+		if input.Genres != nil {
+			m.Genres = input.Genres
+		}
+	case mediaMergePatch, mediaJSONPatch:
+		if !app.patchMovie(w, r, mt, m) {
+			return
+		}
+	default:
+		app.unsupportedMediaTypeResponse(w, r, "application/json", mediaMergePatch, mediaJSONPatch)
 		return
 	}
-	if input.Title != nil {
-		m.Title = *input.Title
-	}
-	if input.Year != nil {
-		m.Year = *input.Year
-	}
-	if input.Runtime != nil {
-		m.Runtime = *input.Runtime
-	}
-	if input.Genres != nil {
-		m.Genres = input.Genres
-	}
 
 	v := validator.New()
 	if data.ValidateMovie(v, m); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
-	err = app.models.Movies.Update(m)
+	err = app.inTx(r, func(r *http.Request) error {
+		err := app.modelsFor(r).Movies.Update(m, app.contextGetUser(r).ID)
+		if err != nil {
+			return err
+		}
+		err = app.audit(r, auditEvent{
+			Action:       "movie.update",
+			ResourceType: "movie",
+			ResourceID:   strconv.FormatInt(m.ID, 10),
+			Before:       before,
+			After:        m,
+		})
+		if err != nil {
+			return err
+		}
+		return app.publish(r, eventMovieUpdated, m)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -145,7 +318,33 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		app.notFountResponse(w, r)
 		return
 	}
-	err = app.models.Movies.Delete(id)
+	m, err := app.modelsFor(r).Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFountResponse(w, r)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+	err = app.inTx(r, func(r *http.Request) error {
+		deleted, err := app.modelsFor(r).Movies.Delete(id, app.contextGetUser(r).ID)
+		if err != nil {
+			return err
+		}
+		err = app.audit(r, auditEvent{
+			Action:       "movie.delete",
+			ResourceType: "movie",
+			ResourceID:   strconv.FormatInt(id, 10),
+			Before:       m,
+			After:        deleted,
+		})
+		if err != nil {
+			return err
+		}
+		return app.publish(r, eventMovieDeleted, deleted)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -161,27 +360,94 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+func (app *application) restoreMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFountResponse(w, r)
+		return
+	}
+	m, err := app.modelsFor(r).Movies.GetIncludingDeleted(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFountResponse(w, r)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+	if m.DeletedAt == nil {
+		v := validator.New()
+		v.AddErr("movie", "is not deleted")
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	before := *m
+	err = app.inTx(r, func(r *http.Request) error {
+		err := app.modelsFor(r).Movies.Restore(m, app.contextGetUser(r).ID)
+		if err != nil {
+			return err
+		}
+		err = app.audit(r, auditEvent{
+			Action:       "movie.restore",
+			ResourceType: "movie",
+			ResourceID:   strconv.FormatInt(m.ID, 10),
+			Before:       before,
+			After:        m,
+		})
+		if err != nil {
+			return err
+		}
+		return app.publish(r, eventMovieUpdated, m)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": m}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
 func (app *application) listMovieHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title  string
-		Genres []string
+		Title   string
+		Genres  []string
+		Fields  []string
+		Include []string
 		data.Filters
 	}
 
+	includeDeleted, ok := app.readIncludeDeleted(w, r)
+	if !ok {
+		return
+	}
 	v := validator.New()
 	qs := r.URL.Query()
 	input.Title = app.readString(qs, "title", "")
 	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.Fields, input.Include = app.readMovieShape(qs, v)
 	input.Page = app.readInt(qs, "page", 1, v)
 	input.PageSize = app.readInt(qs, "page_size", 20, v)
 	input.Sort = app.readString(qs, "sort", "id")
 	input.SortSafelist = []string{"id", "title", "year", "runtime",
 		"-id", "-title", "-year", "-runtime"}
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	movies, metadata, err := app.modelsFor(r).Movies.GetAll(input.Title, input.Genres, includeDeleted, input.Fields, input.Filters)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
 		return
 	}
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	err = app.embedMovieIncludes(r, input.Include, movies)
 	if err != nil {
 		app.serverErrResponse(w, r, err)
 		return
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/datewu/xyz/internal/data"
+)
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	runtimeType   = reflect.TypeOf(data.Runtime(0))
+	auditHashType = reflect.TypeOf(data.AuditHash(nil))
+	movieType     = reflect.TypeOf(data.Movie{})
+	rawJSONType   = reflect.TypeOf(json.RawMessage(nil))
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// schemaBuilder turns Go types into JSON schemas the way encoding/json
+// would encode them. Named structs become components, referenced by
+// name. Fields without omitempty are required in responses, request
+// bodies don't mark anything required, the handlers validate that.
+type schemaBuilder struct {
+	components map[string]interface{}
+	types      map[string]reflect.Type
+	request    bool
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		return nullable(b.schema(t.Elem()))
+	}
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case runtimeType:
+		return map[string]interface{}{
+			"type":        "string",
+			"pattern":     `^[0-9]+ mins$`,
+			"description": `Running time in minutes, written as "<minutes> mins"`,
+			"examples":    []string{"102 mins"},
+		}
+	case auditHashType:
+		return map[string]interface{}{
+			"type":        "string",
+			"pattern":     "^[0-9a-f]*$",
+			"description": "Hex encoded SHA-256 hash",
+		}
+	case rawJSONType:
+		return map[string]interface{}{"description": "Any JSON value"}
+	case movieType:
+		// every field may be left out by ?fields=, and ?include= adds
+		// the related resources as further properties
+		if _, ok := b.types["Movie"]; !ok {
+			b.types["Movie"] = t
+			s := b.structSchema(t)
+			delete(s, "required")
+			s["description"] = "A movie, with only the properties named by ?fields= when given, plus any named by ?include="
+			b.components["Movie"] = s
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/Movie"}
+	}
+	// a type encoding itself must be one of the cases above, or the
+	// schema would describe what it isn't
+	if t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType) {
+		panic(fmt.Sprintf("openapi: %s has its own JSON encoding and no schema for it", t))
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if other, ok := b.types[name]; ok {
+			if other != t {
+				panic(fmt.Sprintf("openapi: %s and %s both make schema %s", other, t, name))
+			}
+		} else {
+			b.types[name] = t
+			b.components[name] = b.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	panic(fmt.Sprintf("openapi: no schema for %s", t))
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			embedded := b.structSchema(f.Type)
+			for k, v := range embedded["properties"].(map[string]interface{}) {
+				props[k] = v
+			}
+			if req, ok := embedded["required"].([]string); ok {
+				required = append(required, req...)
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = b.schema(f.Type)
+		if !b.request && !strings.Contains(tag, ",omitempty") {
+			required = append(required, name)
+		}
+	}
+	s := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// nullable lets s be null as well, the way a nil pointer encodes.
+func nullable(s map[string]interface{}) map[string]interface{} {
+	if typ, ok := s["type"].(string); ok {
+		s["type"] = []string{typ, "null"}
+		return s
+	}
+	if _, ok := s["$ref"]; ok {
+		return map[string]interface{}{"anyOf": []interface{}{s, map[string]interface{}{"type": "null"}}}
+	}
+	return s
+}
+
+// openAPIPath turns httprouter's :name parameters into {name}.
+func openAPIPath(path string) (string, []string) {
+	segs := strings.Split(path, "/")
+	var names []string
+	for i, seg := range segs {
+		if strings.HasPrefix(seg, ":") {
+			names = append(names, seg[1:])
+			segs[i] = "{" + seg[1:] + "}"
+		}
+	}
+	return strings.Join(segs, "/"), names
+}
+
+// operationID names an operation after its handler, listMovieHandler
+// becomes listMovie.
+func operationID(h http.HandlerFunc) string {
+	name := runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
+	name = strings.TrimSuffix(name, "-fm")
+	name = name[strings.LastIndex(name, ".")+1:]
+	return strings.TrimSuffix(name, "Handler")
+}
+
+func (b *schemaBuilder) operation(rt route) map[string]interface{} {
+	op := map[string]interface{}{
+		"operationId": operationID(rt.handler),
+		"summary":     rt.summary,
+	}
+	_, pathParams := openAPIPath(rt.path)
+	var parameters []interface{}
+	for _, name := range pathParams {
+		schema := map[string]interface{}{"type": "integer", "format": "int64", "minimum": 1}
+		if name == "name" {
+			schema = map[string]interface{}{"type": "string"}
+		}
+		parameters = append(parameters, map[string]interface{}{
+			"name":     name,
+			"in":       "path",
+			"required": true,
+			"schema":   schema,
+		})
+	}
+	for _, q := range rt.query {
+		schema := b.schema(reflect.TypeOf(q.schema))
+		if len(q.enum) > 0 {
+			schema["enum"] = q.enum
+		}
+		p := map[string]interface{}{"name": q.name, "in": "query", "schema": schema}
+		if q.description != "" {
+			p["description"] = q.description
+		}
+		parameters = append(parameters, p)
+	}
+	if rt.idempotent {
+		parameters = append(parameters, map[string]interface{}{
+			"name":        "Idempotency-Key",
+			"in":          "header",
+			"description": "Client chosen key, a retry with the same key and body replays the first response rather than running again. Ignored for anonymous requests",
+			"schema":      map[string]interface{}{"type": "string", "minLength": 1, "maxLength": 255},
+		})
+	}
+	if len(parameters) > 0 {
+		op["parameters"] = parameters
+	}
+	if rt.permission != "" {
+		op["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}}
+		op["x-permission"] = rt.permission
+		op["description"] = fmt.Sprintf("Needs the %s permission.", rt.permission)
+	}
+
+	content := make(map[string]interface{})
+	if rt.body != nil {
+		b.request = true
+		content["application/json"] = map[string]interface{}{"schema": b.schema(reflect.TypeOf(rt.body))}
+		for mt, body := range rt.moreBodies {
+			content[mt] = map[string]interface{}{"schema": b.schema(reflect.TypeOf(body))}
+		}
+		b.request = false
+	}
+	for _, mt := range rt.rawBody {
+		content[mt] = map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}
+	}
+	if len(content) > 0 {
+		op["requestBody"] = map[string]interface{}{"required": true, "content": content}
+	}
+
+	content = make(map[string]interface{})
+	if rt.response != nil {
+		props := make(map[string]interface{})
+		var required []string
+		for key, v := range rt.response {
+			props[key] = b.schema(reflect.TypeOf(v))
+			required = append(required, key)
+		}
+		sort.Strings(required)
+		content["application/json"] = map[string]interface{}{"schema": map[string]interface{}{
+			"type":       "object",
+			"properties": props,
+			"required":   required,
+		}}
+	}
+	for _, mt := range rt.rawResponse {
+		schema := map[string]interface{}{"type": "string"}
+		if mt == "application/json" {
+			schema = map[string]interface{}{}
+		}
+		content[mt] = map[string]interface{}{"schema": schema}
+	}
+	op["responses"] = map[string]interface{}{
+		strconv.Itoa(rt.status): map[string]interface{}{
+			"description": http.StatusText(rt.status),
+			"content":     content,
+		},
+		"default": map[string]interface{}{"$ref": "#/components/responses/Error"},
+	}
+	return op
+}
+
+// buildOpenAPI describes every route of table as an OpenAPI 3.1 document.
+func (app *application) buildOpenAPI(table []route) (map[string]interface{}, error) {
+	b := &schemaBuilder{
+		components: make(map[string]interface{}),
+		types:      make(map[string]reflect.Type),
+	}
+	paths := make(map[string]map[string]interface{})
+	operationIDs := make(map[string]bool)
+	for _, rt := range table {
+		path, _ := openAPIPath(rt.path)
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		method := strings.ToLower(rt.method)
+		if _, ok := paths[path][method]; ok {
+			return nil, fmt.Errorf("openapi: %s %s is listed twice", rt.method, rt.path)
+		}
+		op := b.operation(rt)
+		// a handler serving several methods names one operation each
+		id := op["operationId"].(string)
+		if operationIDs[id] {
+			id += strings.Title(method)
+			op["operationId"] = id
+		}
+		operationIDs[id] = true
+		paths[path][method] = op
+	}
+
+	problemRef := b.schema(reflect.TypeOf(problem{}))
+	b.components["LegacyError"] = map[string]interface{}{
+		"type":     "object",
+		"required": []string{"error"},
+		"properties": map[string]interface{}{
+			"error": map[string]interface{}{"oneOf": []interface{}{
+				map[string]interface{}{"type": "string"},
+				map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": "string"}},
+			}},
+		},
+	}
+	return map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":   "Greenlight API",
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": b.components,
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "An error, as problem+json unless the client accepts application/json or the server runs with -error-format=legacy",
+					"content": map[string]interface{}{
+						"application/problem+json": map[string]interface{}{"schema": problemRef},
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{"$ref": "#/components/schemas/LegacyError"},
+						},
+					},
+				},
+			},
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "Authentication token from POST /v1/tokens/authentication",
+				},
+			},
+		},
+	}, nil
+}
+
+// mustBuildOpenAPI builds the document for table. It only fails on a
+// route whose types have no schema, a bug caught by the first start.
+func (app *application) mustBuildOpenAPI(table []route) []byte {
+	doc, err := app.buildOpenAPI(table)
+	if err != nil {
+		panic(err)
+	}
+	js, err := json.Marshal(doc)
+	if err != nil {
+		panic(err)
+	}
+	return js
+}
+
+func (app *application) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(app.openapi)
+}
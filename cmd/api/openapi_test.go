@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// documentedRoutes returns every operation of the served document as
+// "METHOD /path", with its parameters in httprouter's syntax.
+func documentedRoutes(t *testing.T, app *application) []string {
+	t.Helper()
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	err := json.Unmarshal(app.openapi, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var routes []string
+	for path, ops := range doc.Paths {
+		segs := strings.Split(path, "/")
+		for i, seg := range segs {
+			if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+				segs[i] = ":" + seg[1:len(seg)-1]
+			}
+		}
+		for method := range ops {
+			routes = append(routes, strings.ToUpper(method)+" "+strings.Join(segs, "/"))
+		}
+	}
+	sort.Strings(routes)
+	return routes
+}
+
+// servedBy registers the routes of app's table the way router does,
+// each answering with its own "METHOD /path".
+func servedBy(app *application) *httprouter.Router {
+	router := httprouter.New()
+	router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	var routes []route
+	for _, rt := range app.routeTable() {
+		name := rt.method + " " + rt.path
+		routes = append(routes, route{method: rt.method, path: rt.path, handler: func(w http.ResponseWriter, r *http.Request) {
+			var params []string
+			for _, p := range httprouter.ParamsFromContext(r.Context()) {
+				params = append(params, p.Key+"="+p.Value)
+			}
+			fmt.Fprint(w, name, " ", strings.Join(params, ","))
+		}})
+	}
+	handleRoutes(router, routes)
+	return router
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	for _, metrics := range []bool{false, true} {
+		app := &application{}
+		app.config.metrics = metrics
+		app.router()
+		router := servedBy(app)
+		documented := documentedRoutes(t, app)
+		if len(documented) != len(app.routeTable()) {
+			t.Errorf("metrics=%t: %d routes documented, the table has %d", metrics, len(documented), len(app.routeTable()))
+		}
+		for _, rt := range documented {
+			method, path := rt[:strings.Index(rt, " ")], rt[strings.Index(rt, " ")+1:]
+			segs := strings.Split(path, "/")
+			for i, seg := range segs {
+				if strings.HasPrefix(seg, ":") {
+					segs[i] = "1"
+				}
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(method, strings.Join(segs, "/"), nil))
+			if got := rr.Body.String(); !strings.HasPrefix(got, rt+" ") {
+				t.Errorf("metrics=%t: %s is served by %q", metrics, rt, got)
+			}
+		}
+	}
+}
+
+// TestRoutesNextToWildcards checks the routes handleRoutes dispatches
+// itself get their own parameters, and others fall through.
+func TestRoutesNextToWildcards(t *testing.T) {
+	router := servedBy(&application{})
+	tests := []struct {
+		method, path, want string
+	}{
+		{http.MethodGet, "/v1/movies/7", "GET /v1/movies/:id id=7"},
+		{http.MethodGet, "/v1/movies/export", "GET /v1/movies/export "},
+		{http.MethodGet, "/v1/movies/events", "GET /v1/movies/events "},
+		{http.MethodGet, "/v1/movies/7/revisions", "GET /v1/movies/:id/revisions id=7"},
+		{http.MethodGet, "/v1/movies/7/revisions/3", "GET /v1/movies/:id/revisions/:version id=7,version=3"},
+		{http.MethodGet, "/v1/movies/7/diff", "GET /v1/movies/:id/diff id=7"},
+		{http.MethodGet, "/v1/movies/import/12", "GET /v1/movies/import/:id id=12"},
+		// a static segment wins, as it would in httprouter
+		{http.MethodGet, "/v1/movies/import/diff", "GET /v1/movies/import/:id id=diff"},
+		{http.MethodPost, "/v1/movies/import", "POST /v1/movies/import "},
+		{http.MethodPost, "/v1/movies/7/restore", "POST /v1/movies/:id/restore id=7"},
+		{http.MethodGet, "/v1/movies/7/other", ""},
+		{http.MethodPost, "/v1/movies/7", "Method Not Allowed\n"},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path, nil))
+		if got := rr.Body.String(); got != tt.want {
+			t.Errorf("%s %s: served by %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestOpenAPIOperationIDsAreUnique(t *testing.T) {
+	app := &application{}
+	app.router()
+	var doc struct {
+		Paths map[string]map[string]struct {
+			OperationID string `json:"operationId"`
+		} `json:"paths"`
+	}
+	err := json.Unmarshal(app.openapi, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]string)
+	for path, ops := range doc.Paths {
+		for method, op := range ops {
+			if other, ok := seen[op.OperationID]; ok {
+				t.Errorf("operationId %s is used by %s and %s %s", op.OperationID, other, method, path)
+			}
+			seen[op.OperationID] = method + " " + path
+		}
+	}
+}
+
+// TestMovieCollectionPathsConflict pins the reason handleRoutes
+// dispatches static segments next to wildcards itself, if a router
+// upgrade lifts it the routes can be registered as they are.
+func TestMovieCollectionPathsConflict(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("httprouter accepts /v1/movies/export next to /v1/movies/:id, handleRoutes can register routes as they are")
+		}
+	}()
+	router := httprouter.New()
+	h := func(http.ResponseWriter, *http.Request) {}
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", h)
+	router.HandlerFunc(http.MethodGet, "/v1/movies/export", h)
+}
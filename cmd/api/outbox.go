@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/datewu/xyz/internal/data"
+	"github.com/datewu/xyz/internal/validator"
+)
+
+// jobSendEmail delivers one outbox message.
+const jobSendEmail = "email.send"
+
+type sendEmailPayload struct {
+	OutboxID int64 `json:"outbox_id"`
+}
+
+// sendEmail records an email in the outbox and queues the job that
+// delivers it, so a failing SMTP server or a restart can't lose it.
+// Both go through models, inside the caller's transaction if any.
+func (app *application) sendEmail(models data.Models, recipient, locale, templateFile string, tmplData map[string]interface{}) error {
+	msg := &data.OutboxMessage{
+		Recipient: recipient,
+		Locale:    locale,
+		Template:  templateFile,
+		Data:      tmplData,
+	}
+	err := models.Outbox.Insert(msg)
+	if err != nil {
+		return err
+	}
+	return app.enqueueEmail(models, msg.ID)
+}
+
+func (app *application) enqueueEmail(models data.Models, outboxID int64) error {
+	job := &data.Job{
+		Kind:        jobSendEmail,
+		UniqueKey:   "email:" + strconv.FormatInt(outboxID, 10),
+		MaxAttempts: app.config.outbox.maxAttempts,
+	}
+	return app.enqueueJob(models, job, sendEmailPayload{OutboxID: outboxID})
+}
+
+// sendEmailJob delivers the outbox message and mirrors the outcome
+// of each attempt onto it, so the outbox stays the place to look.
+func (app *application) sendEmailJob(ctx context.Context, job *data.Job) error {
+	var payload sendEmailPayload
+	err := decodePayload(job, &payload)
+	if err != nil {
+		return err
+	}
+	msg, err := app.models.Outbox.Get(payload.OutboxID)
+	if err != nil {
+		return err
+	}
+	if msg.Status == data.OutboxSent {
+		return nil
+	}
+	sendErr := app.mailer.Send(msg.Recipient, msg.Locale, msg.Template, msg.Data)
+	if sendErr == nil {
+		return app.models.Outbox.MarkSent(msg.ID)
+	}
+	dead := job.Attempts >= job.MaxAttempts
+	err = app.models.Outbox.MarkFailed(msg.ID, sendErr, time.Now().Add(jobBackoff(job.Attempts)), dead)
+	if err != nil {
+		app.logger.PrintErr(err, map[string]string{"outbox_id": strconv.FormatInt(msg.ID, 10)})
+	}
+	return sendErr
+}
+
+func (app *application) listOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status    string
+		Recipient string
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+	input.Status = app.readString(qs, "status", "")
+	input.Recipient = app.readString(qs, "recipient", "")
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Sort = app.readString(qs, "sort", "-id")
+	input.SortSafelist = []string{"id", "next_attempt_at", "attempts",
+		"-id", "-next_attempt_at", "-attempts"}
+	v.Check(input.Status == "" || validator.In(input.Status,
+		data.OutboxPending, data.OutboxSent, data.OutboxDead), "status", "invalid status value")
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	msgs, metadata, err := app.modelsFor(r).Outbox.GetAll(input.Status, input.Recipient, input.Filters)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"messages": msgs, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+func (app *application) showOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFountResponse(w, r)
+		return
+	}
+	msg, err := app.modelsFor(r).Outbox.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFountResponse(w, r)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": msg}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+func (app *application) retryOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFountResponse(w, r)
+		return
+	}
+	msg, err := app.modelsFor(r).Outbox.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFountResponse(w, r)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+	if msg.Status == data.OutboxSent {
+		v := validator.New()
+		v.AddErr("status", "message has already been sent")
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	err = app.inTx(r, func(r *http.Request) error {
+		err := app.modelsFor(r).Outbox.Retry(msg)
+		if err != nil {
+			return err
+		}
+		err = app.enqueueEmail(app.modelsFor(r), msg.ID)
+		if err != nil {
+			return err
+		}
+		return app.audit(r, auditEvent{
+			Action:       "outbox.retry",
+			ResourceType: "email",
+			ResourceID:   strconv.FormatInt(msg.ID, 10),
+			After:        msg,
+		})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": msg}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
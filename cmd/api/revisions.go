@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/datewu/xyz/internal/data"
+	"github.com/datewu/xyz/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+// readHistoryMovie loads the movie named by the :id parameter for the
+// history endpoints, deleted movies included when ?include_deleted
+// is set and permitted. A purged movie keeps its history, and stands
+// in as its last revision. It writes the error response itself and
+// returns nil when the request can't go on.
+func (app *application) readHistoryMovie(w http.ResponseWriter, r *http.Request) *data.Movie {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFountResponse(w, r)
+		return nil
+	}
+	includeDeleted, ok := app.readIncludeDeleted(w, r)
+	if !ok {
+		return nil
+	}
+	var m *data.Movie
+	if includeDeleted {
+		m, err = app.modelsFor(r).Movies.GetIncludingDeleted(id)
+		if errors.Is(err, data.ErrRecordNotFound) {
+			m, err = app.purgedMovie(r, id)
+		}
+	} else {
+		m, err = app.modelsFor(r).Movies.Get(id)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFountResponse(w, r)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return nil
+	}
+	return m
+}
+
+// purgedMovie rebuilds a purged movie from its last revision, the
+// delete, which is when it was deleted.
+func (app *application) purgedMovie(r *http.Request, id int64) (*data.Movie, error) {
+	revs, err := app.modelsFor(r).Revisions.GetLatest(r.Context(), []int64{id})
+	if err != nil {
+		return nil, err
+	}
+	rev, ok := revs[id]
+	if !ok || !rev.Deleted {
+		return nil, data.ErrRecordNotFound
+	}
+	return &data.Movie{
+		ID:        rev.MovieID,
+		Title:     rev.Title,
+		Year:      rev.Year,
+		Runtime:   rev.Runtime,
+		Genres:    rev.Genres,
+		Version:   rev.Version,
+		DeletedAt: &rev.CreatedAt,
+	}, nil
+}
+
+func (app *application) getRevision(w http.ResponseWriter, r *http.Request, movieID int64, version int32) *data.MovieRevision {
+	rev, err := app.modelsFor(r).Revisions.Get(movieID, version)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFountResponse(w, r)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return nil
+	}
+	return rev
+}
+
+func (app *application) listMovieRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	m := app.readHistoryMovie(w, r)
+	if m == nil {
+		return
+	}
+	var input data.Filters
+	v := validator.New()
+	qs := r.URL.Query()
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Sort = app.readString(qs, "sort", "-version")
+	input.SortSafelist = []string{"version", "-version"}
+	if data.ValidateFilters(v, input); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	revs, metadata, err := app.modelsFor(r).Revisions.GetAllForMovie(m.ID, input)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"revisions": revs, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+func (app *application) showMovieRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	m := app.readHistoryMovie(w, r)
+	if m == nil {
+		return
+	}
+	version, err := strconv.ParseInt(httprouter.ParamsFromContext(r.Context()).ByName("version"), 10, 32)
+	if err != nil {
+		app.notFountResponse(w, r)
+		return
+	}
+	rev := app.getRevision(w, r, m.ID, int32(version))
+	if rev == nil {
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"revision": rev}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+// diffMovieRevisionsHandler compares ?from with ?to, which default to
+// the version before the current one and the current one.
+func (app *application) diffMovieRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	m := app.readHistoryMovie(w, r)
+	if m == nil {
+		return
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	to := app.readInt(qs, "to", int(m.Version), v)
+	from := app.readInt(qs, "from", to-1, v)
+	v.CheckCode(from >= 1, "from", validator.CodeTooSmall, "must be greater than zero")
+	v.Check(to >= 1 && to <= int(m.Version), "to", "must be an existing version")
+	v.Check(from != to, "from", "must differ from to")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	a := app.getRevision(w, r, m.ID, int32(from))
+	if a == nil {
+		return
+	}
+	b := app.getRevision(w, r, m.ID, int32(to))
+	if b == nil {
+		return
+	}
+	diff := map[string]interface{}{
+		"from":    from,
+		"to":      to,
+		"changes": data.DiffRevisions(a, b),
+	}
+	err := app.writeJSON(w, http.StatusOK, envelope{"diff": diff}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+type revertMovieInput struct {
+	Version int32 `json:"version"`
+}
+
+func (app *application) revertMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFountResponse(w, r)
+		return
+	}
+	var input revertMovieInput
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	m, err := app.modelsFor(r).Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFountResponse(w, r)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+	v := validator.New()
+	v.CheckCode(input.Version >= 1, "version", validator.CodeRequired, "must be provided")
+	v.Check(input.Version < m.Version, "version", "must be an earlier version")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	rev, err := app.modelsFor(r).Revisions.Get(m.ID, input.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddErr("version", "no revision is recorded for this version")
+			app.failedValidationResponse(w, r, v)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+	// a revision may predate the current rules, so it must pass them
+	// again before it becomes the movie
+	reverted := *m
+	reverted.Title, reverted.Year, reverted.Runtime, reverted.Genres = rev.Title, rev.Year, rev.Runtime, rev.Genres
+	if data.ValidateMovie(v, &reverted); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	before := *m
+	err = app.inTx(r, func(r *http.Request) error {
+		err := app.modelsFor(r).Movies.Revert(m, rev, app.contextGetUser(r).ID)
+		if err != nil {
+			return err
+		}
+		err = app.audit(r, auditEvent{
+			Action:       "movie.revert",
+			ResourceType: "movie",
+			ResourceID:   strconv.FormatInt(m.ID, 10),
+			Before:       before,
+			After:        m,
+		})
+		if err != nil {
+			return err
+		}
+		return app.publish(r, eventMovieUpdated, m)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": m}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
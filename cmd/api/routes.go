@@ -1,86 +1,784 @@
 package main
 
 import (
-	"expvar"
+	"context"
 	"net/http"
+	"sort"
+	"strings"
 
+	"github.com/datewu/xyz/internal/data"
+	"github.com/datewu/xyz/internal/mailer"
+	"github.com/datewu/xyz/internal/patch"
+	"github.com/datewu/xyz/internal/webhook"
 	"github.com/julienschmidt/httprouter"
 )
 
-func (app *application) routes() http.Handler {
+// route is one endpoint of the API. routes() registers it and the
+// OpenAPI document describes it, so neither can drift from the other.
+type route struct {
+	method  string
+	path    string
+	summary string
+	// permission the user needs, empty for endpoints anyone may call
+	permission string
+	handler    http.HandlerFunc
+	// idempotent routes honour an Idempotency-Key header, hashing up
+	// to maxBody bytes of the request, jsonMaxBytes when it's zero
+	idempotent bool
+	maxBody    int64
+
+	query []queryParam
+	// body is a value of the JSON request body's type, rawBody lists
+	// the media types of a body that isn't JSON instead
+	body    interface{}
+	rawBody []string
+	// moreBodies maps other media types the body may come in to a
+	// value of their type
+	moreBodies map[string]interface{}
+	// status and response describe the success response, rawResponse
+	// lists its media types when it isn't a JSON envelope
+	status      int
+	response    envelope
+	rawResponse []string
+}
+
+// queryParam documents a query string parameter, schema is a value of
+// its type, enum its allowed values if they're limited.
+type queryParam struct {
+	name        string
+	description string
+	schema      interface{}
+	enum        []string
+}
+
+var (
+	pageParams = []queryParam{
+		{name: "page", description: "Page number, from 1", schema: 0},
+		{name: "page_size", description: "Items per page, at most 100", schema: 0},
+	}
+	includeDeletedParam = queryParam{
+		name:        "include_deleted",
+		description: "Include soft deleted movies, needs the movies:deleted permission",
+		schema:      false,
+	}
+	movieFilterParams = []queryParam{
+		{name: "title", description: "Full text match on the title", schema: ""},
+		{name: "genres", description: "Comma separated genres the movie must all have", schema: ""},
+		includeDeletedParam,
+	}
+	movieSorts = []string{"id", "title", "year", "runtime",
+		"-id", "-title", "-year", "-runtime"}
+)
+
+// movieShapeParams documents ?fields= and ?include=.
+func (app *application) movieShapeParams() []queryParam {
+	return []queryParam{
+		{name: "fields", description: "Comma separated fields to return, of: " + strings.Join(data.MovieFields, ", "), schema: ""},
+		{name: "include", description: "Comma separated related resources to embed, of: " + strings.Join(app.movieIncludeNames(), ", "), schema: ""},
+	}
+}
+
+func sortParam(sorts ...string) queryParam {
+	return queryParam{
+		name:        "sort",
+		description: "Sort field, prefixed with - for descending order",
+		schema:      "",
+		enum:        sorts,
+	}
+}
+
+func params(groups ...[]queryParam) []queryParam {
+	var ps []queryParam
+	for _, g := range groups {
+		ps = append(ps, g...)
+	}
+	return ps
+}
+
+// routeTable lists every endpoint of the API.
+func (app *application) routeTable() []route {
+	table := []route{
+		{
+			method:   http.MethodGet,
+			path:     "/v1/healthcheck",
+			summary:  "Report that the API is up, and its version",
+			handler:  app.healthCheckHandler,
+			status:   http.StatusOK,
+			response: envelope{"status": "", "system_info": map[string]string{}},
+		},
+		{
+			method:      http.MethodGet,
+			path:        "/v1/openapi.json",
+			summary:     "This OpenAPI document",
+			handler:     app.openAPIHandler,
+			status:      http.StatusOK,
+			rawResponse: []string{"application/json"},
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/v1/batch",
+			summary:  "Run several requests as the caller, optionally in one transaction",
+			handler:  app.batchHandler,
+			body:     batchInput{},
+			status:   http.StatusOK,
+			response: envelope{"responses": []batchResponse{}, "committed": false},
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/v1/graphql",
+			summary: "Run a GraphQL query over movies and the current user",
+			handler: app.graphqlHandler,
+			query: []queryParam{
+				{name: "query", description: "The GraphQL query, mutations must be posted", schema: ""},
+				{name: "operationName", description: "The operation to run, of a document with several", schema: ""},
+				{name: "variables", description: "The variables as a JSON object", schema: ""},
+			},
+			status:      http.StatusOK,
+			rawResponse: []string{"application/json"},
+		},
+		{
+			method:      http.MethodPost,
+			path:        "/v1/graphql",
+			summary:     "Run a GraphQL query or mutation over movies and the current user",
+			handler:     app.graphqlHandler,
+			idempotent:  true,
+			body:        graphqlInput{},
+			status:      http.StatusOK,
+			rawResponse: []string{"application/json"},
+		},
+		{
+			method:     http.MethodGet,
+			path:       "/v1/movies",
+			summary:    "List movies",
+			permission: "movies:read",
+			handler:    app.listMovieHandler,
+			query:      params(movieFilterParams, app.movieShapeParams(), pageParams, []queryParam{sortParam(movieSorts...)}),
+			status:     http.StatusOK,
+			response:   envelope{"movies": []data.Movie{}, "metadata": data.Metadata{}},
+		},
+		{
+			method:     http.MethodPost,
+			path:       "/v1/movies",
+			summary:    "Create a movie",
+			permission: "movies:write",
+			handler:    app.createMovieHandler,
+			idempotent: true,
+			body:       createMovieInput{},
+			status:     http.StatusCreated,
+			response:   envelope{"movie": data.Movie{}},
+		},
+		{
+			method:     http.MethodGet,
+			path:       "/v1/movies/:id",
+			summary:    "Show a movie",
+			permission: "movies:read",
+			handler:    app.showMovieHandler,
+			query:      params([]queryParam{includeDeletedParam}, app.movieShapeParams()),
+			status:     http.StatusOK,
+			response:   envelope{"movie": data.Movie{}},
+		},
+		{
+			method:     http.MethodPatch,
+			path:       "/v1/movies/:id",
+			summary:    "Update a movie, by JSON with the fields to change, JSON Merge Patch or JSON Patch",
+			permission: "movies:write",
+			handler:    app.updateMovieHandler,
+			body:       updateMovieInput{},
+			moreBodies: map[string]interface{}{
+				mediaMergePatch: updateMovieInput{},
+				mediaJSONPatch:  []patch.Operation{},
+			},
+			status:   http.StatusOK,
+			response: envelope{"movie": data.Movie{}},
+		},
+		{
+			method:     http.MethodDelete,
+			path:       "/v1/movies/:id",
+			summary:    "Soft delete a movie",
+			permission: "movies:write",
+			handler:    app.deleteMovieHandler,
+			status:     http.StatusOK,
+			response:   envelope{"message": ""},
+		},
+		{
+			method:     http.MethodPost,
+			path:       "/v1/movies/:id/restore",
+			summary:    "Restore a soft deleted movie",
+			permission: "movies:deleted",
+			handler:    app.restoreMovieHandler,
+			status:     http.StatusOK,
+			response:   envelope{"movie": data.Movie{}},
+		},
+		{
+			method:     http.MethodGet,
+			path:       "/v1/movies/:id/revisions",
+			summary:    "List the revisions of a movie",
+			permission: "movies:read",
+			handler:    app.listMovieRevisionsHandler,
+			query:      params([]queryParam{includeDeletedParam}, pageParams, []queryParam{sortParam("version", "-version")}),
+			status:     http.StatusOK,
+			response:   envelope{"revisions": []data.MovieRevision{}, "metadata": data.Metadata{}},
+		},
+		{
+			method:     http.MethodGet,
+			path:       "/v1/movies/:id/revisions/:version",
+			summary:    "Show one revision of a movie",
+			permission: "movies:read",
+			handler:    app.showMovieRevisionHandler,
+			query:      []queryParam{includeDeletedParam},
+			status:     http.StatusOK,
+			response:   envelope{"revision": data.MovieRevision{}},
+		},
+		{
+			method:     http.MethodGet,
+			path:       "/v1/movies/:id/diff",
+			summary:    "Compare two revisions of a movie",
+			permission: "movies:read",
+			handler:    app.diffMovieRevisionsHandler,
+			query: []queryParam{
+				includeDeletedParam,
+				{name: "from", description: "Older version, defaults to the one before to", schema: 0},
+				{name: "to", description: "Newer version, defaults to the current one", schema: 0},
+			},
+			status: http.StatusOK,
+			response: envelope{"diff": struct {
+				From    int                         `json:"from"`
+				To      int                         `json:"to"`
+				Changes map[string]data.FieldChange `json:"changes"`
+			}{}},
+		},
+		{
+			method:     http.MethodPost,
+			path:       "/v1/movies/:id/revert",
+			summary:    "Revert a movie to an earlier version",
+			permission: "movies:write",
+			handler:    app.revertMovieHandler,
+			idempotent: true,
+			body:       revertMovieInput{},
+			status:     http.StatusOK,
+			response:   envelope{"movie": data.Movie{}},
+		},
+		{
+			method:     http.MethodGet,
+			path:       "/v1/movies/export",
+			summary:    "Stream every matching movie, unpaged",
+			permission: "movies:read",
+			handler:    app.exportMoviesHandler,
+			query: params(movieFilterParams, []queryParam{
+				sortParam(movieSorts...),
+				{name: "format", description: "Defaults by Accept header, then to ndjson", schema: "", enum: []string{"ndjson", "csv", "json"}},
+			}),
+			status:      http.StatusOK,
+			rawResponse: []string{"application/x-ndjson", "text/csv", "application/json"},
+		},
+		{
+			method:     http.MethodGet,
+			path:       "/v1/movies/events",
+			summary:    "Stream movie changes as server-sent events: " + strings.Join([]string{data.MovieCreated, data.MovieUpdated, data.MovieDeleted}, ", "),
+			permission: "movies:read",
+			handler:    app.movieEventsHandler,
+			query: []queryParam{
+				{name: "last_event_id", description: "Resume after this event, for clients that can't send Last-Event-ID", schema: 0},
+			},
+			status:      http.StatusOK,
+			rawResponse: []string{"text/event-stream"},
+		},
+		{
+			method:     http.MethodPost,
+			path:       "/v1/movies/import",
+			summary:    "Import movies from CSV or NDJSON, large imports run as a job",
+			permission: "movies:write",
+			handler:    app.importMoviesHandler,
+			idempotent: true,
+			maxBody:    importMaxBytes,
+			query: []queryParam{
+				{name: "format", description: "Defaults by Content-Type", schema: "", enum: []string{"csv", "ndjson"}},
+				{name: "dry_run", description: "Validate without inserting", schema: false},
+				{name: "async", description: "Run as a job however small", schema: false},
+			},
+			rawBody:  []string{"text/csv", "application/x-ndjson"},
+			status:   http.StatusOK,
+			response: envelope{"report": data.ImportReport{}},
+		},
+		{
+			method:     http.MethodGet,
+			path:       "/v1/movies/import/:id",
+			summary:    "Show an import the caller started as a job",
+			permission: "movies:write",
+			handler:    app.showMovieImportHandler,
+			status:     http.StatusOK,
+			response:   envelope{"import": data.MovieImport{}},
+		},
+		{
+			method:     http.MethodPost,
+			path:       "/v1/users",
+			summary:    "Register a user",
+			handler:    app.registerUserHandler,
+			idempotent: true,
+			body:       registerUserInput{},
+			status:     http.StatusAccepted,
+			response:   envelope{"user": data.User{}},
+		},
+		{
+			method:   http.MethodPut,
+			path:     "/v1/users/activated",
+			summary:  "Activate a user with an activation token",
+			handler:  app.activateUserHandler,
+			body:     activateUserInput{},
+			status:   http.StatusOK,
+			response: envelope{"user": data.User{}},
+		},
+		{
+			method:   http.MethodPut,
+			path:     "/v1/users/password",
+			summary:  "Reset a password with a password reset token",
+			handler:  app.updateUserPasswordHandler,
+			body:     updatePasswordInput{},
+			status:   http.StatusOK,
+			response: envelope{"message": ""},
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/v1/tokens/authentication",
+			summary:  "Log in, creating an authentication token",
+			handler:  app.createAuthenticationTokenHandler,
+			body:     createAuthTokenInput{},
+			status:   http.StatusCreated,
+			response: envelope{"authentication_token": data.Token{}},
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/v1/tokens/activation",
+			summary:  "Email a new activation token",
+			handler:  app.createActivationTokenHandler,
+			body:     emailInput{},
+			status:   http.StatusAccepted,
+			response: envelope{"message": ""},
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/v1/tokens/password-reset",
+			summary:  "Email a password reset token",
+			handler:  app.createPwdResetTokenHandler,
+			body:     emailInput{},
+			status:   http.StatusAccepted,
+			response: envelope{"message": ""},
+		},
+		{
+			method:   http.MethodPut,
+			path:     "/v1/invitations/accepted",
+			summary:  "Accept an invitation, creating an activated user",
+			handler:  app.acceptInvitationHandler,
+			body:     acceptInvitationInput{},
+			status:   http.StatusOK,
+			response: envelope{"user": data.User{}},
+		},
+		{
+			method:     http.MethodGet,
+			path:       "/v1/admin/invitations",
+			summary:    "List invitations",
+			permission: "users:invite",
+			handler:    app.listInvitationsHandler,
+			query: params([]queryParam{{name: "status", schema: "", enum: []string{data.InvitationPending, data.InvitationAccepted, data.InvitationRevoked, data.InvitationExpired}}},
+				pageParams, []queryParam{sortParam("id", "email", "expiry", "-id", "-email", "-expiry")}),
+			status:   http.StatusOK,
+			response: envelope{"invitations": []data.Invitation{}, "metadata": data.Metadata{}},
+		},
+		{
+			method:     http.MethodPost,
+			path:       "/v1/admin/invitations",
+			summary:    "Invite someone by email",
+			permission: "users:invite",
+			handler:    app.createInvitationHandler,
+			idempotent: true,
+			body:       createInvitationInput{},
+			status:     http.StatusAccepted,
+			response:   envelope{"invitation": data.Invitation{}},
+		},
+		{
+			method:     http.MethodDelete,
+			path:       "/v1/admin/invitations/:id",
+			summary:    "Revoke a pending invitation",
+			permission: "users:invite",
+			handler:    app.revokeInvitationHandler,
+			status:     http.StatusOK,
+			response:   envelope{"invitation": data.Invitation{}},
+		},
+		{
+			method:     http.MethodGet,
+			path:       "/v1/admin/mail/outbox",
+			summary:    "List outgoing emails",
+			permission: "mail:admin",
+			handler:    app.listOutboxHandler,
+			query: params([]queryParam{
+				{name: "status", schema: "", enum: []string{data.OutboxPending, data.OutboxSent, data.OutboxDead}},
+				{name: "recipient", schema: ""},
+			}, pageParams, []queryParam{sortParam("id", "next_attempt_at", "attempts", "-id", "-next_attempt_at", "-attempts")}),
+			status:   http.StatusOK,
+			response: envelope{"messages": []data.OutboxMessage{}, "metadata": data.Metadata{}},
+		},
+		{
+			method:     http.MethodGet,
+			path:       "/v1/admin/mail/outbox/:id",
+			summary:    "Show an outgoing email",
+			permission: "mail:admin",
+			handler:    app.showOutboxHandler,
+			status:     http.StatusOK,
+			response:   envelope{"message": data.OutboxMessage{}},
+		},
+		{
+			method:     http.MethodPost,
+			path:       "/v1/admin/mail/outbox/:id/retry",
+			summary:    "Send a dead email again",
+			permission: "mail:admin",
+			handler:    app.retryOutboxHandler,
+			status:     http.StatusAccepted,
+			response:   envelope{"message": data.OutboxMessage{}},
+		},
+		{
+			method:     http.MethodGet,
+			path:       "/v1/admin/jobs",
+			summary:    "List background jobs",
+			permission: "jobs:admin",
+			handler:    app.listJobsHandler,
+			query: params([]queryParam{
+				{name: "status", schema: "", enum: []string{data.JobPending, data.JobRunning, data.JobDone, data.JobFailed}},
+				{name: "kind", schema: ""},
+			}, pageParams, []queryParam{sortParam("id", "run_at", "attempts", "-id", "-run_at", "-attempts")}),
+			status:   http.StatusOK,
+			response: envelope{"jobs": []data.Job{}, "metadata": data.Metadata{}},
+		},
+		{
+			method:     http.MethodGet,
+			path:       "/v1/admin/jobs/:id",
+			summary:    "Show a background job",
+			permission: "jobs:admin",
+			handler:    app.showJobHandler,
+			status:     http.StatusOK,
+			response:   envelope{"job": data.Job{}},
+		},
+		{
+			method:     http.MethodPost,
+			path:       "/v1/admin/jobs/:id/retry",
+			summary:    "Run a failed job again",
+			permission: "jobs:admin",
+			handler:    app.retryJobHandler,
+			status:     http.StatusAccepted,
+			response:   envelope{"job": data.Job{}},
+		},
+		{
+			method:     http.MethodGet,
+			path:       "/v1/admin/mail/templates",
+			summary:    "List email templates and their translations",
+			permission: "mail:admin",
+			handler:    app.listMailTemplatesHandler,
+			status:     http.StatusOK,
+			response:   envelope{"templates": []mailer.TemplateInfo{}},
+		},
+		{
+			method:     http.MethodPost,
+			path:       "/v1/admin/mail/templates/:name/preview",
+			summary:    "Render an email template",
+			permission: "mail:admin",
+			handler:    app.previewMailTemplateHandler,
+			body:       previewMailTemplateInput{},
+			status:     http.StatusOK,
+			response:   envelope{"preview": map[string]string{}},
+		},
+		{
+			method:     http.MethodPost,
+			path:       "/v1/admin/mail/templates/:name/send",
+			summary:    "Render an email template and send it",
+			permission: "mail:admin",
+			handler:    app.testSendMailTemplateHandler,
+			idempotent: true,
+			body:       testSendMailTemplateInput{},
+			status:     http.StatusOK,
+			response:   envelope{"message": ""},
+		},
+		{
+			method:     http.MethodGet,
+			path:       "/v1/admin/webhooks",
+			summary:    "List webhook subscriptions",
+			permission: "webhooks:admin",
+			handler:    app.listWebhooksHandler,
+			query:      params(pageParams, []queryParam{sortParam("id", "url", "-id", "-url")}),
+			status:     http.StatusOK,
+			response:   envelope{"webhooks": []data.Webhook{}, "metadata": data.Metadata{}},
+		},
+		{
+			method:     http.MethodPost,
+			path:       "/v1/admin/webhooks",
+			summary:    "Subscribe a URL to events, of: " + strings.Join(webhookEvents, ", "),
+			permission: "webhooks:admin",
+			handler:    app.createWebhookHandler,
+			body:       createWebhookInput{},
+			status:     http.StatusCreated,
+			response:   envelope{"webhook": data.Webhook{}, "secret": ""},
+		},
+		{
+			method:     http.MethodGet,
+			path:       "/v1/admin/webhooks/:id",
+			summary:    "Show a webhook subscription",
+			permission: "webhooks:admin",
+			handler:    app.showWebhookHandler,
+			status:     http.StatusOK,
+			response:   envelope{"webhook": data.Webhook{}},
+		},
+		{
+			method:     http.MethodPatch,
+			path:       "/v1/admin/webhooks/:id",
+			summary:    "Update a webhook subscription, or rotate its secret",
+			permission: "webhooks:admin",
+			handler:    app.updateWebhookHandler,
+			body:       updateWebhookInput{},
+			status:     http.StatusOK,
+			response:   envelope{"webhook": data.Webhook{}},
+		},
+		{
+			method:     http.MethodDelete,
+			path:       "/v1/admin/webhooks/:id",
+			summary:    "Delete a webhook subscription and its delivery log",
+			permission: "webhooks:admin",
+			handler:    app.deleteWebhookHandler,
+			status:     http.StatusOK,
+			response:   envelope{"message": ""},
+		},
+		{
+			method:     http.MethodGet,
+			path:       "/v1/admin/webhooks/:id/deliveries",
+			summary:    "List a webhook's delivery attempts, newest first",
+			permission: "webhooks:admin",
+			handler:    app.listWebhookDeliveriesHandler,
+			query:      pageParams,
+			status:     http.StatusOK,
+			response:   envelope{"deliveries": []data.WebhookDelivery{}, "metadata": data.Metadata{}},
+		},
+		{
+			method:     http.MethodPost,
+			path:       "/v1/admin/webhooks/:id/ping",
+			summary:    "Send a webhook.ping event to a webhook",
+			permission: "webhooks:admin",
+			handler:    app.pingWebhookHandler,
+			status:     http.StatusAccepted,
+			response:   envelope{"event": webhook.Event{}},
+		},
+		{
+			method:     http.MethodGet,
+			path:       "/v1/admin/audit",
+			summary:    "List audit log entries",
+			permission: "audit:read",
+			handler:    app.listAuditHandler,
+			query: params([]queryParam{
+				{name: "actor_id", schema: 0},
+				{name: "resource_type", schema: ""},
+				{name: "resource_id", schema: ""},
+				{name: "since", description: "RFC 3339 timestamp", schema: ""},
+				{name: "until", description: "RFC 3339 timestamp", schema: ""},
+			}, pageParams, []queryParam{sortParam("id", "created_at", "-id", "-created_at")}),
+			status:   http.StatusOK,
+			response: envelope{"entries": []data.AuditEntry{}, "metadata": data.Metadata{}},
+		},
+		{
+			method:     http.MethodGet,
+			path:       "/v1/admin/audit/verify",
+			summary:    "Check the audit log's hash chain",
+			permission: "audit:read",
+			handler:    app.verifyAuditHandler,
+			status:     http.StatusOK,
+			response:   envelope{"verification": data.AuditVerification{}},
+		},
+	}
+	if app.config.metrics {
+		table = append(table, route{
+			method:      http.MethodGet,
+			path:        "/debug/vars",
+			summary:     "Expvar metrics",
+			handler:     app.debugVarsHandler,
+			status:      http.StatusOK,
+			rawResponse: []string{"application/json"},
+		})
+	}
+	return table
+}
+
+// router registers every route of the table.
+func (app *application) router() *httprouter.Router {
 	router := httprouter.New()
 	router.NotFound = http.HandlerFunc(app.notFountResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowResponse)
 
-	router.HandlerFunc(
-		http.MethodGet,
-		"/v1/healthcheck",
-		app.healthCheckHandler)
-
-	router.HandlerFunc(
-		http.MethodGet,
-		"/v1/movies",
-		app.requirePermission("movies:read", app.listMovieHandler))
-
-	router.HandlerFunc(
-		http.MethodPost,
-		"/v1/movies",
-		app.requirePermission("movies:write", app.createMovieHandler))
-
-	router.HandlerFunc(
-		http.MethodGet,
-		"/v1/movies/:id",
-		app.requirePermission("movies:read", app.showMovieHandler))
-
-	router.HandlerFunc(
-		http.MethodPatch,
-		"/v1/movies/:id",
-		app.requirePermission("movies:write", app.updateMovieHandler))
-
-	router.HandlerFunc(
-		http.MethodDelete,
-		"/v1/movies/:id",
-		app.requirePermission("movies:write", app.deleteMovieHandler))
-
-	router.HandlerFunc(
-		http.MethodPost,
-		"/v1/users",
-		app.registerUserHandler)
-
-	router.HandlerFunc(
-		http.MethodPut,
-		"/v1/users/activated",
-		app.activateUserHandler)
-
-	router.HandlerFunc(
-		http.MethodPut,
-		"/v1/users/password",
-		app.updateUserPasswordHandler)
-
-	router.HandlerFunc(
-		http.MethodPost,
-		"/v1/tokens/authentication",
-		app.createAuthenticationTokenHandler)
-
-	router.HandlerFunc(
-		http.MethodPost,
-		"/v1/tokens/activation",
-		app.createActivationTokenHandler)
-
-	router.HandlerFunc(
-		http.MethodPost,
-		"/v1/tokens/password-reset",
-		app.createPwdResetTokenHandler)
+	app.graphqlSchema = app.newGraphQLSchema()
+	table := app.routeTable()
+	handlers := make([]route, len(table))
+	for i, rt := range table {
+		h := rt.handler
+		if rt.idempotent {
+			maxBody := rt.maxBody
+			if maxBody == 0 {
+				maxBody = jsonMaxBytes
+			}
+			h = app.idempotent(maxBody, h)
+		}
+		if rt.permission != "" {
+			h = app.requirePermission(rt.permission, h)
+		}
+		handlers[i] = route{method: rt.method, path: rt.path, handler: h}
+	}
+	handleRoutes(router, handlers)
+	app.openapi = app.mustBuildOpenAPI(table)
+	return router
+}
 
-	if app.config.metrics {
-		router.Handler(
-			http.MethodGet,
-			"/debug/vars",
-			expvar.Handler())
+// handleRoutes registers the handler of each route on router.
+// httprouter v1.3.0 panics on a static segment next to a wildcard, as
+// /v1/movies/export is to /v1/movies/:id, so such a segment is
+// registered as the wildcard and a handler in front of the routes
+// sharing the path picks one by the segments' values, statics first
+// the way httprouter would. Each route's handler gets the parameters
+// named by its own path.
+func handleRoutes(router *httprouter.Router, routes []route) {
+	// segs[i] is the path routes[i] is registered on, split
+	segs := make([][]string, len(routes))
+	for i, rt := range routes {
+		segs[i] = strings.Split(rt.path, "/")
+	}
+	for depth := 0; ; depth++ {
+		// the wildcard, if any, of the routes sharing a method and the
+		// segments up to depth
+		wildcards := make(map[string]string)
+		deeper := false
+		for i, rt := range routes {
+			if depth >= len(segs[i]) {
+				continue
+			}
+			deeper = true
+			prefix := rt.method + " " + strings.Join(segs[i][:depth], "/")
+			if isWildcard(segs[i][depth]) {
+				if _, ok := wildcards[prefix]; !ok {
+					wildcards[prefix] = segs[i][depth]
+				}
+			}
+		}
+		if !deeper {
+			break
+		}
+		for i, rt := range routes {
+			if depth >= len(segs[i]) {
+				continue
+			}
+			if w, ok := wildcards[rt.method+" "+strings.Join(segs[i][:depth], "/")]; ok {
+				segs[i][depth] = w
+			}
+		}
+	}
+
+	shared := make(map[string][]int)
+	var keys []string
+	for i, rt := range routes {
+		key := rt.method + " " + strings.Join(segs[i], "/")
+		if _, ok := shared[key]; !ok {
+			keys = append(keys, key)
+		}
+		shared[key] = append(shared[key], i)
+	}
+	for _, key := range keys {
+		idx := shared[key]
+		rt := routes[idx[0]]
+		registered := strings.Join(segs[idx[0]], "/")
+		if len(idx) == 1 && registered == rt.path {
+			router.HandlerFunc(rt.method, rt.path, rt.handler)
+			continue
+		}
+		candidates := make([]pathRoute, len(idx))
+		for j, i := range idx {
+			candidates[j] = pathRoute{segs: strings.Split(routes[i].path, "/"), handler: routes[i].handler}
+		}
+		sort.SliceStable(candidates, func(a, b int) bool {
+			return candidates[a].before(candidates[b])
+		})
+		router.HandlerFunc(rt.method, registered, dispatchPath(router, candidates))
+	}
+}
+
+func isWildcard(seg string) bool {
+	return strings.HasPrefix(seg, ":") || strings.HasPrefix(seg, "*")
+}
+
+// pathRoute is a route served through dispatchPath, by the segments of
+// its own path.
+type pathRoute struct {
+	segs    []string
+	handler http.HandlerFunc
+}
+
+// before orders routes by their first differing segment, a static one
+// coming first.
+func (p pathRoute) before(q pathRoute) bool {
+	for i := range p.segs {
+		if pw, qw := isWildcard(p.segs[i]), isWildcard(q.segs[i]); pw != qw {
+			return qw
+		}
 	}
+	return false
+}
+
+// dispatchPath serves a request to the first of routes whose static
+// segments match the request's path. Failing that it answers as router
+// does a path it has no route for.
+func dispatchPath(router *httprouter.Router, routes []pathRoute) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		segs := strings.Split(r.URL.Path, "/")
+	next:
+		for _, rt := range routes {
+			if len(segs) != len(rt.segs) {
+				continue
+			}
+			var params httprouter.Params
+			for i, seg := range rt.segs {
+				switch {
+				case isWildcard(seg):
+					params = append(params, httprouter.Param{Key: seg[1:], Value: segs[i]})
+				case seg != segs[i]:
+					continue next
+				}
+			}
+			ctx := context.WithValue(r.Context(), httprouter.ParamsKey, params)
+			rt.handler(w, r.WithContext(ctx))
+			return
+		}
+		var allow []string
+		for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+			if method == r.Method {
+				continue
+			}
+			if h, _, _ := router.Lookup(method, r.URL.Path); h != nil {
+				allow = append(allow, method)
+			}
+		}
+		switch {
+		case len(allow) > 0 && router.HandleMethodNotAllowed:
+			w.Header().Set("Allow", strings.Join(allow, ", "))
+			if router.MethodNotAllowed == nil {
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+			router.MethodNotAllowed.ServeHTTP(w, r)
+		case router.NotFound == nil:
+			http.NotFound(w, r)
+		default:
+			router.NotFound.ServeHTTP(w, r)
+		}
+	}
+}
+
+func (app *application) routes() http.Handler {
+	router := app.router()
 	auMiddle := app.authenticate(router)
 	rlMiddle := app.rateLimit(auMiddle)
 	corsMiddle := app.enabledCORS(rlMiddle)
 	recoverMiddle := app.recoverPanic(corsMiddle)
-	return app.metrics(recoverMiddle)
+	idMiddle := app.requestID(recoverMiddle)
+	app.handler = idMiddle
+	return app.metrics(idMiddle)
 }
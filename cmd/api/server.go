@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,6 +13,29 @@ import (
 	"time"
 )
 
+// serverWriteTimeout bounds how long a response may take, long lived
+// streams end before it and let the client reconnect.
+const serverWriteTimeout = 30 * time.Second
+
+// connContext keeps c in the context of its requests. The server sets
+// the write deadline on the connection before each request, so a
+// handler holding it can move the deadline on.
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey, c)
+}
+
+// extendWriteDeadline gives the response to r another serverWriteTimeout
+// from now, for a download that's still making progress. It reports
+// whether it could, which needs the connection serve put in the
+// request's context.
+func extendWriteDeadline(r *http.Request) bool {
+	c, ok := r.Context().Value(connContextKey).(net.Conn)
+	if !ok {
+		return false
+	}
+	return c.SetWriteDeadline(time.Now().Add(serverWriteTimeout)) == nil
+}
+
 func (app *application) serve() error {
 	srv := &http.Server{
 		Addr:     fmt.Sprintf(":%d", app.config.port),
@@ -20,7 +44,13 @@ func (app *application) serve() error {
 	}
 	srv.IdleTimeout = time.Minute
 	srv.ReadTimeout = 10 * time.Second
-	srv.WriteTimeout = 30 * time.Second
+	srv.WriteTimeout = serverWriteTimeout
+	srv.ConnContext = connContext
+
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	app.startJobs(bgCtx)
+	app.startCron(bgCtx)
+	app.startMovieEvents(bgCtx)
 
 	shutdownErr := make(chan error)
 	bgSignal := func() {
@@ -38,7 +68,8 @@ func (app *application) serve() error {
 			shutdownErr <- err
 		}
 		app.logger.PrintInfo("completing background tasks", nil)
-		app.wg.Wait()
+		stopBackground()
+		app.drainJobs(app.config.jobs.drainTimeout)
 		shutdownErr <- nil
 	}
 	go bgSignal()
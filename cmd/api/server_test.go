@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExtendWriteDeadline(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		extend := r.URL.Query().Get("extend") != ""
+		for i := 0; i < 3; i++ {
+			time.Sleep(timeout)
+			if extend && !extendWriteDeadline(r) {
+				t.Error("couldn't extend the write deadline")
+			}
+			w.Write([]byte("chunk\n"))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	srv.Config.WriteTimeout = timeout
+	srv.Config.ConnContext = connContext
+	srv.Start()
+	defer srv.Close()
+
+	for _, extend := range []bool{false, true} {
+		url := srv.URL
+		if extend {
+			url += "?extend=1"
+		}
+		res, err := http.Get(url)
+		var body []byte
+		if err == nil {
+			body, err = ioutil.ReadAll(res.Body)
+			res.Body.Close()
+		}
+		complete := err == nil && string(body) == "chunk\nchunk\nchunk\n"
+		if complete != extend {
+			t.Errorf("extend=%t: got body %q, err %v", extend, body, err)
+		}
+	}
+}
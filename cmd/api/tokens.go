@@ -3,17 +3,20 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/datewu/xyz/internal/data"
 	"github.com/datewu/xyz/internal/validator"
 )
 
+type createAuthTokenInput struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
-	}
+	var input createAuthTokenInput
 	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
@@ -25,11 +28,11 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	data.ValidatePasswordPlaintext(v, input.Password)
 
 	if !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.modelsFor(r).Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -48,7 +51,24 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
-	t, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	if user.Password.NeedsRehash() {
+		app.rehashPassword(user, input.Password)
+	}
+	var t *data.Token
+	err = app.inTx(r, func(r *http.Request) error {
+		var err error
+		t, err = app.modelsFor(r).Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+		if err != nil {
+			return err
+		}
+		return app.audit(r, auditEvent{
+			Action:       "token.create",
+			ResourceType: "token",
+			ResourceID:   strconv.FormatInt(user.ID, 10),
+			ActorID:      user.ID,
+			After:        tokenAudit(t),
+		})
+	})
 	if err != nil {
 		app.serverErrResponse(w, r, err)
 		return
@@ -59,10 +79,12 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 }
 
+type emailInput struct {
+	Email string `json:"email"`
+}
+
 func (app *application) createPwdResetTokenHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		Email string `json:"email"`
-	}
+	var input emailInput
 	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
@@ -73,16 +95,16 @@ func (app *application) createPwdResetTokenHandler(w http.ResponseWriter, r *htt
 	data.ValidateEmail(v, input.Email)
 
 	if !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.modelsFor(r).Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			v.AddErr("email", "no matching email address found")
-			app.failedValidationResponse(w, r, v.Errors)
+			app.failedValidationResponse(w, r, v)
 		default:
 			app.serverErrResponse(w, r, err)
 		}
@@ -90,21 +112,34 @@ func (app *application) createPwdResetTokenHandler(w http.ResponseWriter, r *htt
 	}
 	if !user.Activated {
 		v.AddErr("email", "user account must be actived")
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
-	t, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePwdReset)
+	err = app.inTx(r, func(r *http.Request) error {
+		models := app.modelsFor(r)
+		t, err := models.Tokens.New(user.ID, 45*time.Minute, data.ScopePwdReset)
+		if err != nil {
+			return err
+		}
+		err = app.sendEmail(models, user.Email, user.Locale, "token_password_reset.tmpl", map[string]interface{}{
+			"passwordResetToken": t.Plaintext,
+			"tokenExpiry":        t.Expiry,
+		})
+		if err != nil {
+			return err
+		}
+		return app.audit(r, auditEvent{
+			Action:       "token.create",
+			ResourceType: "token",
+			ResourceID:   strconv.FormatInt(user.ID, 10),
+			ActorID:      user.ID,
+			After:        tokenAudit(t),
+		})
+	})
 	if err != nil {
 		app.serverErrResponse(w, r, err)
 		return
 	}
-	app.background(func() {
-		data := map[string]interface{}{"passwordResetToken": t.Plaintext}
-		err = app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
-		if err != nil {
-			app.logger.PrintErr(err, nil)
-		}
-	})
 	container := envelope{"message": "an email will be sent to you containing password rest instructions"}
 	err = app.writeJSON(w, http.StatusAccepted, container, nil)
 	if err != nil {
@@ -113,9 +148,7 @@ func (app *application) createPwdResetTokenHandler(w http.ResponseWriter, r *htt
 }
 
 func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		Email string `json:"email"`
-	}
+	var input emailInput
 	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
@@ -126,16 +159,16 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 	data.ValidateEmail(v, input.Email)
 
 	if !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.modelsFor(r).Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			v.AddErr("email", "no matching email address found")
-			app.failedValidationResponse(w, r, v.Errors)
+			app.failedValidationResponse(w, r, v)
 		default:
 			app.serverErrResponse(w, r, err)
 		}
@@ -143,24 +176,62 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 	}
 	if user.Activated {
 		v.AddErr("email", "user has already been activated")
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
-	t, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
-	if err != nil {
+	_, err = app.modelsFor(r).Invitations.GetPendingForUser(user.ID)
+	switch {
+	case err == nil:
+		v.AddErr("email", "user must accept their invitation instead")
+		app.failedValidationResponse(w, r, v)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
 		app.serverErrResponse(w, r, err)
 		return
 	}
-	app.background(func() {
-		data := map[string]interface{}{"activationToken": t.Plaintext}
-		err = app.mailer.Send(user.Email, "token_activation.tmpl", data)
+	err = app.inTx(r, func(r *http.Request) error {
+		models := app.modelsFor(r)
+		t, err := models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			return err
+		}
+		err = app.sendEmail(models, user.Email, user.Locale, "token_activation.tmpl", map[string]interface{}{
+			"activationToken": t.Plaintext,
+			"tokenExpiry":     t.Expiry,
+		})
 		if err != nil {
-			app.logger.PrintErr(err, nil)
+			return err
 		}
+		return app.audit(r, auditEvent{
+			Action:       "token.create",
+			ResourceType: "token",
+			ResourceID:   strconv.FormatInt(user.ID, 10),
+			ActorID:      user.ID,
+			After:        tokenAudit(t),
+		})
 	})
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+		return
+	}
 	container := envelope{"message": "an email will be sent to you containing activation instructions"}
 	err = app.writeJSON(w, http.StatusAccepted, container, nil)
 	if err != nil {
 		app.serverErrResponse(w, r, err)
 	}
 }
+
+// rehashPassword upgrades the stored hash of a user who just logged
+// in successfully, failures are logged but never block the login.
+func (app *application) rehashPassword(user *data.User, plain string) {
+	err := user.Password.Set(plain)
+	if err == nil {
+		err = app.models.Users.Update(user)
+	}
+	if err != nil {
+		app.logger.PrintErr(err, map[string]string{
+			"action":  "rehash password",
+			"user_id": strconv.FormatInt(user.ID, 10),
+		})
+	}
+}
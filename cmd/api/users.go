@@ -3,28 +3,37 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/datewu/xyz/internal/data"
 	"github.com/datewu/xyz/internal/validator"
 )
 
+type registerUserInput struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Locale   string `json:"locale"`
+}
+
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		Name     string `json:"name"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
-	}
+	var input registerUserInput
 	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
 	}
+	if input.Locale == "" {
+		input.Locale = app.readLocale(r)
+	}
 
 	user := &data.User{
 		Name:      input.Name,
 		Email:     input.Email,
 		Activated: false,
+		Locale:    strings.ToLower(input.Locale),
 	}
 	err = user.Password.Set(input.Password)
 	if err != nil {
@@ -32,54 +41,75 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 	v := validator.New()
-	if data.ValidateUser(v, user); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+	data.ValidateUser(v, user)
+	data.ValidatePasswordPolicy(v, input.Password, user.Name, user.Email)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
-	err = app.models.Users.Insert(user)
+	err = app.inTx(r, func(r *http.Request) error {
+		models := app.modelsFor(r)
+		err := models.Users.Insert(user)
+		if err != nil {
+			return err
+		}
+		err = app.audit(r, auditEvent{
+			Action:       "user.create",
+			ResourceType: "user",
+			ResourceID:   strconv.FormatInt(user.ID, 10),
+			ActorID:      user.ID,
+			After:        user,
+		})
+		if err != nil {
+			return err
+		}
+		err = models.Permissions.AddForUser(user.ID, "movies:read")
+		if err != nil {
+			return err
+		}
+		err = app.audit(r, auditEvent{
+			Action:       "permissions.grant",
+			ResourceType: "user",
+			ResourceID:   strconv.FormatInt(user.ID, 10),
+			ActorID:      user.ID,
+			After:        []string{"movies:read"},
+		})
+		if err != nil {
+			return err
+		}
+		token, err := models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			return err
+		}
+		return app.sendEmail(models, user.Email, user.Locale, "user_welcome.tmpl", map[string]interface{}{
+			"activationToken": token.Plaintext,
+			"tokenExpiry":     token.Expiry,
+			"userID":          user.ID,
+		})
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
-			v.AddErr("email", "a user with this emal address already exists")
-			app.failedValidationResponse(w, r, v.Errors)
+			v.AddErrCode("email", validator.CodeAlreadyExists, "a user with this emal address already exists")
+			app.failedValidationResponse(w, r, v)
 		default:
 			app.serverErrResponse(w, r, err)
 		}
 		return
 	}
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
-	if err != nil {
-		app.serverErrResponse(w, r, err)
-		return
-	}
-
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
-	if err != nil {
-		app.serverErrResponse(w, r, err)
-		return
-	}
-	sendMail := func() {
-		data := map[string]interface{}{
-			"activationToken": token.Plaintext,
-			"userID":          user.ID,
-		}
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
-		if err != nil {
-			app.logger.PrintErr(err, nil)
-		}
-	}
-	app.background(sendMail)
 	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrResponse(w, r, err)
 	}
 }
 
+type activateUserInput struct {
+	TokenPlaintext string `json:"token"`
+}
+
 func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		TokenPlaintext string `json:"token"`
-	}
+	var input activateUserInput
 	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
@@ -87,22 +117,45 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 	v := validator.New()
 	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
-	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	user, err := app.modelsFor(r).Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			v.AddErr("token", "invalid or expired activation token")
-			app.failedValidationResponse(w, r, v.Errors)
+			app.failedValidationResponse(w, r, v)
 		default:
 			app.serverErrResponse(w, r, err)
 		}
 		return
 	}
+	before := *user
 	user.Activated = true
-	err = app.models.Users.Update(user)
+	err = app.inTx(r, func(r *http.Request) error {
+		models := app.modelsFor(r)
+		err := models.Users.Update(user)
+		if err != nil {
+			return err
+		}
+		err = models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			return err
+		}
+		err = app.audit(r, auditEvent{
+			Action:       "user.activate",
+			ResourceType: "user",
+			ResourceID:   strconv.FormatInt(user.ID, 10),
+			ActorID:      user.ID,
+			Before:       before,
+			After:        user,
+		})
+		if err != nil {
+			return err
+		}
+		return app.publish(r, eventUserActivated, user)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -112,22 +165,19 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		}
 		return
 	}
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
-	if err != nil {
-		app.serverErrResponse(w, r, err)
-		return
-	}
 	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrResponse(w, r, err)
 	}
 }
 
+type updatePasswordInput struct {
+	Password       string `json:"password"`
+	TokenPlaintext string `json:"token"`
+}
+
 func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		Password       string `json:"password"`
-		TokenPlaintext string `json:"token"`
-	}
+	var input updatePasswordInput
 	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
@@ -137,26 +187,46 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 	data.ValidatePasswordPlaintext(v, input.Password)
 	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
 	if !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
-	user, err := app.models.Users.GetForToken(data.ScopePwdReset, input.TokenPlaintext)
+	user, err := app.modelsFor(r).Users.GetForToken(data.ScopePwdReset, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			v.AddErr("token", "invalid or expired password reset token")
-			app.failedValidationResponse(w, r, v.Errors)
+			app.failedValidationResponse(w, r, v)
 		default:
 			app.serverErrResponse(w, r, err)
 		}
 		return
 	}
+	if data.ValidatePasswordPolicy(v, input.Password, user.Name, user.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
 	err = user.Password.Set(input.Password)
 	if err != nil {
 		app.serverErrResponse(w, r, err)
 		return
 	}
-	err = app.models.Users.Update(user)
+	err = app.inTx(r, func(r *http.Request) error {
+		models := app.modelsFor(r)
+		err := models.Users.Update(user)
+		if err != nil {
+			return err
+		}
+		err = models.Tokens.DeleteAllForUser(data.ScopePwdReset, user.ID)
+		if err != nil {
+			return err
+		}
+		return app.audit(r, auditEvent{
+			Action:       "user.password_reset",
+			ResourceType: "user",
+			ResourceID:   strconv.FormatInt(user.ID, 10),
+			ActorID:      user.ID,
+		})
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -166,11 +236,6 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 		}
 		return
 	}
-	err = app.models.Tokens.DeleteAllForUser(data.ScopePwdReset, user.ID)
-	if err != nil {
-		app.serverErrResponse(w, r, err)
-		return
-	}
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "your password was successfully reset"}, nil)
 	if err != nil {
 		app.serverErrResponse(w, r, err)
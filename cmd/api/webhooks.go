@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/datewu/xyz/internal/data"
+	"github.com/datewu/xyz/internal/validator"
+	"github.com/datewu/xyz/internal/webhook"
+)
+
+const (
+	eventMovieCreated  = data.MovieCreated
+	eventMovieUpdated  = data.MovieUpdated
+	eventMovieDeleted  = data.MovieDeleted
+	eventUserActivated = "user.activated"
+	// eventPing is only sent by the ping endpoint, to the one webhook
+	eventPing = "webhook.ping"
+
+	// jobDeliverWebhook posts one event to one webhook.
+	jobDeliverWebhook = "webhook.deliver"
+)
+
+// webhookEvents lists the events webhooks can subscribe to.
+var webhookEvents = []string{eventMovieCreated, eventMovieUpdated, eventMovieDeleted, eventUserActivated}
+
+type deliverWebhookPayload struct {
+	WebhookID int64         `json:"webhook_id"`
+	Event     webhook.Event `json:"event"`
+}
+
+// publish queues event, with payload as its data, for every webhook
+// subscribed to it. Like app.audit it's called in the transaction of
+// the change it describes, the deliveries are queued if and only if
+// that commits.
+func (app *application) publish(r *http.Request, event string, payload interface{}) error {
+	err := app.enqueueEvent(app.modelsFor(r), event, payload)
+	if err != nil {
+		return fmt.Errorf("publish %s: %w", event, err)
+	}
+	return nil
+}
+
+// enqueueEvent queues a delivery job per subscribed webhook and
+// payload through models, inside the caller's transaction if any.
+func (app *application) enqueueEvent(models data.Models, event string, payloads ...interface{}) error {
+	whs, err := models.Webhooks.GetAllForEvent(event)
+	if err != nil || len(whs) == 0 {
+		return err
+	}
+	for _, payload := range payloads {
+		ev, err := newEvent(event, payload)
+		if err != nil {
+			return err
+		}
+		for _, wh := range whs {
+			err = app.enqueueDelivery(models, wh.ID, ev)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func newEvent(event string, payload interface{}) (webhook.Event, error) {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return webhook.Event{}, err
+	}
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return webhook.Event{}, err
+	}
+	return webhook.Event{
+		ID:        hex.EncodeToString(b),
+		Type:      event,
+		CreatedAt: time.Now().UTC(),
+		Data:      js,
+	}, nil
+}
+
+func (app *application) enqueueDelivery(models data.Models, webhookID int64, ev webhook.Event) error {
+	job := &data.Job{
+		Kind:        jobDeliverWebhook,
+		UniqueKey:   fmt.Sprintf("webhook:%d:%s", webhookID, ev.ID),
+		MaxAttempts: app.config.webhooks.maxAttempts,
+	}
+	return app.enqueueJob(models, job, deliverWebhookPayload{WebhookID: webhookID, Event: ev})
+}
+
+// deliverWebhookJob posts the event and records the attempt. A failed
+// attempt fails the job, so the queue retries it with backoff. Events
+// for webhooks deleted or deactivated since are dropped.
+func (app *application) deliverWebhookJob(ctx context.Context, job *data.Job) error {
+	var payload deliverWebhookPayload
+	err := decodePayload(job, &payload)
+	if err != nil {
+		return err
+	}
+	wh, err := app.models.Webhooks.Get(payload.WebhookID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if !wh.Active && payload.Event.Type != eventPing {
+		return nil
+	}
+	res, deliverErr := webhook.Deliver(ctx, app.webhookClient, wh.URL, wh.Secret, payload.Event)
+	d := &data.WebhookDelivery{
+		WebhookID: wh.ID,
+		EventID:   payload.Event.ID,
+		Event:     payload.Event.Type,
+		Attempt:   job.Attempts,
+	}
+	if res != nil {
+		d.StatusCode = res.StatusCode
+		d.DurationMS = res.Duration.Milliseconds()
+		d.Response = res.Response
+	}
+	if deliverErr != nil {
+		d.Error = deliverErr.Error()
+	}
+	err = app.models.Webhooks.InsertDelivery(d)
+	if err != nil {
+		app.logger.PrintErr(err, map[string]string{"webhook_id": strconv.FormatInt(wh.ID, 10)})
+	}
+	return deliverErr
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type createWebhookInput struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// Secret is generated when left out
+	Secret string `json:"secret,omitempty"`
+	Active *bool  `json:"active,omitempty"`
+}
+
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input createWebhookInput
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	wh := &data.Webhook{
+		CreatedBy: app.contextGetUser(r).ID,
+		URL:       input.URL,
+		Secret:    input.Secret,
+		Events:    input.Events,
+		Active:    true,
+	}
+	if input.Active != nil {
+		wh.Active = *input.Active
+	}
+	if wh.Secret == "" {
+		wh.Secret, err = newWebhookSecret()
+		if err != nil {
+			app.serverErrResponse(w, r, err)
+			return
+		}
+	}
+	v := validator.New()
+	if data.ValidateWebhook(v, wh, webhookEvents...); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	err = app.inTx(r, func(r *http.Request) error {
+		err := app.modelsFor(r).Webhooks.Insert(wh)
+		if err != nil {
+			return err
+		}
+		return app.audit(r, auditEvent{
+			Action:       "webhook.create",
+			ResourceType: "webhook",
+			ResourceID:   strconv.FormatInt(wh.ID, 10),
+			After:        wh,
+		})
+	})
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+		return
+	}
+	hs := make(http.Header)
+	hs.Set("Location", fmt.Sprintf("/v1/admin/webhooks/%d", wh.ID))
+	err = app.writeJSON(w, http.StatusCreated, envelope{"webhook": wh, "secret": wh.Secret}, hs)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Sort = app.readString(qs, "sort", "id")
+	input.SortSafelist = []string{"id", "url", "-id", "-url"}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	whs, metadata, err := app.modelsFor(r).Webhooks.GetAll(input.Filters)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhooks": whs, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+// readWebhook loads the webhook named by the :id parameter, answering
+// the request itself when it can't.
+func (app *application) readWebhook(w http.ResponseWriter, r *http.Request) (*data.Webhook, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFountResponse(w, r)
+		return nil, false
+	}
+	wh, err := app.modelsFor(r).Webhooks.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFountResponse(w, r)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return wh, true
+}
+
+func (app *application) showWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	wh, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+	err := app.writeJSON(w, http.StatusOK, envelope{"webhook": wh}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+type updateWebhookInput struct {
+	URL    *string  `json:"url"`
+	Events []string `json:"events"`
+	// Secret replaces the signing secret, "" generates a new one
+	Secret *string `json:"secret"`
+	Active *bool   `json:"active"`
+}
+
+func (app *application) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	wh, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+	var input updateWebhookInput
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	before := *wh
+	if input.URL != nil {
+		wh.URL = *input.URL
+	}
+	if input.Events != nil {
+		wh.Events = input.Events
+	}
+	if input.Active != nil {
+		wh.Active = *input.Active
+	}
+	if input.Secret != nil {
+		wh.Secret = *input.Secret
+		if wh.Secret == "" {
+			wh.Secret, err = newWebhookSecret()
+			if err != nil {
+				app.serverErrResponse(w, r, err)
+				return
+			}
+		}
+	}
+	v := validator.New()
+	if data.ValidateWebhook(v, wh, webhookEvents...); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	err = app.inTx(r, func(r *http.Request) error {
+		err := app.modelsFor(r).Webhooks.Update(wh)
+		if err != nil {
+			return err
+		}
+		return app.audit(r, auditEvent{
+			Action:       "webhook.update",
+			ResourceType: "webhook",
+			ResourceID:   strconv.FormatInt(wh.ID, 10),
+			Before:       before,
+			After:        wh,
+		})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+	env := envelope{"webhook": wh}
+	if input.Secret != nil {
+		env["secret"] = wh.Secret
+	}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	wh, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+	err := app.inTx(r, func(r *http.Request) error {
+		err := app.modelsFor(r).Webhooks.Delete(wh.ID)
+		if err != nil {
+			return err
+		}
+		return app.audit(r, auditEvent{
+			Action:       "webhook.delete",
+			ResourceType: "webhook",
+			ResourceID:   strconv.FormatInt(wh.ID, 10),
+			Before:       wh,
+		})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFountResponse(w, r)
+		default:
+			app.serverErrResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	wh, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Sort = "-id"
+	input.SortSafelist = []string{"-id"}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	ds, metadata, err := app.modelsFor(r).Webhooks.GetDeliveries(wh.ID, input.Filters)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"deliveries": ds, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
+
+// pingWebhookHandler queues a webhook.ping event for the webhook alone,
+// whatever it subscribes to, to check the receiver end to end.
+func (app *application) pingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	wh, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+	ev, err := newEvent(eventPing, envelope{"webhook_id": wh.ID})
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+		return
+	}
+	err = app.enqueueDelivery(app.modelsFor(r), wh.ID, ev)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"event": ev}, nil)
+	if err != nil {
+		app.serverErrResponse(w, r, err)
+	}
+}
@@ -0,0 +1,91 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-a * * * *",
+		"@sometimes",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded", expr)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	// a Wednesday
+	from := time.Date(2021, time.June, 16, 9, 30, 20, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2021, time.June, 16, 9, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2021, time.June, 16, 9, 45, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2021, time.June, 16, 9, 45, 0, 0, time.UTC)},
+		{"0,10 * * * *", time.Date(2021, time.June, 16, 10, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2021, time.June, 16, 10, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2021, time.June, 17, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2021, time.June, 20, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2021, time.July, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 3 * * 1-5", time.Date(2021, time.June, 17, 3, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2021, time.June, 20, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// both day fields restricted: either one matches
+		{"0 0 1 * 5", time.Date(2021, time.June, 18, 0, 0, 0, 0, time.UTC)},
+		// a stepped * isn't a restriction, so both must match:
+		// the first odd day that's a Monday, or the first that's
+		// an even weekday
+		{"0 0 */2 * 1", time.Date(2021, time.June, 21, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * */2", time.Date(2021, time.July, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.expr)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: Next = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestNextKeepsLocation(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*60*60)
+	s, err := Parse("0 3 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := s.Next(time.Date(2021, time.June, 16, 9, 0, 0, 0, loc))
+	want := time.Date(2021, time.June, 17, 3, 0, 0, 0, loc)
+	if !got.Equal(want) || got.Location() != loc {
+		t.Errorf("Next = %v, want %v", got, want)
+	}
+}
+
+func TestString(t *testing.T) {
+	s, err := Parse("@daily")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.String() != "@daily" {
+		t.Errorf("String = %q", s.String())
+	}
+}
@@ -0,0 +1,225 @@
+package cron
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/datewu/xyz/internal/jsonlog"
+)
+
+// leaderLockKey is the pg_advisory_lock key the replicas compete for.
+const leaderLockKey int64 = 0x6772_6e6c_6372_6f6e
+
+// Task is a named unit of maintenance work. Run reports how many
+// rows it touched.
+type Task struct {
+	Name     string
+	Schedule *Schedule
+	Timeout  time.Duration
+	Run      func(ctx context.Context) (int64, error)
+}
+
+// TaskStats is what the scheduler remembers about a task's runs.
+type TaskStats struct {
+	Schedule     string     `json:"schedule"`
+	Runs         int64      `json:"runs"`
+	Failures     int64      `json:"failures"`
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	LastDuration string     `json:"last_duration,omitempty"`
+	LastRows     int64      `json:"last_rows"`
+	LastError    string     `json:"last_error,omitempty"`
+	NextRun      time.Time  `json:"next_run"`
+}
+
+// Scheduler runs tasks when they're due, but only on the replica
+// holding the leader advisory lock. The lock is tied to one pooled
+// connection, so a crashed leader's lock is freed with its session.
+type Scheduler struct {
+	db     *sql.DB
+	logger *jsonlog.Logger
+	tasks  []Task
+
+	conn *sql.Conn
+
+	mu     sync.Mutex
+	leader bool
+	stats  map[string]*TaskStats
+}
+
+// New a Scheduler for tasks.
+func New(db *sql.DB, logger *jsonlog.Logger, tasks []Task) *Scheduler {
+	s := &Scheduler{
+		db:     db,
+		logger: logger,
+		tasks:  tasks,
+		stats:  make(map[string]*TaskStats, len(tasks)),
+	}
+	for _, t := range tasks {
+		s.stats[t.Name] = &TaskStats{Schedule: t.Schedule.String()}
+	}
+	return s
+}
+
+// Run blocks until ctx is done, then gives up the leader lock.
+func (s *Scheduler) Run(ctx context.Context) {
+	defer s.resign()
+	now := time.Now()
+	next := make([]time.Time, len(s.tasks))
+	for i, t := range s.tasks {
+		next[i] = t.Schedule.Next(now)
+		s.setNext(t.Name, next[i])
+	}
+	for {
+		wake := time.Time{}
+		for _, n := range next {
+			if !n.IsZero() && (wake.IsZero() || n.Before(wake)) {
+				wake = n
+			}
+		}
+		if wake.IsZero() {
+			<-ctx.Done()
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(wake)):
+		}
+
+		leader := s.elect(ctx)
+		now := time.Now()
+		for i, t := range s.tasks {
+			if next[i].IsZero() || next[i].After(now) {
+				continue
+			}
+			if leader && ctx.Err() == nil {
+				s.runTask(ctx, t)
+			}
+			next[i] = t.Schedule.Next(time.Now())
+			s.setNext(t.Name, next[i])
+		}
+	}
+}
+
+// elect keeps or tries to take the leader lock, reporting whether
+// this replica is the leader.
+func (s *Scheduler) elect(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	if s.conn != nil {
+		if err := s.conn.PingContext(ctx); err == nil {
+			return true
+		}
+		s.conn.Close()
+		s.conn = nil
+		s.setLeader(false)
+	}
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		s.logger.PrintErr(err, map[string]string{"cron": "leader election"})
+		return false
+	}
+	var locked bool
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", leaderLockKey).Scan(&locked)
+	if err != nil || !locked {
+		if err != nil {
+			s.logger.PrintErr(err, map[string]string{"cron": "leader election"})
+		}
+		conn.Close()
+		return false
+	}
+	s.conn = conn
+	s.setLeader(true)
+	s.logger.PrintInfo("cron leader elected", nil)
+	return true
+}
+
+func (s *Scheduler) resign() {
+	if s.conn == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := s.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", leaderLockKey)
+	if err != nil {
+		s.logger.PrintErr(err, map[string]string{"cron": "resign"})
+	}
+	s.conn.Close()
+	s.conn = nil
+	s.setLeader(false)
+}
+
+func (s *Scheduler) runTask(ctx context.Context, t Task) {
+	timeout := t.Timeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	rows, err := func() (rows int64, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = errors.New("panic while running task")
+			}
+		}()
+		return t.Run(ctx)
+	}()
+	elapsed := time.Since(start)
+
+	s.mu.Lock()
+	st := s.stats[t.Name]
+	st.Runs++
+	st.LastRun = &start
+	st.LastDuration = elapsed.String()
+	st.LastRows = rows
+	st.LastError = ""
+	if err != nil {
+		st.Failures++
+		st.LastError = err.Error()
+	}
+	s.mu.Unlock()
+
+	props := map[string]string{
+		"task":     t.Name,
+		"duration": elapsed.String(),
+		"rows":     strconv.FormatInt(rows, 10),
+	}
+	if err != nil {
+		s.logger.PrintErr(err, props)
+		return
+	}
+	s.logger.PrintInfo("cron task completed", props)
+}
+
+func (s *Scheduler) setNext(name string, next time.Time) {
+	s.mu.Lock()
+	s.stats[name].NextRun = next
+	s.mu.Unlock()
+}
+
+func (s *Scheduler) setLeader(leader bool) {
+	s.mu.Lock()
+	s.leader = leader
+	s.mu.Unlock()
+}
+
+// Metrics is a snapshot of the leadership and task stats, meant to
+// be published with expvar.Func.
+func (s *Scheduler) Metrics() interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tasks := make(map[string]TaskStats, len(s.stats))
+	for name, st := range s.stats {
+		tasks[name] = *st
+	}
+	return map[string]interface{}{
+		"leader": s.leader,
+		"tasks":  tasks,
+	}
+}
@@ -0,0 +1,308 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// auditLock is the advisory lock serialising appends to the log, so
+// every entry links onto the one before it. Appends run in the
+// transaction of the write they record, the lock is held until that
+// commits, so audited writes commit one at a time.
+const auditLock = 0x61756469
+
+// AuditHash is a SHA-256 chain link, hex encoded in JSON.
+type AuditHash []byte
+
+func (h AuditHash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(h))
+}
+
+// AuditEntry records one write: who made it, from where, and the
+// resource before and after. Entries chain per resource, PrevHash is
+// the Hash of the resource's previous entry, and Hash covers every
+// field and PrevHash, so editing a row breaks the resource's chain
+// from there on. ChainHash links Hash onto the ChainHash of the entry
+// before it in the whole log, so removing a resource's newest entries,
+// or all of them, breaks the global chain at the next entry. Entries
+// from before the global chain have none.
+type AuditEntry struct {
+	ID           int64           `json:"id"`
+	CreatedAt    time.Time       `json:"created_at"`
+	ActorID      *int64          `json:"actor_id"`
+	ClientIP     string          `json:"client_ip"`
+	RequestID    string          `json:"request_id"`
+	Action       string          `json:"action"`
+	ResourceType string          `json:"resource_type"`
+	ResourceID   string          `json:"resource_id"`
+	Before       json.RawMessage `json:"before,omitempty"`
+	After        json.RawMessage `json:"after,omitempty"`
+	PrevHash     AuditHash       `json:"prev_hash"`
+	Hash         AuditHash       `json:"hash"`
+	ChainHash    AuditHash       `json:"chain_hash"`
+}
+
+// AuditFilter narrows an audit listing, zero fields match anything.
+type AuditFilter struct {
+	ActorID      int64
+	ResourceType string
+	ResourceID   string
+	Since        time.Time
+	Until        time.Time
+}
+
+// AuditVerification is the outcome of walking the hash chain.
+type AuditVerification struct {
+	Checked  int64  `json:"checked"`
+	Valid    bool   `json:"valid"`
+	BrokenAt *int64 `json:"broken_at,omitempty"`
+}
+
+// AuditModel wraps a sql.DB connection pool
+type AuditModel struct {
+	DB Handle
+}
+
+func (e *AuditEntry) computeHash() []byte {
+	actor := ""
+	if e.ActorID != nil {
+		actor = strconv.FormatInt(*e.ActorID, 10)
+	}
+	h := sha256.New()
+	h.Write(e.PrevHash)
+	for _, f := range []string{
+		e.CreatedAt.UTC().Format(time.RFC3339Nano), actor, e.ClientIP, e.RequestID,
+		e.Action, e.ResourceType, e.ResourceID, string(e.Before), string(e.After),
+	} {
+		fmt.Fprintf(h, "%d:%s", len(f), f)
+	}
+	return h.Sum(nil)
+}
+
+// computeChainHash links the entry's Hash onto prev, the ChainHash of
+// the entry before it in the log.
+func (e *AuditEntry) computeChainHash(prev []byte) []byte {
+	h := sha256.New()
+	h.Write(prev)
+	h.Write(e.Hash)
+	return h.Sum(nil)
+}
+
+func marshalAuditState(v interface{}) (json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+// Append marshals before and after, either may be nil, into entry and
+// adds it to the end of its resource's chain and of the log. It's meant to run in the
+// transaction of the write it records, so neither is kept without the
+// other.
+func (m AuditModel) Append(entry *AuditEntry, before, after interface{}) error {
+	var err error
+	if entry.Before, err = marshalAuditState(before); err != nil {
+		return err
+	}
+	if entry.After, err = marshalAuditState(after); err != nil {
+		return err
+	}
+	// timestamptz keeps microseconds, the hash must match what's read back
+	entry.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := beginTx(ctx, m.DB, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", auditLock)
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRowContext(ctx, `
+        SELECT hash FROM audit_log
+		WHERE resource_type = $1 AND resource_id = $2
+		ORDER BY id DESC LIMIT 1`, entry.ResourceType, entry.ResourceID).Scan(&entry.PrevHash)
+	if err == sql.ErrNoRows {
+		entry.PrevHash = make([]byte, sha256.Size)
+	} else if err != nil {
+		return err
+	}
+	entry.Hash = entry.computeHash()
+	var prevChain []byte
+	err = tx.QueryRowContext(ctx, `
+        SELECT chain_hash FROM audit_log
+		ORDER BY id DESC LIMIT 1`).Scan(&prevChain)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if prevChain == nil {
+		prevChain = make([]byte, sha256.Size)
+	}
+	entry.ChainHash = entry.computeChainHash(prevChain)
+
+	query := `
+        INSERT INTO audit_log (created_at, actor_id, client_ip, request_id, action,
+		resource_type, resource_id, before, after, prev_hash, hash, chain_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING id`
+	args := []interface{}{
+		entry.CreatedAt, entry.ActorID, entry.ClientIP, entry.RequestID, entry.Action,
+		entry.ResourceType, entry.ResourceID, nullJSON(entry.Before), nullJSON(entry.After),
+		[]byte(entry.PrevHash), []byte(entry.Hash), []byte(entry.ChainHash),
+	}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&entry.ID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func nullJSON(js json.RawMessage) interface{} {
+	if js == nil {
+		return nil
+	}
+	return string(js)
+}
+
+const auditColumns = `id, created_at, actor_id, client_ip, request_id, action,
+		resource_type, resource_id, before, after, prev_hash, hash, chain_hash`
+
+func scanAuditEntry(row interface{ Scan(...interface{}) error }, extra ...interface{}) (*AuditEntry, error) {
+	var (
+		e             AuditEntry
+		before, after []byte
+	)
+	dest := append(extra,
+		&e.ID, &e.CreatedAt, &e.ActorID, &e.ClientIP, &e.RequestID, &e.Action,
+		&e.ResourceType, &e.ResourceID, &before, &after, (*[]byte)(&e.PrevHash), (*[]byte)(&e.Hash),
+		(*[]byte)(&e.ChainHash))
+	err := row.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+	if before != nil {
+		e.Before = before
+	}
+	if after != nil {
+		e.After = after
+	}
+	return &e, nil
+}
+
+func (m AuditModel) GetAll(f AuditFilter, filter Filters) ([]*AuditEntry, Metadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), `+auditColumns+`
+		FROM audit_log
+		WHERE (actor_id = $1 OR $1 = 0)
+		AND (resource_type = $2 OR $2 = '')
+		AND (resource_id = $3 OR $3 = '')
+		AND ($4::timestamptz IS NULL OR created_at >= $4)
+		AND ($5::timestamptz IS NULL OR created_at < $5)
+		ORDER BY %s %s, id ASC
+		LIMIT $6 OFFSET $7`, filter.sortColumn(), filter.sortDirection())
+	args := []interface{}{
+		f.ActorID, f.ResourceType, f.ResourceID,
+		sql.NullTime{Time: f.Since, Valid: !f.Since.IsZero()},
+		sql.NullTime{Time: f.Until, Valid: !f.Until.IsZero()},
+		filter.limit(), filter.offset(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		e, err := scanAuditEntry(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		entries = append(entries, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return entries, calculateMetadata(totalRecords, filter.Page, filter.PageSize), nil
+}
+
+// auditVerifier checks entries, in the order of the log, against the
+// ones before them.
+type auditVerifier struct {
+	resources map[[2]string][]byte
+	chain     []byte
+}
+
+func newAuditVerifier() *auditVerifier {
+	return &auditVerifier{resources: make(map[[2]string][]byte)}
+}
+
+// check reports whether e links onto its resource's previous entry and,
+// once the global chain has started, onto the previous entry of the
+// log, and whether its hashes are its own.
+func (v *auditVerifier) check(e *AuditEntry) bool {
+	res := [2]string{e.ResourceType, e.ResourceID}
+	prev, ok := v.resources[res]
+	if !ok {
+		prev = make([]byte, sha256.Size)
+	}
+	if !bytes.Equal(e.PrevHash, prev) || !bytes.Equal(e.Hash, e.computeHash()) {
+		return false
+	}
+	v.resources[res] = e.Hash
+	if e.ChainHash == nil {
+		// an entry from before the global chain can't follow one in it
+		return v.chain == nil
+	}
+	prevChain := v.chain
+	if prevChain == nil {
+		prevChain = make([]byte, sha256.Size)
+	}
+	if !bytes.Equal(e.ChainHash, e.computeChainHash(prevChain)) {
+		return false
+	}
+	v.chain = e.ChainHash
+	return true
+}
+
+// Verify walks the log in order and reports the first entry whose
+// hash, link to its resource's previous entry, or link to the log's
+// previous entry doesn't check out. Entries removed from the end of the
+// log leave no entry behind to notice.
+func (m AuditModel) Verify(ctx context.Context) (*AuditVerification, error) {
+	rows, err := m.DB.QueryContext(ctx, `SELECT `+auditColumns+` FROM audit_log ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := &AuditVerification{Valid: true}
+	v := newAuditVerifier()
+	for rows.Next() {
+		e, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		result.Checked++
+		if !v.check(e) {
+			result.Valid = false
+			result.BrokenAt = &e.ID
+			return result, nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,131 @@
+package data
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAuditEntryHashCoversEveryField(t *testing.T) {
+	actor := int64(7)
+	base := func() *AuditEntry {
+		return &AuditEntry{
+			CreatedAt:    time.Date(2021, 3, 4, 5, 6, 7, 8000, time.UTC),
+			ActorID:      &actor,
+			ClientIP:     "192.0.2.1",
+			RequestID:    "req-1",
+			Action:       "movie.update",
+			ResourceType: "movie",
+			ResourceID:   "42",
+			Before:       json.RawMessage(`{"title":"a"}`),
+			After:        json.RawMessage(`{"title":"b"}`),
+			PrevHash:     make([]byte, sha256.Size),
+		}
+	}
+	want := base().computeHash()
+	other := int64(8)
+	edits := map[string]func(e *AuditEntry){
+		"created_at":    func(e *AuditEntry) { e.CreatedAt = e.CreatedAt.Add(time.Microsecond) },
+		"actor_id":      func(e *AuditEntry) { e.ActorID = &other },
+		"no actor":      func(e *AuditEntry) { e.ActorID = nil },
+		"client_ip":     func(e *AuditEntry) { e.ClientIP = "192.0.2.2" },
+		"request_id":    func(e *AuditEntry) { e.RequestID = "req-2" },
+		"action":        func(e *AuditEntry) { e.Action = "movie.delete" },
+		"resource_type": func(e *AuditEntry) { e.ResourceType = "user" },
+		"resource_id":   func(e *AuditEntry) { e.ResourceID = "43" },
+		"before":        func(e *AuditEntry) { e.Before = nil },
+		"after":         func(e *AuditEntry) { e.After = json.RawMessage(`{"title":"c"}`) },
+		"prev_hash":     func(e *AuditEntry) { e.PrevHash = want },
+		// fields are length prefixed, moving a byte between them shows
+		"boundary": func(e *AuditEntry) { e.ResourceType, e.ResourceID = "movie4", "2" },
+	}
+	for name, edit := range edits {
+		e := base()
+		edit(e)
+		if bytes.Equal(e.computeHash(), want) {
+			t.Errorf("changing %s keeps the hash", name)
+		}
+	}
+	if !bytes.Equal(base().computeHash(), want) {
+		t.Error("hash isn't deterministic")
+	}
+}
+
+// auditLog chains entries for the given resources the way Append does.
+func auditLog(resources ...string) []*AuditEntry {
+	heads := make(map[string][]byte)
+	chain := make([]byte, sha256.Size)
+	var log []*AuditEntry
+	for i, id := range resources {
+		e := &AuditEntry{
+			ID:           int64(i + 1),
+			CreatedAt:    time.Date(2021, 3, 4, 5, 6, i, 0, time.UTC),
+			Action:       "movie.update",
+			ResourceType: "movie",
+			ResourceID:   id,
+			PrevHash:     heads[id],
+		}
+		if e.PrevHash == nil {
+			e.PrevHash = make([]byte, sha256.Size)
+		}
+		e.Hash = e.computeHash()
+		e.ChainHash = e.computeChainHash(chain)
+		heads[id], chain = e.Hash, e.ChainHash
+		log = append(log, e)
+	}
+	return log
+}
+
+// verifyAuditLog returns the ID of the first entry that doesn't check
+// out, 0 if they all do.
+func verifyAuditLog(log []*AuditEntry) int64 {
+	v := newAuditVerifier()
+	for _, e := range log {
+		if !v.check(e) {
+			return e.ID
+		}
+	}
+	return 0
+}
+
+func TestAuditVerifierDetectsRemovals(t *testing.T) {
+	// entries 1 to 6 for movies 1, 2, 1, 3, 2, 1
+	full := auditLog("1", "2", "1", "3", "2", "1")
+	without := func(ids ...int64) []*AuditEntry {
+		var log []*AuditEntry
+	next:
+		for _, e := range full {
+			for _, id := range ids {
+				if e.ID == id {
+					continue next
+				}
+			}
+			log = append(log, e)
+		}
+		return log
+	}
+	legacy := auditLog("1", "2", "1")
+	for _, e := range legacy {
+		e.ChainHash = nil
+	}
+	tests := []struct {
+		name   string
+		log    []*AuditEntry
+		broken int64
+	}{
+		{"intact", full, 0},
+		{"a middle entry", without(3), 4},
+		{"movie 2's newest entry", without(5), 6},
+		{"all of movie 3", without(4), 5},
+		{"the first entry", without(1), 2},
+		{"entries from before the global chain", append(legacy, auditLog("4")[0]), 0},
+		{"an entry without a chain hash after one with", append(auditLog("1"), legacy[1]), 2},
+	}
+	for _, tt := range tests {
+		if got := verifyAuditLog(tt.log); got != tt.broken {
+			t.Errorf("%s: broken at %d, want %d", tt.name, got, tt.broken)
+		}
+	}
+}
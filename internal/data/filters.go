@@ -40,10 +40,10 @@ func (f Filters) offset() int {
 
 func ValidateFilters(v *validator.Validator, f Filters) {
 	// Check that the page and page_size parameters contain sensible values.
-	v.Check(f.Page > 0, "page", "must be greater than zero")
-	v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
-	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
-	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
+	v.CheckCode(f.Page > 0, "page", validator.CodeTooSmall, "must be greater than zero")
+	v.CheckCode(f.Page <= 10_000_000, "page", validator.CodeTooLarge, "must be a maximum of 10 million")
+	v.CheckCode(f.PageSize > 0, "page_size", validator.CodeTooSmall, "must be greater than zero")
+	v.CheckCode(f.PageSize <= 100, "page_size", validator.CodeTooLarge, "must be a maximum of 100")
 
 	// Check that the sort parameter matches a value in the safelist.
 	v.Check(validator.In(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
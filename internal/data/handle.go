@@ -0,0 +1,93 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Handle is what models run their queries on: the connection pool, or
+// a transaction shared by several requests, see Models.WithTx.
+type Handle interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Tx is a transaction opened by beginTx, *sql.Tx or a savepoint.
+type Tx interface {
+	Handle
+	Commit() error
+	Rollback() error
+}
+
+// beginTx opens a transaction on h. Inside a shared transaction that's
+// a savepoint, so a model method still commits or rolls back its own
+// writes as a unit, while the outer transaction decides for all.
+func beginTx(ctx context.Context, h Handle, opts *sql.TxOptions) (Tx, error) {
+	switch h := h.(type) {
+	case *sharedTx:
+		return h.savepoint(ctx)
+	case interface {
+		BeginTx(context.Context, *sql.TxOptions) (*sql.Tx, error)
+	}:
+		tx, err := h.BeginTx(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		return tx, nil
+	}
+	return nil, fmt.Errorf("data: can't begin a transaction on %T", h)
+}
+
+// sharedTx is a transaction models run on as if it were the pool.
+type sharedTx struct {
+	*sql.Tx
+	savepoints int
+}
+
+func (t *sharedTx) savepoint(ctx context.Context) (Tx, error) {
+	t.savepoints++
+	sp := &savepoint{tx: t.Tx, name: fmt.Sprintf("sp_%d", t.savepoints)}
+	_, err := t.ExecContext(ctx, "SAVEPOINT "+sp.name)
+	if err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+type savepoint struct {
+	tx   *sql.Tx
+	name string
+	done bool
+}
+
+func (s *savepoint) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return s.tx.ExecContext(ctx, query, args...)
+}
+
+func (s *savepoint) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return s.tx.QueryContext(ctx, query, args...)
+}
+
+func (s *savepoint) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return s.tx.QueryRowContext(ctx, query, args...)
+}
+
+func (s *savepoint) Commit() error {
+	if s.done {
+		return sql.ErrTxDone
+	}
+	s.done = true
+	_, err := s.tx.Exec("RELEASE SAVEPOINT " + s.name)
+	return err
+}
+
+func (s *savepoint) Rollback() error {
+	if s.done {
+		return sql.ErrTxDone
+	}
+	s.done = true
+	_, err := s.tx.Exec("ROLLBACK TO SAVEPOINT " + s.name)
+	return err
+}
@@ -0,0 +1,198 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrIdempotencyKeyReused is a key sent again for another endpoint.
+	ErrIdempotencyKeyReused = errors.New("idempotency key used for another request")
+	// ErrIdempotencyMismatch is a key sent again with another body.
+	ErrIdempotencyMismatch = errors.New("idempotency key used with another request body")
+	// ErrIdempotencyInProgress is a key sent again while its first
+	// request is still running.
+	ErrIdempotencyInProgress = errors.New("idempotency key in use by a running request")
+)
+
+// StoredResponse is the response recorded for an idempotency key.
+type StoredResponse struct {
+	Status int
+	Header map[string][]string
+	Body   []byte
+}
+
+// IdempotentRequest is a request holding its idempotency key. Until it
+// is completed, aborted or its lease runs out, other requests with the
+// key get ErrIdempotencyInProgress. Response is set when the key was
+// already used, it is to be replayed rather than the request run, once
+// Fingerprint is checked against the retry's.
+type IdempotentRequest struct {
+	m           IdempotencyModel
+	userID      int64
+	client      string
+	key         string
+	lockedUntil time.Time
+	Fingerprint []byte
+	Response    *StoredResponse
+}
+
+// IdempotencyModel wraps a sql.DB connection pool
+type IdempotencyModel struct {
+	DB Handle
+}
+
+// Begin claims key for the user's request, for at most lease. No
+// transaction or connection is held while the request runs, the row's
+// lease marks it as taken and guards Complete and Abort against an
+// attempt that outlived it. A key past ttl is free to use again. client
+// further scopes the key, for anonymous requests sharing a userID of 0,
+// and is empty otherwise.
+func (m IdempotencyModel) Begin(ctx context.Context, userID int64, client, key, method, path string, ttl, lease time.Duration) (*IdempotentRequest, error) {
+	tx, err := beginTx(ctx, m.DB, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	req, err := m.claim(ctx, tx, userID, client, key, method, path, ttl, lease)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (m IdempotencyModel) claim(ctx context.Context, tx Tx, userID int64, client, key, method, path string, ttl, lease time.Duration) (*IdempotentRequest, error) {
+	_, err := tx.ExecContext(ctx, `
+	    DELETE FROM idempotency_keys
+		WHERE user_id = $1 AND client = $2 AND key = $3 AND expires_at < NOW()`, userID, client, key)
+	if err != nil {
+		return nil, err
+	}
+	req := &IdempotentRequest{m: m, userID: userID, client: client, key: key}
+	err = tx.QueryRowContext(ctx, `
+	    INSERT INTO idempotency_keys (user_id, client, key, expires_at, method, path, locked_until)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW() + $7 * interval '1 millisecond')
+		ON CONFLICT (user_id, client, key) DO NOTHING
+		RETURNING locked_until`,
+		userID, client, key, time.Now().Add(ttl), method, path, lease.Milliseconds()).
+		Scan(&req.lockedUntil)
+	switch {
+	case err == nil:
+		return req, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, err
+	}
+
+	var (
+		gotMethod, gotPath string
+		status             sql.NullInt64
+		header, body       []byte
+		lockedUntil        sql.NullTime
+	)
+	err = tx.QueryRowContext(ctx, `
+	    SELECT method, path, fingerprint, status, header, body, locked_until
+		FROM idempotency_keys
+		WHERE user_id = $1 AND client = $2 AND key = $3
+		FOR UPDATE`, userID, client, key).
+		Scan(&gotMethod, &gotPath, &req.Fingerprint, &status, &header, &body, &lockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	if gotMethod != method || gotPath != path {
+		return nil, ErrIdempotencyKeyReused
+	}
+	if status.Valid {
+		req.Response = &StoredResponse{Status: int(status.Int64), Body: body}
+		err = json.Unmarshal(header, &req.Response.Header)
+		if err != nil {
+			return nil, err
+		}
+		return req, nil
+	}
+	if lockedUntil.Valid && lockedUntil.Time.After(time.Now()) {
+		return nil, ErrIdempotencyInProgress
+	}
+	// the attempt holding the key crashed or hung past its lease
+	err = tx.QueryRowContext(ctx, `
+	    UPDATE idempotency_keys
+		SET locked_until = NOW() + $4 * interval '1 millisecond'
+		WHERE user_id = $1 AND client = $2 AND key = $3
+		RETURNING locked_until`, userID, client, key, lease.Milliseconds()).
+		Scan(&req.lockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	req.Fingerprint = nil
+	return req, nil
+}
+
+// Matches reports whether fingerprint is the one of the request that
+// stored the response.
+func (r *IdempotentRequest) Matches(fingerprint []byte) bool {
+	return bytes.Equal(r.Fingerprint, fingerprint)
+}
+
+// Complete stores res, the response to a request whose body hashed to
+// fingerprint, for the key and releases it.
+func (r *IdempotentRequest) Complete(ctx context.Context, fingerprint []byte, res *StoredResponse) error {
+	header, err := json.Marshal(res.Header)
+	if err != nil {
+		return err
+	}
+	result, err := r.m.DB.ExecContext(ctx, `
+	    UPDATE idempotency_keys
+		SET status = $1, header = $2, body = $3, fingerprint = $4, locked_until = NULL
+		WHERE user_id = $5 AND client = $6 AND key = $7 AND status IS NULL AND locked_until = $8`,
+		res.Status, header, res.Body, fingerprint, r.userID, r.client, r.key, r.lockedUntil)
+	if err != nil {
+		return err
+	}
+	return r.checkLease(result)
+}
+
+// Abort releases the key without storing a response, so the request
+// may be retried.
+func (r *IdempotentRequest) Abort(ctx context.Context) error {
+	result, err := r.m.DB.ExecContext(ctx, `
+	    DELETE FROM idempotency_keys
+		WHERE user_id = $1 AND client = $2 AND key = $3 AND status IS NULL AND locked_until = $4`,
+		r.userID, r.client, r.key, r.lockedUntil)
+	if err != nil {
+		return err
+	}
+	return r.checkLease(result)
+}
+
+// checkLease fails with ErrEditConflict when the lease ran out and
+// another attempt took the key over.
+func (r *IdempotentRequest) checkLease(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrEditConflict
+	}
+	return nil
+}
+
+// DeleteExpired removes every key past its window and reports how many
+// were deleted.
+func (m IdempotencyModel) DeleteExpired(ctx context.Context) (int64, error) {
+	query := `
+	    DELETE FROM idempotency_keys
+		WHERE expires_at < NOW()`
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
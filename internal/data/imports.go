@@ -0,0 +1,212 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	ImportPending = "pending"
+	ImportRunning = "running"
+	ImportDone    = "done"
+	ImportFailed  = "failed"
+)
+
+// importBatchSize is how many movies go into one INSERT statement.
+const importBatchSize = 500
+
+// ImportRowError lists what's wrong with one line of an import, for
+// CSV Line is the record number with the header as line 1.
+type ImportRowError struct {
+	Line   int               `json:"line"`
+	Errors map[string]string `json:"errors"`
+}
+
+// ImportReport is the outcome of an import, or of its dry run.
+type ImportReport struct {
+	DryRun   bool             `json:"dry_run"`
+	Rows     int              `json:"rows"`
+	Valid    int              `json:"valid"`
+	Inserted int              `json:"inserted"`
+	Errors   []ImportRowError `json:"errors"`
+}
+
+// MovieImport is an uploaded import waiting for, or done by, the
+// import job. Payload is the raw upload and never serialised.
+type MovieImport struct {
+	ID         int64         `json:"id"`
+	CreatedAt  time.Time     `json:"created_at"`
+	UserID     int64         `json:"user_id"`
+	Format     string        `json:"format"`
+	DryRun     bool          `json:"dry_run"`
+	Status     string        `json:"status"`
+	Payload    []byte        `json:"-"`
+	Report     *ImportReport `json:"report,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+}
+
+// InsertBatch inserts movies, each with its first revision credited
+// to userID, in batches inside one transaction: either every movie is
+// stored or none is. It returns the stored movies, with their ids.
+func (m MovieModel) InsertBatch(ctx context.Context, movies []*Movie, userID int64) ([]*Movie, error) {
+	tx, err := beginTx(ctx, m.DB, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	inserted := make([]*Movie, 0, len(movies))
+	for start := 0; start < len(movies); start += importBatchSize {
+		end := start + importBatchSize
+		if end > len(movies) {
+			end = len(movies)
+		}
+		batch := movies[start:end]
+		values := make([]string, len(batch))
+		args := []interface{}{sql.NullInt64{Int64: userID, Valid: userID > 0}}
+		for i, movie := range batch {
+			n := len(args)
+			values[i] = fmt.Sprintf("($%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4)
+			args = append(args, movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres))
+		}
+		query := `
+        WITH inserted AS (
+			INSERT INTO movies (title, year, runtime, genres)
+			VALUES ` + strings.Join(values, ", ") + `
+			RETURNING id, created_at, title, year, runtime, genres, version),
+		revisions AS (
+			INSERT INTO movie_revisions (movie_id, version, user_id, action, title, year, runtime, genres)
+			SELECT id, version, $1, '` + RevisionCreate + `', title, year, runtime, genres
+			FROM inserted),
+		events AS (
+			INSERT INTO movie_events (type, movie_id, version, title, year, runtime, genres)
+			SELECT '` + MovieCreated + `', id, version, title, year, runtime, genres
+			FROM inserted)
+		SELECT id, created_at, title, year, runtime, genres, version
+		FROM inserted`
+		err := func() error {
+			rows, err := tx.QueryContext(ctx, query, args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var movie Movie
+				err = rows.Scan(&movie.ID, &movie.CreatedAt, &movie.Title, &movie.Year,
+					&movie.Runtime, pq.Array(&movie.Genres), &movie.Version)
+				if err != nil {
+					return err
+				}
+				inserted = append(inserted, &movie)
+			}
+			return rows.Err()
+		}()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// one notification wakes listeners for the whole import
+	if len(inserted) > 0 {
+		_, err = tx.ExecContext(ctx, `SELECT pg_notify('`+MovieEventsChannel+`', '')`)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return inserted, nil
+}
+
+// MovieImportModel wraps a sql.DB connection pool
+type MovieImportModel struct {
+	DB Handle
+}
+
+func (m MovieImportModel) Insert(imp *MovieImport) error {
+	query := `
+        INSERT INTO movie_imports (user_id, format, dry_run, payload)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, status`
+	args := []interface{}{imp.UserID, imp.Format, imp.DryRun, imp.Payload}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&imp.ID, &imp.CreatedAt, &imp.Status)
+}
+
+// Get returns the import, with its payload only when withPayload is set.
+func (m MovieImportModel) Get(id int64, withPayload bool) (*MovieImport, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+        SELECT id, created_at, COALESCE(user_id, 0), format, dry_run, status,
+		CASE WHEN $2 THEN payload END, report, error, finished_at
+		FROM movie_imports
+		WHERE id = $1`
+	var (
+		imp    MovieImport
+		report []byte
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id, withPayload).Scan(
+		&imp.ID, &imp.CreatedAt, &imp.UserID, &imp.Format, &imp.DryRun, &imp.Status,
+		&imp.Payload, &report, &imp.Error, &imp.FinishedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	if report != nil {
+		imp.Report = &ImportReport{}
+		err = json.Unmarshal(report, imp.Report)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &imp, nil
+}
+
+func (m MovieImportModel) SetStatus(id int64, status string) error {
+	query := `
+        UPDATE movie_imports
+		SET status = $1
+		WHERE id = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, status, id)
+	return err
+}
+
+// Finish stores the outcome of an import. The payload is dropped
+// then, it's no longer needed and may be large.
+func (m MovieImportModel) Finish(imp *MovieImport) error {
+	var report interface{}
+	if imp.Report != nil {
+		js, err := json.Marshal(imp.Report)
+		if err != nil {
+			return err
+		}
+		report = js
+	}
+	query := `
+        UPDATE movie_imports
+		SET status = $1, report = $2, error = $3, finished_at = NOW(), payload = ''
+		WHERE id = $4
+		RETURNING finished_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, imp.Status, report, imp.Error, imp.ID).Scan(&imp.FinishedAt)
+}
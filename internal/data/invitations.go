@@ -0,0 +1,232 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	InvitationPending  = "pending"
+	InvitationAccepted = "accepted"
+	InvitationRevoked  = "revoked"
+	InvitationExpired  = "expired"
+)
+
+// Invitation records an admin created account waiting
+// for its invitee to set a name and password.
+type Invitation struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Email       string      `json:"email"`
+	UserID      int64       `json:"user_id,omitempty"`
+	InvitedBy   int64       `json:"invited_by,omitempty"`
+	Permissions Permissions `json:"permissions"`
+	Expiry      time.Time   `json:"expiry"`
+	AcceptedAt  *time.Time  `json:"accepted_at,omitempty"`
+	RevokedAt   *time.Time  `json:"revoked_at,omitempty"`
+	Status      string      `json:"status"`
+}
+
+func (i *Invitation) setStatus() {
+	switch {
+	case i.AcceptedAt != nil:
+		i.Status = InvitationAccepted
+	case i.RevokedAt != nil:
+		i.Status = InvitationRevoked
+	case time.Now().After(i.Expiry):
+		i.Status = InvitationExpired
+	default:
+		i.Status = InvitationPending
+	}
+}
+
+// InvitationModel wraps a sql.DB connection pool
+type InvitationModel struct {
+	DB Handle
+}
+
+const invitationColumns = `id, created_at, email, user_id, invited_by,
+		permissions, expiry, accepted_at, revoked_at`
+
+func scanInvitation(row interface{ Scan(...interface{}) error }, extra ...interface{}) (*Invitation, error) {
+	var (
+		inv       Invitation
+		userID    sql.NullInt64
+		invitedBy sql.NullInt64
+	)
+	dest := append(extra,
+		&inv.ID, &inv.CreatedAt, &inv.Email, &userID, &invitedBy,
+		pq.Array(&inv.Permissions), &inv.Expiry, &inv.AcceptedAt, &inv.RevokedAt)
+	err := row.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+	inv.UserID = userID.Int64
+	inv.InvitedBy = invitedBy.Int64
+	inv.setStatus()
+	return &inv, nil
+}
+
+func (m InvitationModel) Insert(inv *Invitation) error {
+	query := `
+        INSERT INTO invitations (email, user_id, invited_by, permissions, expiry)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+	args := []interface{}{
+		inv.Email, inv.UserID, inv.InvitedBy,
+		pq.Array(inv.Permissions), inv.Expiry,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&inv.ID, &inv.CreatedAt)
+	if err != nil {
+		return err
+	}
+	inv.setStatus()
+	return nil
+}
+
+func (m InvitationModel) Get(id int64) (*Invitation, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+        SELECT ` + invitationColumns + `
+		FROM invitations
+		WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	inv, err := scanInvitation(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return inv, nil
+}
+
+// GetPendingForUser returns the open invitation of a pending user.
+func (m InvitationModel) GetPendingForUser(userID int64) (*Invitation, error) {
+	query := `
+        SELECT ` + invitationColumns + `
+		FROM invitations
+		WHERE user_id = $1
+		AND accepted_at IS NULL AND revoked_at IS NULL
+		ORDER BY id DESC
+		LIMIT 1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	inv, err := scanInvitation(m.DB.QueryRowContext(ctx, query, userID))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return inv, nil
+}
+
+func (m InvitationModel) GetAll(status string, filter Filters) ([]*Invitation, Metadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), `+invitationColumns+`
+		FROM invitations
+		WHERE ($1 = ''
+		OR ($1 = 'accepted' AND accepted_at IS NOT NULL)
+		OR ($1 = 'revoked' AND revoked_at IS NOT NULL)
+		OR ($1 = 'expired' AND accepted_at IS NULL AND revoked_at IS NULL AND expiry <= NOW())
+		OR ($1 = 'pending' AND accepted_at IS NULL AND revoked_at IS NULL AND expiry > NOW()))
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3`, filter.sortColumn(), filter.sortDirection())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, status, filter.limit(), filter.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	invs := []*Invitation{}
+	for rows.Next() {
+		inv, err := scanInvitation(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		invs = append(invs, inv)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return invs, calculateMetadata(totalRecords, filter.Page, filter.PageSize), nil
+}
+
+func (m InvitationModel) Accept(inv *Invitation) error {
+	query := `
+        UPDATE invitations
+		SET accepted_at = NOW()
+		WHERE id = $1 AND accepted_at IS NULL AND revoked_at IS NULL
+		RETURNING accepted_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, inv.ID).Scan(&inv.AcceptedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	inv.setStatus()
+	return nil
+}
+
+// Revoke marks a pending invitation as revoked and deletes the
+// pending user created for it, which also drops its tokens.
+func (m InvitationModel) Revoke(inv *Invitation) error {
+	query := `
+        UPDATE invitations
+		SET revoked_at = NOW()
+		WHERE id = $1 AND accepted_at IS NULL AND revoked_at IS NULL
+		RETURNING revoked_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := beginTx(ctx, m.DB, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRowContext(ctx, query, inv.ID).Scan(&inv.RevokedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	if inv.UserID != 0 {
+		query = `
+        DELETE FROM users
+		WHERE id = $1 AND activated = false`
+		_, err = tx.ExecContext(ctx, query, inv.UserID)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	inv.setStatus()
+	return nil
+}
@@ -0,0 +1,287 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+var (
+	// ErrDuplicateJob is returned by Enqueue when a pending or running
+	// job already holds the same unique key.
+	ErrDuplicateJob = errors.New("duplicate job")
+)
+
+// Job is a unit of background work. Payload is decoded by the
+// handler registered for Kind.
+type Job struct {
+	ID          int64           `json:"id"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	UniqueKey   string          `json:"unique_key,omitempty"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	LastError   string          `json:"last_error,omitempty"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+
+	// lockedUntil is the lease a claimed job was handed out with
+	lockedUntil time.Time
+}
+
+// JobModel wraps a sql.DB connection pool
+type JobModel struct {
+	DB Handle
+}
+
+const jobColumns = `id, created_at, kind, payload, unique_key, status,
+		attempts, max_attempts, run_at, last_error, finished_at`
+
+func scanJob(row interface{ Scan(...interface{}) error }, extra ...interface{}) (*Job, error) {
+	var (
+		job       Job
+		payload   []byte
+		uniqueKey sql.NullString
+	)
+	dest := append(extra,
+		&job.ID, &job.CreatedAt, &job.Kind, &payload, &uniqueKey, &job.Status,
+		&job.Attempts, &job.MaxAttempts, &job.RunAt, &job.LastError, &job.FinishedAt)
+	err := row.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+	job.Payload = payload
+	job.UniqueKey = uniqueKey.String
+	return &job, nil
+}
+
+// Enqueue stores job. A zero RunAt means now, a zero MaxAttempts
+// means 5. payload is marshalled into job.Payload.
+func (m JobModel) Enqueue(job *Job, payload interface{}) error {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	job.Payload = js
+	if job.RunAt.IsZero() {
+		job.RunAt = time.Now()
+	}
+	if job.MaxAttempts == 0 {
+		job.MaxAttempts = 5
+	}
+	uniqueKey := sql.NullString{String: job.UniqueKey, Valid: job.UniqueKey != ""}
+	query := `
+        INSERT INTO jobs (kind, payload, unique_key, max_attempts, run_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (unique_key) WHERE status IN ('pending', 'running') DO NOTHING
+		RETURNING id, created_at, status`
+	args := []interface{}{job.Kind, js, uniqueKey, job.MaxAttempts, job.RunAt}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err = m.DB.QueryRowContext(ctx, query, args...).
+		Scan(&job.ID, &job.CreatedAt, &job.Status)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrDuplicateJob
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Claim locks the next due job of one of kinds for lease. Running jobs
+// whose lease ran out, because their worker died, are claimed again
+// while they have attempts left, and marked failed once they haven't.
+// It returns ErrRecordNotFound when nothing is due.
+func (m JobModel) Claim(kinds []string, lease time.Duration) (*Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, `
+        UPDATE jobs
+		SET status = 'failed', finished_at = NOW(), locked_until = NULL,
+		last_error = 'lease expired on the last attempt'
+		WHERE kind = ANY($1)
+		AND status = 'running' AND locked_until < NOW()
+		AND attempts >= max_attempts`, pq.Array(kinds))
+	if err != nil {
+		return nil, err
+	}
+	query := `
+        UPDATE jobs
+		SET status = 'running', attempts = attempts + 1,
+		locked_until = NOW() + $2 * interval '1 second'
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE kind = ANY($1)
+			AND ((status = 'pending' AND run_at <= NOW())
+			OR (status = 'running' AND locked_until < NOW() AND attempts < max_attempts))
+			ORDER BY run_at, id
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1)
+		RETURNING locked_until, ` + jobColumns
+	var lockedUntil time.Time
+	job, err := scanJob(m.DB.QueryRowContext(ctx, query, pq.Array(kinds), lease.Seconds()), &lockedUntil)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	job.lockedUntil = lockedUntil
+	return job, nil
+}
+
+// Complete marks a claimed job done. It returns ErrEditConflict when
+// the job's lease ran out and it was claimed again since, the later
+// claim decides its outcome then.
+func (m JobModel) Complete(job *Job) error {
+	query := `
+        UPDATE jobs
+		SET status = 'done', finished_at = NOW(), locked_until = NULL, last_error = ''
+		WHERE id = $1 AND status = 'running' AND attempts = $2 AND locked_until = $3
+		RETURNING status`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, job.ID, job.Attempts, job.lockedUntil).Scan(&job.Status)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Fail records a failed run of a claimed job. The job runs again at
+// retryAt unless it has used up its attempts, in which case it is
+// marked failed. Like Complete it returns ErrEditConflict for a job
+// that was claimed again since.
+func (m JobModel) Fail(job *Job, runErr error, retryAt time.Time) error {
+	query := `
+        UPDATE jobs
+		SET status = CASE WHEN attempts >= max_attempts THEN 'failed' ELSE 'pending' END,
+		finished_at = CASE WHEN attempts >= max_attempts THEN NOW() END,
+		run_at = $1, last_error = $2, locked_until = NULL
+		WHERE id = $3 AND status = 'running' AND attempts = $4 AND locked_until = $5
+		RETURNING status`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, retryAt, runErr.Error(), job.ID, job.Attempts, job.lockedUntil).
+		Scan(&job.Status)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Retry requeues a failed job with a fresh attempt budget.
+func (m JobModel) Retry(job *Job) error {
+	query := `
+        UPDATE jobs
+		SET status = 'pending', attempts = 0, run_at = NOW(), finished_at = NULL
+		WHERE id = $1 AND status = 'failed'
+		RETURNING status, attempts, run_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, job.ID).Scan(&job.Status, &job.Attempts, &job.RunAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m JobModel) Get(id int64) (*Job, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+        SELECT ` + jobColumns + `
+		FROM jobs
+		WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	job, err := scanJob(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return job, nil
+}
+
+func (m JobModel) GetAll(status, kind string, filter Filters) ([]*Job, Metadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), `+jobColumns+`
+		FROM jobs
+		WHERE (status = $1 OR $1 = '')
+		AND (kind = $2 OR $2 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT $3 OFFSET $4`, filter.sortColumn(), filter.sortDirection())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, status, kind, filter.limit(), filter.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	jobs := []*Job{}
+	for rows.Next() {
+		job, err := scanJob(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		jobs = append(jobs, job)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return jobs, calculateMetadata(totalRecords, filter.Page, filter.PageSize), nil
+}
+
+// DeleteFinished removes done and failed jobs that finished more
+// than age ago.
+func (m JobModel) DeleteFinished(ctx context.Context, age time.Duration) (int64, error) {
+	query := `
+        DELETE FROM jobs
+		WHERE status IN ('done', 'failed')
+		AND finished_at < NOW() - $1 * interval '1 second'`
+	result, err := m.DB.ExecContext(ctx, query, age.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
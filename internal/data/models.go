@@ -1,6 +1,7 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 )
@@ -13,17 +14,66 @@ var (
 // Models wraps *Model
 type Models struct {
 	Movies      MovieModel
+	Revisions   MovieRevisionModel
+	Imports     MovieImportModel
 	Users       UserModel
 	Tokens      TokenModel
 	Permissions PermissionModel
+	Invitations InvitationModel
+	Outbox      OutboxModel
+	Jobs        JobModel
+	Audit       AuditModel
+	Idempotency IdempotencyModel
+	Webhooks    WebhookModel
+	MovieEvents MovieEventModel
 }
 
 // NewModels  initialize *Models
 func NewModels(db *sql.DB) Models {
+	return newModels(db)
+}
+
+// WithTx returns models running every query in tx, so what they write
+// commits or rolls back together. Model methods that use a transaction
+// of their own get a savepoint in tx instead.
+func (m Models) WithTx(tx *sql.Tx) Models {
+	return newModels(&sharedTx{Tx: tx})
+}
+
+// Transaction runs fn with models whose writes commit together if fn
+// returns nil, and roll back if it doesn't. Models already in a shared
+// transaction run fn in a savepoint of it.
+func (m Models) Transaction(ctx context.Context, fn func(Models) error) error {
+	tx, err := beginTx(ctx, m.Movies.DB, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	models := m
+	if sqlTx, ok := tx.(*sql.Tx); ok {
+		models = m.WithTx(sqlTx)
+	}
+	err = fn(models)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func newModels(h Handle) Models {
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Movies:      MovieModel{DB: h},
+		Revisions:   MovieRevisionModel{DB: h},
+		Imports:     MovieImportModel{DB: h},
+		Users:       UserModel{DB: h},
+		Tokens:      TokenModel{DB: h},
+		Permissions: PermissionModel{DB: h},
+		Invitations: InvitationModel{DB: h},
+		Outbox:      OutboxModel{DB: h},
+		Jobs:        JobModel{DB: h},
+		Audit:       AuditModel{DB: h},
+		Idempotency: IdempotencyModel{DB: h},
+		Webhooks:    WebhookModel{DB: h},
+		MovieEvents: MovieEventModel{DB: h},
 	}
 }
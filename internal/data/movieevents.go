@@ -0,0 +1,150 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	MovieCreated = "movie.created"
+	MovieUpdated = "movie.updated"
+	MovieDeleted = "movie.deleted"
+
+	// MovieEventsChannel is the channel writers of movie events notify
+	// on, with an empty payload, once they commit.
+	MovieEventsChannel = "movie_events"
+)
+
+// MovieEvent is a change to a movie, as kept in the bounded event log
+// for clients catching up on what they missed. ID is its position in
+// the log, in the order the changes committed.
+type MovieEvent struct {
+	ID        int64
+	CreatedAt time.Time
+	Type      string
+	Movie     *Movie
+}
+
+// movieEventType maps a revision action to the event clients see.
+func movieEventType(action string) string {
+	switch action {
+	case RevisionCreate:
+		return MovieCreated
+	case RevisionDelete:
+		return MovieDeleted
+	}
+	return MovieUpdated
+}
+
+// insertMovieEvent logs the change and notifies listeners of it, which
+// Postgres only does once tx commits. The event has no position in the
+// log until Sequence gives it one after the commit.
+func insertMovieEvent(ctx context.Context, tx Tx, movie *Movie, action string) error {
+	query := `
+        INSERT INTO movie_events (type, movie_id, version, title, year, runtime, genres, deleted_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	args := []interface{}{
+		movieEventType(action), movie.ID, movie.Version,
+		movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.DeletedAt,
+	}
+	_, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `SELECT pg_notify('`+MovieEventsChannel+`', '')`)
+	return err
+}
+
+// movieEventsSequenceLock serialises Sequence, so positions become
+// visible in the order they're given out. Writers of the log don't
+// take it.
+const movieEventsSequenceLock = 0x6d6f7669
+
+// MovieEventModel wraps a sql.DB connection pool
+type MovieEventModel struct {
+	DB Handle
+}
+
+// Sequence gives the committed events without a position the next
+// ones, and reports how many it sequenced. It runs in a transaction of
+// its own, after the writers' have committed, so an event can't turn
+// up behind a position readers have already gone past, which an ID
+// taken at insert would allow.
+func (m MovieEventModel) Sequence(ctx context.Context) (int64, error) {
+	tx, err := beginTx(ctx, m.DB, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, movieEventsSequenceLock)
+	if err != nil {
+		return 0, err
+	}
+	query := `
+        UPDATE movie_events e
+		SET position = s.position
+		FROM (SELECT id, nextval('movie_events_position_seq') AS position
+			FROM (SELECT id FROM movie_events WHERE position IS NULL ORDER BY id) pending) s
+		WHERE e.id = s.id`
+	result, err := tx.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// GetSince returns up to limit events after position afterID, oldest
+// first.
+func (m MovieEventModel) GetSince(ctx context.Context, afterID int64, limit int) ([]*MovieEvent, error) {
+	query := `
+        SELECT position, created_at, type, movie_id, version, title, year, runtime, genres, deleted_at
+		FROM movie_events
+		WHERE position > $1
+		ORDER BY position
+		LIMIT $2`
+	rows, err := m.DB.QueryContext(ctx, query, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []*MovieEvent
+	for rows.Next() {
+		ev := MovieEvent{Movie: &Movie{}}
+		err := rows.Scan(&ev.ID, &ev.CreatedAt, &ev.Type,
+			&ev.Movie.ID, &ev.Movie.Version, &ev.Movie.Title, &ev.Movie.Year,
+			&ev.Movie.Runtime, pq.Array(&ev.Movie.Genres), &ev.Movie.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &ev)
+	}
+	return events, rows.Err()
+}
+
+// Bounds returns the IDs of the oldest and newest events in the log,
+// both 0 when it's empty.
+func (m MovieEventModel) Bounds(ctx context.Context) (first, last int64, err error) {
+	query := `
+        SELECT COALESCE(MIN(position), 0), COALESCE(MAX(position), 0)
+		FROM movie_events`
+	err = m.DB.QueryRowContext(ctx, query).Scan(&first, &last)
+	return first, last, err
+}
+
+// DeleteOlder trims the log of events older than age.
+func (m MovieEventModel) DeleteOlder(ctx context.Context, age time.Duration) (int64, error) {
+	query := `
+        DELETE FROM movie_events
+		WHERE created_at < $1`
+	result, err := m.DB.ExecContext(ctx, query, time.Now().Add(-age))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -1,10 +1,15 @@
 package data
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/datewu/xyz/internal/validator"
@@ -12,38 +17,192 @@ import (
 )
 
 type Movie struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"-"`
-	Title     string    `json:"title"`
-	Year      int32     `json:"year,omitempty"`
-	Runtime   Runtime   `json:"runtime,omitempty"`
-	Genres    []string  `json:"genres,omitempty"`
-	Version   int32     `json:"version"`
+	ID        int64      `json:"id"`
+	CreatedAt time.Time  `json:"-"`
+	Title     string     `json:"title"`
+	Year      int32      `json:"year,omitempty"`
+	Runtime   Runtime    `json:"runtime,omitempty"`
+	Genres    []string   `json:"genres,omitempty"`
+	Version   int32      `json:"version"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	// fields is the sparse fieldset the movie was read with, empty for
+	// every field, embedded holds related resources to encode with it
+	fields   []string
+	embedded map[string]interface{}
+}
+
+// MovieFields are the JSON names ?fields= can pick from, each is also
+// the name of its column.
+var MovieFields = []string{"id", "title", "year", "runtime", "genres", "version", "deleted_at"}
+
+// movieJSON is Movie without its MarshalJSON.
+type movieJSON Movie
+
+// MarshalJSON encodes only the fields the movie was read with, each
+// of them even when zero, followed by the embedded resources.
+func (m Movie) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	if len(m.fields) == 0 {
+		js, err := json.Marshal(movieJSON(m))
+		if err != nil {
+			return nil, err
+		}
+		if len(m.embedded) == 0 {
+			return js, nil
+		}
+		buf.Write(js[:len(js)-1])
+	} else {
+		buf.WriteByte('{')
+		for _, f := range MovieFields {
+			if !contains(m.fields, f) {
+				continue
+			}
+			var v interface{}
+			switch f {
+			case "id":
+				v = m.ID
+			case "title":
+				v = m.Title
+			case "year":
+				v = m.Year
+			case "runtime":
+				v = m.Runtime
+			case "genres":
+				v = m.Genres
+			case "version":
+				v = m.Version
+			case "deleted_at":
+				v = m.DeletedAt
+			}
+			err := writeJSONMember(&buf, f, v)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	names := make([]string, 0, len(m.embedded))
+	for name := range m.embedded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := writeJSONMember(&buf, name, m.embedded[name])
+		if err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// writeJSONMember appends "key":value to an object being written to
+// buf, after a comma unless it's the first member.
+func writeJSONMember(buf *bytes.Buffer, key string, v interface{}) error {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if buf.Len() > 1 {
+		buf.WriteByte(',')
+	}
+	buf.WriteString(strconv.Quote(key))
+	buf.WriteByte(':')
+	buf.Write(js)
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Embed adds a related resource, encoded under name alongside the
+// movie's own fields.
+func (m *Movie) Embed(name string, v interface{}) {
+	if m.embedded == nil {
+		m.embedded = make(map[string]interface{})
+	}
+	m.embedded[name] = v
+}
+
+// ValidateFields checks a sparse fieldset only names fields from safelist.
+func ValidateFields(v *validator.Validator, fields []string, safelist ...string) {
+	for _, f := range fields {
+		v.Check(validator.In(f, safelist...), "fields", fmt.Sprintf("unknown field %q", f))
+	}
+	v.CheckCode(validator.Unique(fields), "fields", validator.CodeDuplicate, "must not contain duplicate values")
+}
+
+// movieColumns lists the columns to read for fields, every one when
+// fields is empty. id is always read, embedding needs it.
+func movieColumns(fields []string) []string {
+	if len(fields) == 0 {
+		return []string{"id", "created_at", "title", "year", "runtime", "genres", "version", "deleted_at"}
+	}
+	cols := []string{"id"}
+	for _, f := range fields {
+		if f != "id" {
+			cols = append(cols, f)
+		}
+	}
+	return cols
+}
+
+// movieDest returns where to scan cols into movie.
+func movieDest(movie *Movie, cols []string) []interface{} {
+	dest := make([]interface{}, len(cols))
+	for i, col := range cols {
+		switch col {
+		case "id":
+			dest[i] = &movie.ID
+		case "created_at":
+			dest[i] = &movie.CreatedAt
+		case "title":
+			dest[i] = &movie.Title
+		case "year":
+			dest[i] = &movie.Year
+		case "runtime":
+			dest[i] = &movie.Runtime
+		case "genres":
+			dest[i] = pq.Array(&movie.Genres)
+		case "version":
+			dest[i] = &movie.Version
+		case "deleted_at":
+			dest[i] = &movie.DeletedAt
+		}
+	}
+	return dest
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
-	v.Check(movie.Title != "", "title", "must be provided")
-	v.Check(len(movie.Title) <= 500, "title", "must not be more than 500 bytes long")
+	v.CheckCode(movie.Title != "", "title", validator.CodeRequired, "must be provided")
+	v.CheckCode(len(movie.Title) <= 500, "title", validator.CodeTooLong, "must not be more than 500 bytes long")
 
-	v.Check(movie.Year != 0, "year", "must be provided")
-	v.Check(movie.Year >= 1888, "year", "must be greater than 1888")
+	v.CheckCode(movie.Year != 0, "year", validator.CodeRequired, "must be provided")
+	v.CheckCode(movie.Year >= 1888, "year", validator.CodeTooSmall, "must be greater than 1888")
 	v.Check(movie.Year <= int32(time.Now().Year()), "year", "must not be in the future")
 
-	v.Check(movie.Runtime != 0, "runtime", "must be provided")
-	v.Check(movie.Runtime > 0, "runtime", "must be a positive integer")
+	v.CheckCode(movie.Runtime != 0, "runtime", validator.CodeRequired, "must be provided")
+	v.CheckCode(movie.Runtime > 0, "runtime", validator.CodeTooSmall, "must be a positive integer")
 
-	v.Check(movie.Genres != nil, "genres", "must be provided")
-	v.Check(len(movie.Genres) >= 1, "genres", "must contain  at least 1 genre")
-	v.Check(len(movie.Genres) <= 5, "genres", "must not contain  more than 5 genres")
-	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
+	v.CheckCode(movie.Genres != nil, "genres", validator.CodeRequired, "must be provided")
+	v.CheckCode(len(movie.Genres) >= 1, "genres", validator.CodeTooShort, "must contain  at least 1 genre")
+	v.CheckCode(len(movie.Genres) <= 5, "genres", validator.CodeTooLong, "must not contain  more than 5 genres")
+	v.CheckCode(validator.Unique(movie.Genres), "genres", validator.CodeDuplicate, "must not contain duplicate values")
 }
 
 // MovieModel wraps a sql.DB coonection pool
 type MovieModel struct {
-	DB *sql.DB
+	DB Handle
 }
 
-func (m MovieModel) Insert(movie *Movie) error {
+// Insert creates the movie and its first revision, credited to userID.
+func (m MovieModel) Insert(movie *Movie, userID int64) error {
 	query := `
         INSERT INTO movies (title, year, runtime, genres)
 		VALUES ($1, $2, $3, $4)
@@ -54,31 +213,54 @@ func (m MovieModel) Insert(movie *Movie) error {
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	return m.DB.QueryRowContext(ctx, query, args...).
+	tx, err := beginTx(ctx, m.DB, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRowContext(ctx, query, args...).
 		Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	if err != nil {
+		return err
+	}
+	err = insertRevision(ctx, tx, movie, userID, RevisionCreate, 0)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
+// Get returns the movie unless it has been soft deleted.
 func (m MovieModel) Get(id int64) (*Movie, error) {
+	return m.get(id, false, nil)
+}
+
+// GetIncludingDeleted returns the movie whether it has been soft
+// deleted or not.
+func (m MovieModel) GetIncludingDeleted(id int64) (*Movie, error) {
+	return m.get(id, true, nil)
+}
+
+// GetFields returns the movie read with only the given fields, all
+// of them when fields is empty.
+func (m MovieModel) GetFields(id int64, includeDeleted bool, fields []string) (*Movie, error) {
+	return m.get(id, includeDeleted, fields)
+}
+
+func (m MovieModel) get(id int64, includeDeleted bool, fields []string) (*Movie, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
+	cols := movieColumns(fields)
 	query := `
-        SELECT id, created_at, title, year, runtime, genres, version
+        SELECT ` + strings.Join(cols, ", ") + `
 		FROM movies
-		WHERE id = $1`
-	var movie Movie
+		WHERE id = $1 AND (deleted_at IS NULL OR $2)`
+	movie := Movie{fields: fields}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
-		&movie.ID,
-		&movie.CreatedAt,
-		&movie.Title,
-		&movie.Year,
-		&movie.Runtime,
-		pq.Array(&movie.Genres),
-		&movie.Version,
-	)
+	err := m.DB.QueryRowContext(ctx, query, id, includeDeleted).Scan(movieDest(&movie, cols)...)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -90,12 +272,28 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	return &movie, nil
 }
 
-func (m MovieModel) Update(movie *Movie) error {
+// Update saves the movie, if it is still at the version it was read,
+// and records the result as a new revision by userID.
+func (m MovieModel) Update(movie *Movie, userID int64) error {
+	return m.update(movie, userID, RevisionUpdate, 0)
+}
+
+// Revert brings the movie's fields back to those of rev, recorded as
+// a new revision rather than by rewriting history.
+func (m MovieModel) Revert(movie *Movie, rev *MovieRevision, userID int64) error {
+	movie.Title = rev.Title
+	movie.Year = rev.Year
+	movie.Runtime = rev.Runtime
+	movie.Genres = rev.Genres
+	return m.update(movie, userID, RevisionRevert, rev.Version)
+}
+
+func (m MovieModel) update(movie *Movie, userID int64, action string, revertedFrom int32) error {
 	query := `
         UPDATE movies
 		SET title = $1, year = $2, runtime = $3,
 		genres = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		WHERE id = $5 AND version = $6 AND deleted_at IS NULL
 		RETURNING version`
 	args := []interface{}{
 		movie.Title,
@@ -107,7 +305,12 @@ func (m MovieModel) Update(movie *Movie) error {
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	err := m.DB.QueryRowContext(ctx, query, args...).
+	tx, err := beginTx(ctx, m.DB, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRowContext(ctx, query, args...).
 		Scan(&movie.Version)
 	if err != nil {
 		switch {
@@ -117,44 +320,122 @@ func (m MovieModel) Update(movie *Movie) error {
 			return err
 		}
 	}
-	return nil
+	err = insertRevision(ctx, tx, movie, userID, action, revertedFrom)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (m MovieModel) Delete(id int64) error {
+// Delete soft deletes the movie, it can be restored until
+// PurgeDeleted removes it for good. It returns the deleted row, with
+// its new version and deleted_at.
+func (m MovieModel) Delete(id int64, userID int64) (*Movie, error) {
 	if id < 1 {
-		return ErrRecordNotFound
+		return nil, ErrRecordNotFound
 	}
 	query := `
-        DELETE FROM movies
-		WHERE id = $1`
+        UPDATE movies
+		SET deleted_at = NOW(), version = version + 1
+		WHERE id = $1 AND deleted_at IS NULL
+		RETURNING id, created_at, title, year, runtime, genres, version, deleted_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := beginTx(ctx, m.DB, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var movie Movie
+	err = tx.QueryRowContext(ctx, query, id).Scan(
+		&movie.ID,
+		&movie.CreatedAt,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+		&movie.Version,
+		&movie.DeletedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	err = insertRevision(ctx, tx, &movie, userID, RevisionDelete, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return &movie, nil
+}
+
+// Restore undeletes a soft deleted movie at the version it was read.
+func (m MovieModel) Restore(movie *Movie, userID int64) error {
+	query := `
+        UPDATE movies
+		SET deleted_at = NULL, version = version + 1
+		WHERE id = $1 AND version = $2 AND deleted_at IS NOT NULL
+		RETURNING version`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	result, err := m.DB.ExecContext(ctx, query, id)
+	tx, err := beginTx(ctx, m.DB, nil)
 	if err != nil {
 		return err
 	}
-	affected, err := result.RowsAffected()
+	defer tx.Rollback()
+	err = tx.QueryRowContext(ctx, query, movie.ID, movie.Version).Scan(&movie.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	movie.DeletedAt = nil
+	err = insertRevision(ctx, tx, movie, userID, RevisionRestore, 0)
 	if err != nil {
 		return err
 	}
-	if affected == 0 {
-		return ErrRecordNotFound
+	return tx.Commit()
+}
+
+// PurgeDeleted hard deletes movies that were soft deleted more than
+// age ago. Their revisions are kept.
+func (m MovieModel) PurgeDeleted(ctx context.Context, age time.Duration) (int64, error) {
+	query := `
+        DELETE FROM movies
+		WHERE deleted_at < NOW() - $1 * interval '1 second'`
+	result, err := m.DB.ExecContext(ctx, query, age.Seconds())
+	if err != nil {
+		return 0, err
 	}
-	return nil
+	return result.RowsAffected()
 }
 
-func (m MovieModel) GetAll(title string, genres []string, filter Filters) ([]*Movie, Metadata, error) {
+// GetAll lists movies matching title and genres, soft deleted ones
+// are left out unless includeDeleted is set. fields limits the columns
+// read, as for GetFields.
+func (m MovieModel) GetAll(title string, genres []string, includeDeleted bool, fields []string, filter Filters) ([]*Movie, Metadata, error) {
+	cols := movieColumns(fields)
 	query := fmt.Sprintf(`
-        SELECT count(*) OVER(),
-		id, created_at, title, year, runtime, genres, version
+        SELECT count(*) OVER(), %s
 		FROM movies
 		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
 		AND (genres @> $2 OR $2= '{}')
+		AND (deleted_at IS NULL OR $3)
 		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4`, filter.sortColumn(), filter.sortDirection())
+		LIMIT $4 OFFSET $5`, strings.Join(cols, ", "), filter.sortColumn(), filter.sortDirection())
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	args := []interface{}{title, pq.Array(genres), filter.limit(), filter.offset()}
+	args := []interface{}{title, pq.Array(genres), includeDeleted, filter.limit(), filter.offset()}
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
@@ -163,17 +444,8 @@ func (m MovieModel) GetAll(title string, genres []string, filter Filters) ([]*Mo
 	totalRecords := 0
 	ms := []*Movie{}
 	for rows.Next() {
-		var movie Movie
-		err := rows.Scan(
-			&totalRecords,
-			&movie.ID,
-			&movie.CreatedAt,
-			&movie.Title,
-			&movie.Year,
-			&movie.Runtime,
-			pq.Array(&movie.Genres),
-			&movie.Version,
-		)
+		movie := Movie{fields: fields}
+		err := rows.Scan(append([]interface{}{&totalRecords}, movieDest(&movie, cols)...)...)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
@@ -184,3 +456,68 @@ func (m MovieModel) GetAll(title string, genres []string, filter Filters) ([]*Mo
 	}
 	return ms, calculateMetadata(totalRecords, filter.Page, filter.PageSize), nil
 }
+
+// exportFetchSize is how many rows Stream fetches from its cursor at a
+// time, which bounds its memory however many movies match.
+const exportFetchSize = 500
+
+// Stream calls fn with every movie matching the same filters as GetAll,
+// sorted by filter.Sort, reading them through a server-side cursor so
+// memory stays flat. It stops at the first error from fn or when ctx is
+// done, which cancels the running query as well.
+func (m MovieModel) Stream(ctx context.Context, title string, genres []string, includeDeleted bool, filter Filters, fn func(*Movie) error) error {
+	tx, err := beginTx(ctx, m.DB, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := fmt.Sprintf(`
+        DECLARE movie_export NO SCROLL CURSOR FOR
+		SELECT id, created_at, title, year, runtime, genres, version, deleted_at
+		FROM movies
+		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+		AND (genres @> $2 OR $2= '{}')
+		AND (deleted_at IS NULL OR $3)
+		ORDER BY %s %s, id ASC`, filter.sortColumn(), filter.sortDirection())
+	_, err = tx.ExecContext(ctx, query, title, pq.Array(genres), includeDeleted)
+	if err != nil {
+		return err
+	}
+	fetch := fmt.Sprintf("FETCH FORWARD %d FROM movie_export", exportFetchSize)
+	for {
+		rows, err := tx.QueryContext(ctx, fetch)
+		if err != nil {
+			return err
+		}
+		n := 0
+		for rows.Next() {
+			var movie Movie
+			err = rows.Scan(
+				&movie.ID,
+				&movie.CreatedAt,
+				&movie.Title,
+				&movie.Year,
+				&movie.Runtime,
+				pq.Array(&movie.Genres),
+				&movie.Version,
+				&movie.DeletedAt,
+			)
+			if err == nil {
+				err = fn(&movie)
+			}
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			n++
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		if n < exportFetchSize {
+			return nil
+		}
+	}
+}
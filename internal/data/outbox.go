@@ -0,0 +1,202 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+	OutboxDead    = "dead"
+)
+
+// OutboxMessage is an email waiting to be, or already, sent.
+// Data holds the template data and may contain tokens, so it is
+// never serialised, and is cleared once the message is sent. Numbers
+// in it read back as json.Number, an id stays an integer.
+type OutboxMessage struct {
+	ID            int64                  `json:"id"`
+	CreatedAt     time.Time              `json:"created_at"`
+	Recipient     string                 `json:"recipient"`
+	Locale        string                 `json:"locale"`
+	Template      string                 `json:"template"`
+	Data          map[string]interface{} `json:"-"`
+	Status        string                 `json:"status"`
+	Attempts      int                    `json:"attempts"`
+	LastError     string                 `json:"last_error,omitempty"`
+	NextAttemptAt time.Time              `json:"next_attempt_at"`
+	SentAt        *time.Time             `json:"sent_at,omitempty"`
+}
+
+// OutboxModel wraps a sql.DB connection pool
+type OutboxModel struct {
+	DB Handle
+}
+
+const outboxColumns = `id, created_at, recipient, locale, template, data, status,
+		attempts, last_error, next_attempt_at, sent_at`
+
+func scanOutboxMessage(row interface{ Scan(...interface{}) error }, extra ...interface{}) (*OutboxMessage, error) {
+	var (
+		msg OutboxMessage
+		js  []byte
+	)
+	dest := append(extra,
+		&msg.ID, &msg.CreatedAt, &msg.Recipient, &msg.Locale, &msg.Template, &js, &msg.Status,
+		&msg.Attempts, &msg.LastError, &msg.NextAttemptAt, &msg.SentAt)
+	err := row.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	err = dec.Decode(&msg.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (m OutboxModel) Insert(msg *OutboxMessage) error {
+	js, err := json.Marshal(msg.Data)
+	if err != nil {
+		return err
+	}
+	query := `
+        INSERT INTO email_outbox (recipient, locale, template, data)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, status, next_attempt_at`
+	if msg.Locale == "" {
+		msg.Locale = DefaultLocale
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, msg.Recipient, msg.Locale, msg.Template, js).
+		Scan(&msg.ID, &msg.CreatedAt, &msg.Status, &msg.NextAttemptAt)
+}
+
+// MarkSent records the message as sent and drops its template data,
+// which is no longer needed and may hold tokens.
+func (m OutboxModel) MarkSent(id int64) error {
+	query := `
+        UPDATE email_outbox
+		SET status = 'sent', attempts = attempts + 1, sent_at = NOW(), last_error = '',
+		data = '{}'
+		WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// MarkFailed records a failed attempt. The send job retries it at
+// retryAt, or the message is dead-lettered when dead is true.
+func (m OutboxModel) MarkFailed(id int64, sendErr error, retryAt time.Time, dead bool) error {
+	status := OutboxPending
+	if dead {
+		status = OutboxDead
+	}
+	query := `
+        UPDATE email_outbox
+		SET status = $1, attempts = attempts + 1, last_error = $2, next_attempt_at = $3
+		WHERE id = $4`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, status, sendErr.Error(), retryAt, id)
+	return err
+}
+
+// Retry marks a message pending again with a fresh attempt budget,
+// the caller enqueues the job that sends it.
+func (m OutboxModel) Retry(msg *OutboxMessage) error {
+	query := `
+        UPDATE email_outbox
+		SET status = 'pending', attempts = 0, next_attempt_at = NOW()
+		WHERE id = $1 AND status <> 'sent'
+		RETURNING status, attempts, next_attempt_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, msg.ID).
+		Scan(&msg.Status, &msg.Attempts, &msg.NextAttemptAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m OutboxModel) Get(id int64) (*OutboxMessage, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+        SELECT ` + outboxColumns + `
+		FROM email_outbox
+		WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	msg, err := scanOutboxMessage(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+func (m OutboxModel) GetAll(status, recipient string, filter Filters) ([]*OutboxMessage, Metadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), `+outboxColumns+`
+		FROM email_outbox
+		WHERE (status = $1 OR $1 = '')
+		AND (recipient = $2 OR $2 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT $3 OFFSET $4`, filter.sortColumn(), filter.sortDirection())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, status, recipient, filter.limit(), filter.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	msgs := []*OutboxMessage{}
+	for rows.Next() {
+		msg, err := scanOutboxMessage(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		msgs = append(msgs, msg)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return msgs, calculateMetadata(totalRecords, filter.Page, filter.PageSize), nil
+}
+
+// DeleteFinished removes sent and dead-lettered messages older than
+// age, pending ones are always kept.
+func (m OutboxModel) DeleteFinished(ctx context.Context, age time.Duration) (int64, error) {
+	query := `
+        DELETE FROM email_outbox
+		WHERE status IN ('sent', 'dead')
+		AND created_at < NOW() - $1 * interval '1 second'`
+	result, err := m.DB.ExecContext(ctx, query, age.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,50 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeRow scans fixed values, the way database/sql assigns them.
+type fakeRow []interface{}
+
+func (row fakeRow) Scan(dest ...interface{}) error {
+	if len(dest) != len(row) {
+		return fmt.Errorf("scanning %d values into %d destinations", len(row), len(dest))
+	}
+	for i, v := range row {
+		d := reflect.ValueOf(dest[i]).Elem()
+		if v == nil {
+			d.Set(reflect.Zero(d.Type()))
+			continue
+		}
+		d.Set(reflect.ValueOf(v).Convert(d.Type()))
+	}
+	return nil
+}
+
+func TestScanOutboxMessageKeepsIntegers(t *testing.T) {
+	now := time.Now()
+	row := fakeRow{
+		int64(1), now, "alice@example.com", "en", "user_welcome.tmpl",
+		[]byte(`{"userID": 9007199254740993, "activationToken": "ABC"}`), OutboxPending,
+		0, "", now, (*time.Time)(nil),
+	}
+	msg, err := scanOutboxMessage(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, ok := msg.Data["userID"].(json.Number)
+	if !ok {
+		t.Fatalf("userID is a %T, want json.Number", msg.Data["userID"])
+	}
+	if id.String() != "9007199254740993" {
+		t.Errorf("userID = %s, want 9007199254740993", id)
+	}
+	if got := fmt.Sprint(msg.Data["userID"]); got != "9007199254740993" {
+		t.Errorf("userID renders as %s", got)
+	}
+}
@@ -0,0 +1,190 @@
+package data
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+
+	unusablePasswordHash = "!"
+)
+
+var (
+	// ErrUnknownPasswordHash is returned when a stored hash is in
+	// a format none of the supported algorithms can read.
+	ErrUnknownPasswordHash = errors.New("unknown password hash format")
+)
+
+// Argon2Params holds the argon2id cost parameters,
+// Memory is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// PasswordHashing is the algorithm and parameters used when
+// hashing new passwords. Hashes made with anything else are
+// still verified, and reported by NeedsRehash.
+type PasswordHashing struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+var passwordHashing = PasswordHashing{
+	Algorithm:  AlgorithmArgon2id,
+	BcryptCost: 12,
+	Argon2: Argon2Params{
+		Memory:      64 * 1024,
+		Iterations:  3,
+		Parallelism: 2,
+		SaltLength:  16,
+		KeyLength:   32,
+	},
+}
+
+// SetPasswordHashing replaces the algorithm and parameters
+// used by password.Set.
+func SetPasswordHashing(h PasswordHashing) error {
+	switch h.Algorithm {
+	case AlgorithmArgon2id:
+		if h.Argon2.Memory < 8*uint32(h.Argon2.Parallelism) {
+			return errors.New("argon2 memory must be at least 8KiB per thread")
+		}
+		if h.Argon2.Iterations < 1 || h.Argon2.Parallelism < 1 {
+			return errors.New("argon2 iterations and parallelism must be greater than zero")
+		}
+		if h.Argon2.SaltLength < 8 || h.Argon2.KeyLength < 16 {
+			return errors.New("argon2 salt must be at least 8 bytes and key at least 16 bytes")
+		}
+	case AlgorithmBcrypt:
+		if h.BcryptCost < bcrypt.MinCost || h.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return fmt.Errorf("unsupported password hashing algorithm %q", h.Algorithm)
+	}
+	passwordHashing = h
+	return nil
+}
+
+// maxPasswordBytes is the longest plaintext the current
+// algorithm hashes without truncation.
+func maxPasswordBytes() int {
+	if passwordHashing.Algorithm == AlgorithmBcrypt {
+		return 72
+	}
+	return 1024
+}
+
+func hashPassword(plain string) ([]byte, error) {
+	if passwordHashing.Algorithm == AlgorithmBcrypt {
+		return bcrypt.GenerateFromPassword([]byte(plain), passwordHashing.BcryptCost)
+	}
+	p := passwordHashing.Argon2
+	salt := make([]byte, p.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(plain), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+	return []byte(encoded), nil
+}
+
+func isBcryptHash(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte("$2"))
+}
+
+// decodeArgon2Hash parses a hash in the PHC string format
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>, rejecting
+// parameters argon2 can't hash with.
+func decodeArgon2Hash(hash []byte) (p Argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != AlgorithmArgon2id {
+		return p, nil, nil, ErrUnknownPasswordHash
+	}
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return p, nil, nil, ErrUnknownPasswordHash
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism)
+	if err != nil {
+		return p, nil, nil, ErrUnknownPasswordHash
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrUnknownPasswordHash
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, ErrUnknownPasswordHash
+	}
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+	// argon2.IDKey panics on parameters it can't run with, a bad
+	// stored hash must fail the login instead
+	if p.Iterations < 1 || p.Parallelism < 1 || p.Memory < 8*uint32(p.Parallelism) || p.KeyLength == 0 {
+		return p, nil, nil, ErrUnknownPasswordHash
+	}
+	return p, salt, key, nil
+}
+
+func comparePassword(hash []byte, plain string) (bool, error) {
+	if isBcryptHash(hash) {
+		err := bcrypt.CompareHashAndPassword(hash, []byte(plain))
+		if err != nil {
+			switch {
+			case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+				return false, nil
+			default:
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	p, salt, key, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(plain), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// passwordNeedsRehash reports whether hash was made with a different
+// algorithm or different parameters than the current ones.
+func passwordNeedsRehash(hash []byte) bool {
+	if string(hash) == unusablePasswordHash {
+		return false
+	}
+	if isBcryptHash(hash) {
+		if passwordHashing.Algorithm != AlgorithmBcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost(hash)
+		return err != nil || cost != passwordHashing.BcryptCost
+	}
+	if passwordHashing.Algorithm != AlgorithmArgon2id {
+		return true
+	}
+	p, _, _, err := decodeArgon2Hash(hash)
+	return err != nil || p != passwordHashing.Argon2
+}
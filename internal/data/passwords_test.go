@@ -0,0 +1,81 @@
+package data
+
+import (
+	"errors"
+	"testing"
+)
+
+// withHashing swaps in cheap hashing parameters for the test.
+func withHashing(t *testing.T, h PasswordHashing) {
+	saved := passwordHashing
+	err := SetPasswordHashing(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { passwordHashing = saved })
+}
+
+var testArgon2 = PasswordHashing{
+	Algorithm: AlgorithmArgon2id,
+	Argon2:    Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+}
+
+func TestArgon2RoundTrip(t *testing.T) {
+	withHashing(t, testArgon2)
+	var p password
+	err := p.Set("pa55word!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for plain, want := range map[string]bool{"pa55word!": true, "pa55word?": false} {
+		ok, err := p.Matches(plain)
+		if err != nil || ok != want {
+			t.Errorf("Matches(%q) = %v, %v, want %v", plain, ok, err, want)
+		}
+	}
+	if p.NeedsRehash() {
+		t.Error("a hash made with the current parameters needs a rehash")
+	}
+	other := testArgon2
+	other.Argon2.Iterations = 2
+	withHashing(t, other)
+	if !p.NeedsRehash() {
+		t.Error("a hash made with other parameters doesn't need a rehash")
+	}
+}
+
+func TestMalformedArgon2Hash(t *testing.T) {
+	const salt, key = "c29tZXNhbHRzb21lc2FsdA", "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+	for _, hash := range []string{
+		"$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key,
+		"$argon2id$v=19$m=15,t=1,p=2$" + salt + "$" + key,
+		"$argon2id$v=19$m=0,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1,p=1$" + salt + "$",
+		"$argon2id$v=19$m=64,t=1,p=300$" + salt + "$" + key,
+		"$argon2id$v=18$m=64,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1,p=1$" + salt + "$!!",
+		"$argon2i$v=19$m=64,t=1,p=1$" + salt + "$" + key,
+		"argon2id",
+	} {
+		ok, err := comparePassword([]byte(hash), "pa55word!")
+		if ok || !errors.Is(err, ErrUnknownPasswordHash) {
+			t.Errorf("%s: got %v, %v, want %v", hash, ok, err, ErrUnknownPasswordHash)
+		}
+		if !passwordNeedsRehash([]byte(hash)) {
+			t.Errorf("%s: a malformed hash doesn't need a rehash", hash)
+		}
+	}
+}
+
+func TestUnusablePassword(t *testing.T) {
+	var p password
+	p.SetUnusable()
+	ok, err := p.Matches("")
+	if ok || err != nil {
+		t.Errorf("Matches = %v, %v", ok, err)
+	}
+	if p.NeedsRehash() {
+		t.Error("an unusable password needs a rehash")
+	}
+}
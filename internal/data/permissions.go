@@ -2,7 +2,6 @@ package data
 
 import (
 	"context"
-	"database/sql"
 	"time"
 
 	"github.com/lib/pq"
@@ -23,7 +22,7 @@ func (p Permissions) Include(code string) bool {
 
 // PermissionModel ...
 type PermissionModel struct {
-	DB *sql.DB
+	DB Handle
 }
 
 func (p PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
@@ -58,6 +57,35 @@ func (p PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
+// GetAll returns every permission code known to the database.
+func (p PermissionModel) GetAll() (Permissions, error) {
+	query := `
+        SELECT code
+		FROM permissions
+		ORDER BY id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := p.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var permissions Permissions
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
 func (p PermissionModel) AddForUser(userID int64, codes ...string) error {
 	query := `
         INSERT INTO users_permissions
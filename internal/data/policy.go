@@ -0,0 +1,313 @@
+package data
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/datewu/xyz/internal/validator"
+)
+
+// PasswordPolicy is the set of rules a new password must pass.
+// The zero value of each field disables the rule.
+type PasswordPolicy struct {
+	MinLength        int
+	MinCharClasses   int
+	DisallowPersonal bool
+	MinScore         int
+	Breached         *BreachedPasswords
+}
+
+var passwordPolicy = PasswordPolicy{MinLength: 8}
+
+// SetPasswordPolicy replaces the policy used by ValidatePasswordPolicy.
+func SetPasswordPolicy(p PasswordPolicy) {
+	passwordPolicy = p
+}
+
+// ValidatePasswordPolicy checks a new password against every rule of the
+// current policy. name and email are the owner's, so they can't be reused
+// inside the password. Each failed rule contributes its own message, added
+// to any password error already in v. A missing password is left to
+// ValidatePasswordPlaintext.
+func ValidatePasswordPolicy(v *validator.Validator, plain, name, email string) {
+	if plain == "" {
+		return
+	}
+	p := passwordPolicy
+	var msgs []string
+	code := validator.CodeInvalid
+	if len(plain) < p.MinLength {
+		msgs = append(msgs, fmt.Sprintf("must be at least %d bytes long", p.MinLength))
+		code = validator.CodeTooShort
+	}
+	if n := charClasses(plain); n < p.MinCharClasses {
+		msgs = append(msgs, fmt.Sprintf("must contain at least %d of: lowercase letters, uppercase letters, digits, symbols", p.MinCharClasses))
+	}
+	personal := personalInputs(name, email)
+	if p.DisallowPersonal {
+		lower := strings.ToLower(plain)
+		for _, s := range personal {
+			if strings.Contains(lower, s) {
+				msgs = append(msgs, "must not contain your name or email address")
+				break
+			}
+		}
+	}
+	if p.MinScore > 0 && PasswordScore(plain, personal...) < p.MinScore {
+		msgs = append(msgs, "is too easy to guess")
+	}
+	if p.Breached != nil && p.Breached.Contains(plain) {
+		msgs = append(msgs, "has appeared in a data breach and must not be used")
+	}
+	if len(msgs) > 0 {
+		// appended, as AddErr would drop them behind an earlier
+		// message such as the maximum length
+		v.AppendErr("password", code, strings.Join(msgs, "; "))
+	}
+}
+
+// personalInputs splits name and email into the lower cased parts
+// long enough to be worth checking for.
+func personalInputs(name, email string) []string {
+	var parts []string
+	local := email
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		local = email[:i]
+	}
+	fields := strings.FieldsFunc(name+" "+local, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, f := range fields {
+		if len(f) >= 3 {
+			parts = append(parts, strings.ToLower(f))
+		}
+	}
+	return parts
+}
+
+func charClasses(s string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range s {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+var commonPasswords = []string{
+	"password", "123456", "qwerty", "letmein", "welcome", "monkey",
+	"dragon", "football", "baseball", "iloveyou", "admin", "login",
+	"master", "sunshine", "princess", "starwars", "shadow", "superman",
+	"trustno1", "whatever", "freedom", "hello", "secret", "greenlight",
+	"abc123", "passw0rd", "michael", "charlie", "jordan", "hunter",
+}
+
+var keyboardRows = []string{
+	"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./",
+}
+
+// PasswordScore estimates how hard plain is to guess, in the manner of
+// zxcvbn: 0 is trivially guessable, 4 is very strong. Repeats,
+// sequences, keyboard runs, common passwords and the supplied user
+// inputs count as a single guess each instead of per character.
+func PasswordScore(plain string, userInputs ...string) int {
+	rs := []rune(strings.ToLower(plain))
+	var log10Guesses float64
+	words := make([]string, 0, len(userInputs)+len(commonPasswords))
+	words = append(words, userInputs...)
+	words = append(words, commonPasswords...)
+	// Dictionary words are matched with common l33t substitutions undone,
+	// on both sides so "abc123" still finds itself, which keeps rune
+	// positions intact, then blanked out of rs.
+	unleeted := []rune(strings.Map(unleet, string(rs)))
+	for _, w := range words {
+		w = strings.Map(unleet, strings.ToLower(w))
+		ws := []rune(w)
+		if len(ws) < 3 {
+			continue
+		}
+		for {
+			i := strings.Index(string(unleeted), w)
+			if i < 0 {
+				break
+			}
+			start := len([]rune(string(unleeted)[:i]))
+			for j := start; j < start+len(ws); j++ {
+				rs[j], unleeted[j] = 0, 0
+			}
+			log10Guesses += math.Log10(float64(len(words)))
+		}
+	}
+
+	perChar := math.Log10(float64(charsetSize(plain)))
+	for i, r := range rs {
+		if r == 0 {
+			continue
+		}
+		if i > 0 && (rs[i-1] == r || rs[i-1]+1 == r || rs[i-1]-1 == r || keyboardAdjacent(rs[i-1], r)) {
+			log10Guesses += math.Log10(2)
+			continue
+		}
+		log10Guesses += perChar
+	}
+
+	switch {
+	case log10Guesses < 3:
+		return 0
+	case log10Guesses < 6:
+		return 1
+	case log10Guesses < 8:
+		return 2
+	case log10Guesses < 10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+func unleet(r rune) rune {
+	switch r {
+	case '0':
+		return 'o'
+	case '1', '!':
+		return 'i'
+	case '3':
+		return 'e'
+	case '4', '@':
+		return 'a'
+	case '5', '$':
+		return 's'
+	case '7':
+		return 't'
+	}
+	return r
+}
+
+func charsetSize(s string) int {
+	size := 0
+	var lower, upper, digit, symbol bool
+	for _, r := range s {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if lower {
+		size += 26
+	}
+	if upper {
+		size += 26
+	}
+	if digit {
+		size += 10
+	}
+	if symbol {
+		size += 33
+	}
+	if size == 0 {
+		return 1
+	}
+	return size
+}
+
+func keyboardAdjacent(a, b rune) bool {
+	for _, row := range keyboardRows {
+		i := strings.IndexRune(row, a)
+		j := strings.IndexRune(row, b)
+		if i >= 0 && j >= 0 && (i-j == 1 || j-i == 1) {
+			return true
+		}
+	}
+	return false
+}
+
+// BreachedPasswords is a set of SHA-1 password hashes grouped by their
+// first five hex characters, the same k-anonymity layout used by the
+// Pwned Passwords range API.
+type BreachedPasswords struct {
+	ranges map[string]map[string]struct{}
+}
+
+// LoadBreachedPasswords reads a hash-prefix file. Each line is either a
+// full 40 character SHA-1 hash, or a "PREFIX:SUFFIX" pair as returned
+// by the range API, optionally followed by ":count".
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := &BreachedPasswords{ranges: make(map[string]map[string]struct{})}
+	sc := bufio.NewScanner(f)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(strings.ToUpper(line), ":")
+		hash := parts[0]
+		if len(parts) > 1 && len(parts[0]) == 5 && len(parts[1]) == 35 {
+			hash = parts[0] + parts[1]
+		}
+		if len(hash) != 40 {
+			return nil, fmt.Errorf("%s:%d: invalid SHA-1 hash", path, lineNo)
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid SHA-1 hash", path, lineNo)
+		}
+		b.add(hash[:5], hash[5:])
+	}
+	if err = sc.Err(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *BreachedPasswords) add(prefix, suffix string) {
+	r, ok := b.ranges[prefix]
+	if !ok {
+		r = make(map[string]struct{})
+		b.ranges[prefix] = r
+	}
+	r[suffix] = struct{}{}
+}
+
+// Contains reports whether plain is in the breached set.
+func (b *BreachedPasswords) Contains(plain string) bool {
+	sum := sha1.Sum([]byte(plain))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	_, ok := b.ranges[hash[:5]][hash[5:]]
+	return ok
+}
+
+// Len is the number of hashes loaded.
+func (b *BreachedPasswords) Len() int {
+	n := 0
+	for _, r := range b.ranges {
+		n += len(r)
+	}
+	return n
+}
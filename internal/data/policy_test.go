@@ -0,0 +1,145 @@
+package data
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/datewu/xyz/internal/validator"
+)
+
+// withPolicy swaps in p for the duration of the test.
+func withPolicy(t *testing.T, p PasswordPolicy) {
+	saved := passwordPolicy
+	SetPasswordPolicy(p)
+	t.Cleanup(func() { SetPasswordPolicy(saved) })
+}
+
+func TestPasswordScore(t *testing.T) {
+	tests := []struct {
+		plain  string
+		inputs []string
+		max    int
+		min    int
+	}{
+		{plain: "123456", max: 0},
+		{plain: "abc123", max: 0},
+		{plain: "passw0rd", max: 0},
+		{plain: "P@$$w0rd", max: 0},
+		{plain: "trustno1", max: 0},
+		{plain: "aaaaaaaaaaaa", max: 1},
+		{plain: "qwertyuiop", max: 1},
+		{plain: "alicealice2021", inputs: []string{"alice"}, max: 2},
+		{plain: "alicealice2021", min: 4, max: 4},
+		{plain: "qT7!mZ2#vL9@", min: 4, max: 4},
+		{plain: "correct horse battery staple", min: 4, max: 4},
+	}
+	for _, tt := range tests {
+		got := PasswordScore(tt.plain, tt.inputs...)
+		if got < tt.min || got > tt.max {
+			t.Errorf("PasswordScore(%q, %q) = %d, want %d-%d", tt.plain, tt.inputs, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestValidatePasswordPolicy(t *testing.T) {
+	withPolicy(t, PasswordPolicy{MinLength: 10, MinCharClasses: 3, DisallowPersonal: true, MinScore: 3})
+	tests := []struct {
+		plain string
+		want  []string
+	}{
+		{"qT7!mZ2#vL9@", nil},
+		{"short", []string{"at least 10 bytes", "at least 3 of", "too easy to guess"}},
+		{"Smith-4-President!", []string{"your name or email"}},
+		{"trustno1trustno1", []string{"at least 3 of", "too easy to guess"}},
+	}
+	for _, tt := range tests {
+		v := validator.New()
+		ValidatePasswordPolicy(v, tt.plain, "Alice Smith", "alice@example.com")
+		msg, failed := v.Errors["password"]
+		if failed != (tt.want != nil) {
+			t.Errorf("%q: got error %q, want %v", tt.plain, msg, tt.want)
+			continue
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(msg, w) {
+				t.Errorf("%q: error %q doesn't mention %q", tt.plain, msg, w)
+			}
+		}
+	}
+}
+
+func TestPasswordMinLengthBelowEight(t *testing.T) {
+	withPolicy(t, PasswordPolicy{MinLength: 6})
+	v := validator.New()
+	ValidatePasswordPlaintext(v, "x7!Kp2")
+	ValidatePasswordPolicy(v, "x7!Kp2", "Alice Smith", "alice@example.com")
+	if !v.Valid() {
+		t.Errorf("a 6 byte password failed a 6 byte minimum: %v", v.Errors)
+	}
+	v = validator.New()
+	ValidatePasswordPlaintext(v, "x7!Kp")
+	ValidatePasswordPolicy(v, "x7!Kp", "Alice Smith", "alice@example.com")
+	if v.Errors["password"] != "must be at least 6 bytes long" {
+		t.Errorf("got %q", v.Errors["password"])
+	}
+}
+
+func TestValidatePasswordPolicyKeepsEarlierErrors(t *testing.T) {
+	withPolicy(t, PasswordPolicy{MinCharClasses: 2})
+	plain := strings.Repeat("a", maxPasswordBytes()+1)
+	v := validator.New()
+	ValidatePasswordPlaintext(v, plain)
+	ValidatePasswordPolicy(v, plain, "", "")
+	msg := v.Errors["password"]
+	if !strings.Contains(msg, "must not be more than") || !strings.Contains(msg, "at least 2 of") {
+		t.Errorf("got %q, want both the length and the policy errors", msg)
+	}
+
+	v = validator.New()
+	ValidatePasswordPlaintext(v, "")
+	ValidatePasswordPolicy(v, "", "", "")
+	if v.Errors["password"] != "must be provided" {
+		t.Errorf("got %q", v.Errors["password"])
+	}
+}
+
+func TestBreachedPasswords(t *testing.T) {
+	sum := sha1.Sum([]byte("hunter2"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	file := filepath.Join(t.TempDir(), "breached.txt")
+	content := "# comment\n\n" + hash[:5] + ":" + hash[5:] + ":42\n" +
+		strings.Repeat("A", 40) + "\n"
+	err := ioutil.WriteFile(file, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := LoadBreachedPasswords(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 2 {
+		t.Errorf("Len = %d, want 2", b.Len())
+	}
+	if !b.Contains("hunter2") || b.Contains("hunter3") {
+		t.Error("Contains got the set wrong")
+	}
+
+	withPolicy(t, PasswordPolicy{Breached: b})
+	v := validator.New()
+	ValidatePasswordPolicy(v, "hunter2", "", "")
+	if !strings.Contains(v.Errors["password"], "data breach") {
+		t.Errorf("got %q", v.Errors["password"])
+	}
+
+	err = ioutil.WriteFile(file, []byte("not a hash\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadBreachedPasswords(file); err == nil {
+		t.Error("loaded an invalid hash")
+	}
+}
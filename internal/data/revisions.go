@@ -0,0 +1,230 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	RevisionCreate  = "create"
+	RevisionUpdate  = "update"
+	RevisionDelete  = "delete"
+	RevisionRestore = "restore"
+	RevisionRevert  = "revert"
+)
+
+// MovieRevision is a full snapshot of a movie at one version, along
+// with who made the change and how.
+type MovieRevision struct {
+	ID           int64     `json:"id"`
+	MovieID      int64     `json:"movie_id"`
+	Version      int32     `json:"version"`
+	CreatedAt    time.Time `json:"created_at"`
+	UserID       *int64    `json:"user_id"`
+	Action       string    `json:"action"`
+	RevertedFrom *int32    `json:"reverted_from,omitempty"`
+	Title        string    `json:"title"`
+	Year         int32     `json:"year"`
+	Runtime      Runtime   `json:"runtime"`
+	Genres       []string  `json:"genres"`
+	Deleted      bool      `json:"deleted"`
+}
+
+// FieldChange is one field that differs between two revisions.
+type FieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// DiffRevisions lists the fields that changed from a to b, keyed by
+// their JSON name.
+func DiffRevisions(a, b *MovieRevision) map[string]FieldChange {
+	changes := make(map[string]FieldChange)
+	if a.Title != b.Title {
+		changes["title"] = FieldChange{a.Title, b.Title}
+	}
+	if a.Year != b.Year {
+		changes["year"] = FieldChange{a.Year, b.Year}
+	}
+	if a.Runtime != b.Runtime {
+		changes["runtime"] = FieldChange{a.Runtime, b.Runtime}
+	}
+	if !equalStrings(a.Genres, b.Genres) {
+		changes["genres"] = FieldChange{a.Genres, b.Genres}
+	}
+	if a.Deleted != b.Deleted {
+		changes["deleted"] = FieldChange{a.Deleted, b.Deleted}
+	}
+	return changes
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// insertRevision records movie as it is now, and the event telling
+// listeners about it. It must run in the transaction that changed the
+// movie so history can't drift from it.
+func insertRevision(ctx context.Context, tx Tx, movie *Movie, userID int64, action string, revertedFrom int32) error {
+	query := `
+        INSERT INTO movie_revisions (movie_id, version, user_id, action, reverted_from,
+		title, year, runtime, genres, deleted)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	args := []interface{}{
+		movie.ID, movie.Version,
+		sql.NullInt64{Int64: userID, Valid: userID > 0},
+		action,
+		sql.NullInt32{Int32: revertedFrom, Valid: revertedFrom > 0},
+		movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres),
+		movie.DeletedAt != nil,
+	}
+	_, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	return insertMovieEvent(ctx, tx, movie, action)
+}
+
+// RevisionAuthor is the user behind a revision, as far as other users
+// get to see them.
+type RevisionAuthor struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// MovieRevisionModel wraps a sql.DB connection pool
+type MovieRevisionModel struct {
+	DB Handle
+}
+
+const revisionColumns = `id, movie_id, version, created_at, user_id, action, reverted_from,
+		title, year, runtime, genres, deleted`
+
+func scanRevision(row interface{ Scan(...interface{}) error }, extra ...interface{}) (*MovieRevision, error) {
+	var rev MovieRevision
+	dest := append(extra,
+		&rev.ID, &rev.MovieID, &rev.Version, &rev.CreatedAt, &rev.UserID, &rev.Action, &rev.RevertedFrom,
+		&rev.Title, &rev.Year, &rev.Runtime, pq.Array(&rev.Genres), &rev.Deleted)
+	err := row.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+func (m MovieRevisionModel) Get(movieID int64, version int32) (*MovieRevision, error) {
+	if movieID < 1 || version < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+        SELECT ` + revisionColumns + `
+		FROM movie_revisions
+		WHERE movie_id = $1 AND version = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rev, err := scanRevision(m.DB.QueryRowContext(ctx, query, movieID, version))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return rev, nil
+}
+
+func (m MovieRevisionModel) GetAllForMovie(movieID int64, filter Filters) ([]*MovieRevision, Metadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), `+revisionColumns+`
+		FROM movie_revisions
+		WHERE movie_id = $1
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3`, filter.sortColumn(), filter.sortDirection())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, movieID, filter.limit(), filter.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	revs := []*MovieRevision{}
+	for rows.Next() {
+		rev, err := scanRevision(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		revs = append(revs, rev)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return revs, calculateMetadata(totalRecords, filter.Page, filter.PageSize), nil
+}
+
+// GetLatest returns the newest revision of each of movieIDs, keyed by
+// movie ID.
+func (m MovieRevisionModel) GetLatest(ctx context.Context, movieIDs []int64) (map[int64]*MovieRevision, error) {
+	query := `
+        SELECT DISTINCT ON (movie_id) ` + revisionColumns + `
+		FROM movie_revisions
+		WHERE movie_id = ANY($1)
+		ORDER BY movie_id, version DESC`
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(movieIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revs := make(map[int64]*MovieRevision)
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revs[rev.MovieID] = rev
+	}
+	return revs, rows.Err()
+}
+
+// GetCreators returns who created each of movieIDs, keyed by movie ID.
+// Movies from before revisions were recorded, or whose creator has
+// since been deleted, are missing.
+func (m MovieRevisionModel) GetCreators(ctx context.Context, movieIDs []int64) (map[int64]*RevisionAuthor, error) {
+	query := `
+        SELECT r.movie_id, u.id, u.name
+		FROM movie_revisions r
+		INNER JOIN users u ON u.id = r.user_id
+		WHERE r.movie_id = ANY($1) AND r.action = '` + RevisionCreate + `'`
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(movieIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	authors := make(map[int64]*RevisionAuthor)
+	for rows.Next() {
+		var (
+			movieID int64
+			a       RevisionAuthor
+		)
+		err := rows.Scan(&movieID, &a.ID, &a.Name)
+		if err != nil {
+			return nil, err
+		}
+		authors[movieID] = &a
+	}
+	return authors, rows.Err()
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/base32"
 	"time"
 
@@ -15,6 +14,7 @@ const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
 	ScopePwdReset       = "password-reset"
+	ScopeInvitation     = "invitation"
 )
 
 // Token ...
@@ -46,13 +46,13 @@ func generateToekn(userID int64, ttl time.Duration, scope string) (*Token, error
 }
 
 func ValidateTokenPlaintext(v *validator.Validator, text string) {
-	v.Check(text != "", "token", "must be provided")
+	v.CheckCode(text != "", "token", validator.CodeRequired, "must be provided")
 	v.Check(len(text) == 26, "token", "must be 26 bytes long")
 }
 
 // TokenModel ...
 type TokenModel struct {
-	DB *sql.DB
+	DB Handle
 }
 
 func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -88,3 +88,16 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// DeleteExpired removes every token past its expiry and reports how
+// many were deleted.
+func (m TokenModel) DeleteExpired(ctx context.Context) (int64, error) {
+	query := `
+	    DELETE FROM tokens
+		WHERE expiry < NOW()`
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
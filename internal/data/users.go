@@ -5,10 +5,11 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
+	"regexp"
 	"time"
 
 	"github.com/datewu/xyz/internal/validator"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -27,6 +28,7 @@ type User struct {
 	Email     string    `json:"email"`
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
+	Locale    string    `json:"locale"`
 	Version   int       `json:"-"`
 }
 
@@ -40,7 +42,7 @@ type password struct {
 }
 
 func (p *password) Set(plain string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plain), 12)
+	hash, err := hashPassword(plain)
 	if err != nil {
 		return err
 	}
@@ -49,36 +51,62 @@ func (p *password) Set(plain string) error {
 	return nil
 }
 
+// SetUnusable stores a hash no password matches, used for
+// accounts whose owner hasn't chosen a password yet.
+func (p *password) SetUnusable() {
+	p.plainText = nil
+	p.hash = []byte(unusablePasswordHash)
+}
+
 func (p *password) Matches(plain string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plain))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
+	if string(p.hash) == unusablePasswordHash {
+		return false, nil
 	}
-	return true, nil
+	return comparePassword(p.hash, plain)
+}
+
+// NeedsRehash reports whether the stored hash should be replaced
+// by one made with the current algorithm and parameters.
+func (p *password) NeedsRehash() bool {
+	return passwordNeedsRehash(p.hash)
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
-	v.Check(email != "", "email", "must be provided")
-	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
+	v.CheckCode(email != "", "email", validator.CodeRequired, "must be provided")
+	v.CheckCode(validator.Matches(email, validator.EmailRX), "email", validator.CodeInvalidFormat, "must be a valid email address")
 }
 
+// ValidatePasswordPlaintext checks a password is present and fits the
+// hasher. The minimum length is up to the policy, see
+// ValidatePasswordPolicy, so logging in with a password set under a
+// shorter -password-min-length keeps working.
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
-	v.Check(password != "", "password", "must be provided")
-	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	v.CheckCode(password != "", "password", validator.CodeRequired, "must be provided")
+	max := maxPasswordBytes()
+	v.CheckCode(len(password) <= max, "password", validator.CodeTooLong, fmt.Sprintf("must not be more than %d bytes long", max))
+}
+
+// DefaultLocale is used for users who never picked one.
+const DefaultLocale = "en"
+
+// LocaleRX matches a lower cased BCP 47 language tag such as "en" or "pt-br".
+var LocaleRX = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+
+func ValidateLocale(v *validator.Validator, locale string) {
+	v.CheckCode(len(locale) <= 35, "locale", validator.CodeTooLong, "must not be more than 35 bytes long")
+	v.CheckCode(validator.Matches(locale, LocaleRX), "locale", validator.CodeInvalidFormat, "must be a valid language tag")
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
-	v.Check(user.Name != "", "name", "must be provided")
-	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
+	v.CheckCode(user.Name != "", "name", validator.CodeRequired, "must be provided")
+	v.CheckCode(len(user.Name) <= 500, "name", validator.CodeTooLong, "must not be more than 500 bytes long")
 
 	ValidateEmail(v, user.Email)
 
+	if user.Locale != "" {
+		ValidateLocale(v, user.Locale)
+	}
+
 	if user.Password.plainText != nil {
 		ValidatePasswordPlaintext(v, *user.Password.plainText)
 	}
@@ -89,16 +117,19 @@ func ValidateUser(v *validator.Validator, user *User) {
 }
 
 type UserModel struct {
-	DB *sql.DB
+	DB Handle
 }
 
 func (u UserModel) Insert(user *User) error {
 	query := `
-        INSERT INTO users (name, email, password_hash, activated)
-		VALUES ($1, $2, $3, $4)
+        INSERT INTO users (name, email, password_hash, activated, locale)
+		VALUES ($1, $2, $3, $4, $5)
 		RETURNING id, created_at, version`
+	if user.Locale == "" {
+		user.Locale = DefaultLocale
+	}
 	args := []interface{}{
-		user.Name, user.Email, user.Password.hash, user.Activated,
+		user.Name, user.Email, user.Password.hash, user.Activated, user.Locale,
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -117,7 +148,7 @@ func (u UserModel) Insert(user *User) error {
 
 func (u UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-        SELECT id, created_at, name, email, password_hash, activated, version
+        SELECT id, created_at, name, email, password_hash, activated, locale, version
 		FROM users
 		WHERE email = $1`
 	var user User
@@ -125,7 +156,7 @@ func (u UserModel) GetByEmail(email string) (*User, error) {
 	defer cancel()
 	err := u.DB.QueryRowContext(ctx, query, email).
 		Scan(&user.ID, &user.CreatedAt, &user.Name, &user.Email,
-			&user.Password.hash, &user.Activated, &user.Version)
+			&user.Password.hash, &user.Activated, &user.Locale, &user.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -140,13 +171,14 @@ func (u UserModel) GetByEmail(email string) (*User, error) {
 func (u UserModel) Update(user *User) error {
 	query := `
         UPDATE users
-        SET name = $1, email = $2, password_hash = $3, activated = $4, version = version +1
-		WHERE id = $5 AND version = $6
+        SET name = $1, email = $2, password_hash = $3, activated = $4, locale = $5, version = version +1
+		WHERE id = $6 AND version = $7
 		RETURNING version`
 	args := []interface{}{
 		user.Name, user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.Locale,
 		user.ID, user.Version,
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -170,13 +202,13 @@ func (u UserModel) GetForToken(scope, token string) (*User, error) {
 	tokenHash := sha256.Sum256([]byte(token))
 	query := `
         SELECT users.id, users.created_at, users.name, users.email, 
-            users.password_hash, users.activated, users.version
+            users.password_hash, users.activated, users.locale, users.version
 		FROM users
 		INNER JOIN tokens
 		ON users.id = tokens.user_id
 		WHERE tokens.hash = $1 
 		AND tokens.scope = $2
-		AND tokens.scope > $3`
+		AND tokens.expiry > $3`
 	args := []interface{}{tokenHash[:], scope, time.Now()}
 
 	var user User
@@ -184,7 +216,7 @@ func (u UserModel) GetForToken(scope, token string) (*User, error) {
 	defer cancel()
 	err := u.DB.QueryRowContext(ctx, query, args...).
 		Scan(&user.ID, &user.CreatedAt, &user.Name, &user.Email,
-			&user.Password.hash, &user.Activated, &user.Version)
+			&user.Password.hash, &user.Activated, &user.Locale, &user.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -195,3 +227,24 @@ func (u UserModel) GetForToken(scope, token string) (*User, error) {
 	}
 	return &user, nil
 }
+
+// DeleteUnactivated removes accounts that were never activated and are
+// older than age. Invited users are kept while their invitation is
+// still open.
+func (u UserModel) DeleteUnactivated(ctx context.Context, age time.Duration) (int64, error) {
+	query := `
+	    DELETE FROM users
+		WHERE activated = false
+		AND created_at < NOW() - $1 * interval '1 second'
+		AND NOT EXISTS (
+			SELECT 1 FROM invitations
+			WHERE invitations.user_id = users.id
+			AND invitations.accepted_at IS NULL
+			AND invitations.revoked_at IS NULL
+			AND invitations.expiry > NOW())`
+	result, err := u.DB.ExecContext(ctx, query, age.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
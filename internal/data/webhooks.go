@@ -0,0 +1,275 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/datewu/xyz/internal/validator"
+	"github.com/lib/pq"
+)
+
+// Webhook is a subscription of url to events. Secret keys the
+// signature of every delivery, it is only shown when it's set.
+type Webhook struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy int64     `json:"created_by,omitempty"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	Version   int32     `json:"version"`
+}
+
+// WebhookDelivery records one attempt to deliver an event.
+type WebhookDelivery struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	WebhookID  int64     `json:"webhook_id"`
+	EventID    string    `json:"event_id"`
+	Event      string    `json:"event"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	Response   string    `json:"response,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// ValidateWebhook checks wh subscribes an http(s) URL to some of
+// events.
+func ValidateWebhook(v *validator.Validator, wh *Webhook, events ...string) {
+	u, err := url.Parse(wh.URL)
+	v.CheckCode(wh.URL != "", "url", validator.CodeRequired, "must be provided")
+	v.CheckCode(len(wh.URL) <= 2000, "url", validator.CodeTooLong, "must not be more than 2000 bytes long")
+	v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "url", "must be an absolute http or https URL")
+	v.CheckCode(len(wh.Secret) >= 16, "secret", validator.CodeTooShort, "must be at least 16 bytes long")
+	v.CheckCode(len(wh.Secret) <= 256, "secret", validator.CodeTooLong, "must not be more than 256 bytes long")
+	v.CheckCode(len(wh.Events) >= 1, "events", validator.CodeTooShort, "must contain at least 1 event")
+	v.CheckCode(validator.Unique(wh.Events), "events", validator.CodeDuplicate, "must not contain duplicate values")
+	for _, e := range wh.Events {
+		v.Check(validator.In(e, events...), "events", fmt.Sprintf("unknown event %q", e))
+	}
+}
+
+// WebhookModel wraps a sql.DB connection pool
+type WebhookModel struct {
+	DB Handle
+}
+
+const webhookColumns = `id, created_at, created_by, url, secret, events, active, version`
+
+func scanWebhook(row interface{ Scan(...interface{}) error }, extra ...interface{}) (*Webhook, error) {
+	var (
+		wh        Webhook
+		createdBy sql.NullInt64
+	)
+	dest := append(extra,
+		&wh.ID, &wh.CreatedAt, &createdBy, &wh.URL, &wh.Secret,
+		pq.Array(&wh.Events), &wh.Active, &wh.Version)
+	err := row.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+	wh.CreatedBy = createdBy.Int64
+	return &wh, nil
+}
+
+func (m WebhookModel) Insert(wh *Webhook) error {
+	query := `
+        INSERT INTO webhooks (created_by, url, secret, events, active)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, version`
+	createdBy := sql.NullInt64{Int64: wh.CreatedBy, Valid: wh.CreatedBy != 0}
+	args := []interface{}{createdBy, wh.URL, wh.Secret, pq.Array(wh.Events), wh.Active}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&wh.ID, &wh.CreatedAt, &wh.Version)
+}
+
+func (m WebhookModel) Get(id int64) (*Webhook, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+        SELECT ` + webhookColumns + `
+		FROM webhooks
+		WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	wh, err := scanWebhook(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return wh, nil
+}
+
+func (m WebhookModel) GetAll(filter Filters) ([]*Webhook, Metadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), `+webhookColumns+`
+		FROM webhooks
+		ORDER BY %s %s, id ASC
+		LIMIT $1 OFFSET $2`, filter.sortColumn(), filter.sortDirection())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, filter.limit(), filter.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	whs := []*Webhook{}
+	for rows.Next() {
+		wh, err := scanWebhook(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		whs = append(whs, wh)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return whs, calculateMetadata(totalRecords, filter.Page, filter.PageSize), nil
+}
+
+// GetAllForEvent returns the active webhooks subscribed to event.
+func (m WebhookModel) GetAllForEvent(event string) ([]*Webhook, error) {
+	query := `
+        SELECT ` + webhookColumns + `
+		FROM webhooks
+		WHERE active AND events @> ARRAY[$1]
+		ORDER BY id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, event)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var whs []*Webhook
+	for rows.Next() {
+		wh, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		whs = append(whs, wh)
+	}
+	return whs, rows.Err()
+}
+
+func (m WebhookModel) Update(wh *Webhook) error {
+	query := `
+        UPDATE webhooks
+		SET url = $1, secret = $2, events = $3, active = $4, version = version + 1
+		WHERE id = $5 AND version = $6
+		RETURNING version`
+	args := []interface{}{wh.URL, wh.Secret, pq.Array(wh.Events), wh.Active, wh.ID, wh.Version}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&wh.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the webhook and its delivery log.
+func (m WebhookModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+        DELETE FROM webhooks
+		WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (m WebhookModel) InsertDelivery(d *WebhookDelivery) error {
+	query := `
+        INSERT INTO webhook_deliveries (webhook_id, event_id, event, attempt,
+		status_code, duration_ms, response, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at`
+	statusCode := sql.NullInt64{Int64: int64(d.StatusCode), Valid: d.StatusCode != 0}
+	args := []interface{}{d.WebhookID, d.EventID, d.Event, d.Attempt,
+		statusCode, d.DurationMS, d.Response, d.Error}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&d.ID, &d.CreatedAt)
+}
+
+// GetDeliveries lists the delivery attempts for a webhook, newest
+// first.
+func (m WebhookModel) GetDeliveries(webhookID int64, filter Filters) ([]*WebhookDelivery, Metadata, error) {
+	query := `
+        SELECT count(*) OVER(), id, created_at, webhook_id, event_id, event,
+		attempt, status_code, duration_ms, response, error
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, webhookID, filter.limit(), filter.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	ds := []*WebhookDelivery{}
+	for rows.Next() {
+		var (
+			d          WebhookDelivery
+			statusCode sql.NullInt64
+		)
+		err := rows.Scan(&totalRecords, &d.ID, &d.CreatedAt, &d.WebhookID, &d.EventID, &d.Event,
+			&d.Attempt, &statusCode, &d.DurationMS, &d.Response, &d.Error)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		d.StatusCode = int(statusCode.Int64)
+		ds = append(ds, &d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return ds, calculateMetadata(totalRecords, filter.Page, filter.PageSize), nil
+}
+
+// DeleteDeliveries removes delivery records older than age.
+func (m WebhookModel) DeleteDeliveries(ctx context.Context, age time.Duration) (int64, error) {
+	query := `
+        DELETE FROM webhook_deliveries
+		WHERE created_at < $1`
+	result, err := m.DB.ExecContext(ctx, query, time.Now().Add(-age))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
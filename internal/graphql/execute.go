@@ -0,0 +1,454 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Request is a GraphQL request as it's posted.
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Options limit what a request may run. A query deeper than MaxDepth
+// fields or costing more than MaxComplexity isn't run, the cost of a
+// field being 1 plus that of its selections times its Multiplier.
+// Zero means no limit. QueryOnly rejects mutations, for GET requests.
+type Options struct {
+	MaxDepth      int
+	MaxComplexity int
+	QueryOnly     bool
+}
+
+// Location is a position in the query, counted from 1.
+type Location struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// Error is an error of the response. Resolvers can return one to set
+// its extensions, its locations and path are filled in.
+type Error struct {
+	Message    string                 `json:"message"`
+	Locations  []Location             `json:"locations,omitempty"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// The codes of the errors found before a request is run.
+const (
+	CodeSyntaxError         = "syntax_error"
+	CodeInvalidQuery        = "invalid_query"
+	CodeInvalidVariables    = "invalid_variables"
+	CodeQueryTooDeep        = "query_too_deep"
+	CodeQueryTooComplex     = "query_too_complex"
+	CodeOperationNotAllowed = "operation_not_allowed"
+)
+
+// Response is the result of a request. Data is absent when the request
+// couldn't be run, and null when its errors nulled all of it.
+type Response struct {
+	Data   interface{} `json:"data,omitempty"`
+	Errors []*Error    `json:"errors,omitempty"`
+}
+
+func newError(src string, code string, pos int, format string, args ...interface{}) *Error {
+	return &Error{
+		Message:    fmt.Sprintf(format, args...),
+		Locations:  []Location{location(src, pos)},
+		Extensions: map[string]interface{}{"code": code},
+	}
+}
+
+func location(src string, pos int) Location {
+	if pos > len(src) {
+		pos = len(src)
+	}
+	before := src[:pos]
+	line := strings.Count(before, "\n") + 1
+	col := pos - strings.LastIndex(before, "\n")
+	return Location{Line: line, Column: col}
+}
+
+// Execute parses, validates and runs req against s.
+func Execute(ctx context.Context, s *Schema, req Request, opts Options) *Response {
+	doc, err := parse(req.Query)
+	if err != nil {
+		se := err.(*syntaxError)
+		return &Response{Errors: []*Error{newError(req.Query, CodeSyntaxError, se.pos, "%s", se.Error())}}
+	}
+	op, gerr := selectOperation(req.Query, doc, req.OperationName)
+	if gerr != nil {
+		return &Response{Errors: []*Error{gerr}}
+	}
+
+	var root *Object
+	switch op.kind {
+	case "query":
+		root = s.Query
+	case "mutation":
+		root = s.Mutation
+		if opts.QueryOnly {
+			return &Response{Errors: []*Error{newError(req.Query, CodeOperationNotAllowed, op.pos,
+				"mutations must be sent in a POST request")}}
+		}
+	}
+	if root == nil {
+		return &Response{Errors: []*Error{newError(req.Query, CodeInvalidQuery, op.pos,
+			"the schema doesn't support %s operations", op.kind)}}
+	}
+
+	vars, errs := coerceVariables(req.Query, s, op, req.Variables)
+	if len(errs) > 0 {
+		return &Response{Errors: errs}
+	}
+	c := &checker{
+		src:    req.Query,
+		schema: s,
+		doc:    doc,
+		vars:   vars,
+		defs:   make(map[string]*varDef),
+		opts:   opts,
+		args:   make(map[*field]map[string]interface{}),
+		frags:  make(map[string]bool),
+	}
+	for _, d := range op.vars {
+		c.defs[d.name] = d
+	}
+	c.selectionSet(root, op.selections, 1)
+	if len(c.errs) > 0 {
+		return &Response{Errors: c.errs}
+	}
+
+	e := &executor{ctx: ctx, src: req.Query, doc: doc, vars: vars, args: c.args}
+	data, ok := e.selectionSet(root, nil, op.selections, nil)
+	resp := &Response{Data: data, Errors: e.errs}
+	if !ok {
+		resp.Data = json.RawMessage("null")
+	}
+	return resp
+}
+
+func selectOperation(src string, doc *document, name string) (*operation, *Error) {
+	if name == "" {
+		if len(doc.operations) > 1 {
+			return nil, newError(src, CodeInvalidQuery, doc.operations[1].pos,
+				"operationName must be given for a document with several operations")
+		}
+		return doc.operations[0], nil
+	}
+	for _, op := range doc.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, &Error{
+		Message:    fmt.Sprintf("unknown operation named %q", name),
+		Extensions: map[string]interface{}{"code": CodeInvalidQuery},
+	}
+}
+
+// coerceVariables checks the values given for the variables of op, and
+// sets the defaults of those not given.
+func coerceVariables(src string, s *Schema, op *operation, given map[string]interface{}) (map[string]interface{}, []*Error) {
+	vars := make(map[string]interface{})
+	var errs []*Error
+	for _, d := range op.vars {
+		t, err := s.inputType(d.typ)
+		if err != nil {
+			errs = append(errs, newError(src, CodeInvalidQuery, d.pos, "variable $%s: %v", d.name, err))
+			continue
+		}
+		v, ok := given[d.name]
+		switch {
+		case !ok && d.hasDefault:
+			v, err = coerceInput(t, d.def, nil)
+		case !ok && isNonNull(t):
+			err = fmt.Errorf("of required type %s was not provided", t)
+		case !ok:
+			continue
+		default:
+			v, err = coerceInput(t, v, nil)
+		}
+		if err != nil {
+			errs = append(errs, newError(src, CodeInvalidVariables, d.pos, "variable $%s %v", d.name, err))
+			continue
+		}
+		vars[d.name] = v
+	}
+	return vars, errs
+}
+
+// coerceArgs coerces the arguments given to a field, or its directive,
+// to those defined.
+func coerceArgs(defs []*Arg, given []*argument, vars map[string]interface{}) (map[string]interface{}, error) {
+	for _, a := range given {
+		known := false
+		for _, d := range defs {
+			known = known || d.Name == a.name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown argument %q", a.name)
+		}
+	}
+	args := make(map[string]interface{})
+	for _, d := range defs {
+		var node *argument
+		for _, a := range given {
+			if a.name == d.Name {
+				node = a
+			}
+		}
+		// a variable that isn't set leaves the argument unset
+		if node != nil {
+			if name, ok := node.value.(variable); ok {
+				if _, set := vars[string(name)]; !set {
+					node = nil
+				}
+			}
+		}
+		if node == nil {
+			switch {
+			case d.Default != nil:
+				args[d.Name] = d.Default
+			case isNonNull(d.Type):
+				return nil, fmt.Errorf("argument %q of type %s is required", d.Name, d.Type)
+			}
+			continue
+		}
+		v, err := coerceInput(d.Type, node.value, vars)
+		if err != nil {
+			return nil, fmt.Errorf("argument %q: %v", d.Name, err)
+		}
+		args[d.Name] = v
+	}
+	return args, nil
+}
+
+var conditionArgs = []*Arg{{Name: "if", Type: &NonNull{Of: Boolean}}}
+
+// included evaluates the skip and include directives.
+func included(ds []*directive, vars map[string]interface{}) (bool, error) {
+	for _, d := range ds {
+		if d.name != "skip" && d.name != "include" {
+			return false, fmt.Errorf("unknown directive @%s", d.name)
+		}
+		args, err := coerceArgs(conditionArgs, d.args, vars)
+		if err != nil {
+			return false, fmt.Errorf("@%s: %v", d.name, err)
+		}
+		if args["if"].(bool) == (d.name == "skip") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// resultMap is an object of the response, its fields kept in the order
+// they were selected.
+type resultMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (m *resultMap) set(key string, v interface{}) {
+	m.keys = append(m.keys, key)
+	m.values[key] = v
+}
+
+func (m *resultMap) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range m.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		value, err := json.Marshal(m.values[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+type executor struct {
+	ctx  context.Context
+	src  string
+	doc  *document
+	vars map[string]interface{}
+	args map[*field]map[string]interface{}
+	errs []*Error
+}
+
+// collectFields groups the fields selected on an object of type t by
+// their response key, following fragments.
+func (e *executor) collectFields(t *Object, ss []selection, keys []string, groups map[string][]*field, seen map[string]bool) []string {
+	for _, s := range ss {
+		switch s := s.(type) {
+		case *field:
+			if ok, _ := included(s.directives, e.vars); !ok {
+				continue
+			}
+			key := s.responseKey()
+			if _, ok := groups[key]; !ok {
+				keys = append(keys, key)
+			}
+			groups[key] = append(groups[key], s)
+		case *inlineFragment:
+			if ok, _ := included(s.directives, e.vars); !ok {
+				continue
+			}
+			keys = e.collectFields(t, s.selections, keys, groups, seen)
+		case *fragmentSpread:
+			if ok, _ := included(s.directives, e.vars); !ok || seen[s.name] {
+				continue
+			}
+			seen[s.name] = true
+			keys = e.collectFields(t, e.doc.fragments[s.name].selections, keys, groups, seen)
+		}
+	}
+	return keys
+}
+
+// selectionSet resolves the fields selected on source, an object of
+// type t. It reports false when a field that can't be null is, so the
+// object has to be null instead.
+func (e *executor) selectionSet(t *Object, source interface{}, ss []selection, path []interface{}) (*resultMap, bool) {
+	groups := make(map[string][]*field)
+	keys := e.collectFields(t, ss, nil, groups, make(map[string]bool))
+	res := &resultMap{values: make(map[string]interface{}, len(keys))}
+	for _, key := range keys {
+		fields := groups[key]
+		f := fields[0]
+		if f.name == "__typename" {
+			res.set(key, t.Name)
+			continue
+		}
+		def := t.Fields[f.name]
+		fieldPath := make([]interface{}, len(path)+1)
+		copy(fieldPath, path)
+		fieldPath[len(path)] = key
+
+		v, err := e.resolve(def, source, f)
+		if err != nil {
+			e.fieldError(err, f, fieldPath)
+			if isNonNull(def.Type) {
+				return nil, false
+			}
+			res.set(key, nil)
+			continue
+		}
+		var sub []selection
+		for _, f := range fields {
+			sub = append(sub, f.selections...)
+		}
+		v, ok := e.complete(def.Type, sub, v, f, fieldPath)
+		if !ok {
+			if isNonNull(def.Type) {
+				return nil, false
+			}
+			v = nil
+		}
+		res.set(key, v)
+	}
+	return res, true
+}
+
+func (e *executor) resolve(def *Field, source interface{}, f *field) (interface{}, error) {
+	if def.Resolve == nil {
+		if m, ok := source.(map[string]interface{}); ok {
+			return m[f.name], nil
+		}
+		return nil, nil
+	}
+	return def.Resolve(ResolveParams{Context: e.ctx, Source: source, Args: e.args[f]})
+}
+
+func (e *executor) fieldError(err error, f *field, path []interface{}) {
+	ge := &Error{Message: err.Error()}
+	if fe, ok := err.(*Error); ok {
+		copied := *fe
+		ge = &copied
+	}
+	ge.Locations = []Location{location(e.src, f.pos)}
+	ge.Path = path
+	e.errs = append(e.errs, ge)
+}
+
+// complete turns v, resolved for a field of type t, into the value of
+// the response. It reports false when v is null because of an error.
+func (e *executor) complete(t Type, ss []selection, v interface{}, f *field, path []interface{}) (interface{}, bool) {
+	if nn, ok := t.(*NonNull); ok {
+		v, ok := e.complete(nn.Of, ss, v, f, path)
+		if ok && v == nil {
+			e.fieldError(fmt.Errorf("cannot return null for non-nullable field %s", f.name), f, path)
+			return nil, false
+		}
+		return v, ok
+	}
+	if isNil(v) {
+		return nil, true
+	}
+	switch t := t.(type) {
+	case *Scalar:
+		if t.Serialize != nil {
+			return t.Serialize(v), true
+		}
+		return v, true
+	case *Object:
+		m, ok := e.selectionSet(t, v, ss, path)
+		if !ok {
+			return nil, false
+		}
+		return m, true
+	case *List:
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			e.fieldError(fmt.Errorf("expected a list for field %s, got %T", f.name, v), f, path)
+			return nil, false
+		}
+		items := make([]interface{}, rv.Len())
+		for i := range items {
+			itemPath := make([]interface{}, len(path)+1)
+			copy(itemPath, path)
+			itemPath[len(path)] = i
+			item, ok := e.complete(t.Of, ss, rv.Index(i).Interface(), f, itemPath)
+			if !ok && isNonNull(t.Of) {
+				return nil, false
+			}
+			items[i] = item
+		}
+		return items, true
+	}
+	return nil, true
+}
+
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testMovie(id string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":     id,
+		"title":  "Movie " + id,
+		"genres": []interface{}{"drama"},
+	}
+}
+
+// testSchema is a small movie schema, with a self referencing field
+// for depth and a list field for complexity.
+func testSchema() *Schema {
+	movie := &Object{Name: "Movie"}
+	movie.Fields = map[string]*Field{
+		"id":     {Type: &NonNull{Of: ID}},
+		"title":  {Type: &NonNull{Of: String}},
+		"genres": {Type: &NonNull{Of: &List{Of: &NonNull{Of: String}}}},
+		"sequel": {Type: movie, Resolve: func(p ResolveParams) (interface{}, error) {
+			return testMovie(p.Source.(map[string]interface{})["id"].(string) + "1"), nil
+		}},
+	}
+	return &Schema{
+		Query: &Object{Name: "Query", Fields: map[string]*Field{
+			"movie": {
+				Type: movie,
+				Args: []*Arg{{Name: "id", Type: &NonNull{Of: ID}}},
+				Resolve: func(p ResolveParams) (interface{}, error) {
+					if p.Args["id"] == "0" {
+						return nil, nil
+					}
+					return testMovie(p.Args["id"].(string)), nil
+				},
+			},
+			"movies": {
+				Type: &NonNull{Of: &List{Of: &NonNull{Of: movie}}},
+				Args: []*Arg{{Name: "limit", Type: Int, Default: 10}},
+				Resolve: func(p ResolveParams) (interface{}, error) {
+					var ms []interface{}
+					for i := 0; i < p.Args["limit"].(int); i++ {
+						ms = append(ms, testMovie(string(rune('1'+i))))
+					}
+					return ms, nil
+				},
+				Multiplier: func(args map[string]interface{}) int {
+					n, _ := args["limit"].(int)
+					return n
+				},
+			},
+			"echo": {
+				Type: String,
+				Args: []*Arg{
+					{Name: "s", Type: String},
+					{Name: "n", Type: Int},
+					{Name: "list", Type: &List{Of: Int}},
+				},
+				Resolve: func(p ResolveParams) (interface{}, error) {
+					js, err := json.Marshal(p.Args)
+					return string(js), err
+				},
+			},
+			"fail": {Type: String, Resolve: func(p ResolveParams) (interface{}, error) {
+				return nil, &Error{Message: "denied", Extensions: map[string]interface{}{"code": "not_permitted"}}
+			}},
+			"mustFail": {Type: &NonNull{Of: String}, Resolve: func(p ResolveParams) (interface{}, error) {
+				return nil, errors.New("broken")
+			}},
+		}},
+		Mutation: &Object{Name: "Mutation", Fields: map[string]*Field{
+			"touch": {Type: Boolean, Resolve: func(p ResolveParams) (interface{}, error) {
+				return true, nil
+			}},
+		}},
+	}
+}
+
+func run(t *testing.T, req Request, opts Options) (string, *Response) {
+	t.Helper()
+	resp := Execute(context.Background(), testSchema(), req, opts)
+	js, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(js), resp
+}
+
+func TestExecute(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		vars  map[string]interface{}
+		want  string
+	}{
+		{"fields in query order", `{ movie(id: 7) { title id } }`,
+			nil, `{"data":{"movie":{"title":"Movie 7","id":"7"}}}`},
+		{"aliases", `{ a: movie(id: "1") { id } b: movie(id: "2") { id } }`,
+			nil, `{"data":{"a":{"id":"1"},"b":{"id":"2"}}}`},
+		{"null object", `{ movie(id: 0) { id } }`,
+			nil, `{"data":{"movie":null}}`},
+		{"nested", `{ movie(id: 1) { sequel { sequel { id } } } }`,
+			nil, `{"data":{"movie":{"sequel":{"sequel":{"id":"111"}}}}}`},
+		{"list", `{ movies(limit: 2) { id genres } }`,
+			nil, `{"data":{"movies":[{"id":"1","genres":["drama"]},{"id":"2","genres":["drama"]}]}}`},
+		{"fragments", `query { movie(id: 1) { ...f ... on Movie { title } } } fragment f on Movie { id }`,
+			nil, `{"data":{"movie":{"id":"1","title":"Movie 1"}}}`},
+		{"skip and include", `query($no: Boolean!) { movie(id: 1) { id @skip(if: true) title @include(if: $no) genres } }`,
+			map[string]interface{}{"no": false}, `{"data":{"movie":{"genres":["drama"]}}}`},
+		{"variables", `query($id: ID!) { movie(id: $id) { id } }`,
+			map[string]interface{}{"id": float64(5)}, `{"data":{"movie":{"id":"5"}}}`},
+		{"variable default", `query($n: Int = 3) { echo(n: $n) }`,
+			nil, `{"data":{"echo":"{\"n\":3}"}}`},
+		{"literals", `{ echo(s: """  block
+    string """, list: 4) }`,
+			nil, `{"data":{"echo":"{\"list\":[4],\"s\":\"  block\\nstring \"}"}}`},
+		{"typename", `{ __typename movie(id: 1) { __typename } }`,
+			nil, `{"data":{"__typename":"Query","movie":{"__typename":"Movie"}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := run(t, Request{Query: tt.query, Variables: tt.vars}, Options{})
+			if got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolverErrors(t *testing.T) {
+	got, _ := run(t, Request{Query: `{ movie(id: 1) { id } fail }`}, Options{})
+	want := `{"data":{"movie":{"id":"1"},"fail":null},"errors":[{"message":"denied","locations":[{"line":1,"column":23}],"path":["fail"],"extensions":{"code":"not_permitted"}}]}`
+	if got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+
+	// a non-null field's error nulls its parent, here all of data
+	got, _ = run(t, Request{Query: `{ movie(id: 1) { id } mustFail }`}, Options{})
+	want = `{"data":null,"errors":[{"message":"broken","locations":[{"line":1,"column":23}],"path":["mustFail"]}]}`
+	if got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestRequestErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		req   Request
+		opts  Options
+		code  string
+		match string
+	}{
+		{"syntax", Request{Query: "{ movie(id: 1) { id }"}, Options{}, CodeSyntaxError, "expected"},
+		{"unterminated string", Request{Query: `{ echo(s: "abc) }`}, Options{}, CodeSyntaxError, "string"},
+		{"bad number", Request{Query: `{ echo(n: 01) }`}, Options{}, CodeSyntaxError, ""},
+		{"unknown field", Request{Query: "{ nope }"}, Options{}, CodeInvalidQuery, `cannot query field "nope"`},
+		{"unknown argument", Request{Query: "{ movie(id: 1, x: 2) { id } }"}, Options{}, CodeInvalidQuery, `unknown argument "x"`},
+		{"missing argument", Request{Query: "{ movie { id } }"}, Options{}, CodeInvalidQuery, `argument "id" of type ID! is required`},
+		{"wrong argument type", Request{Query: `{ echo(n: "x") }`}, Options{}, CodeInvalidQuery, "Int cannot represent"},
+		{"int overflow", Request{Query: `{ echo(n: 3000000000) }`}, Options{}, CodeInvalidQuery, "32-bit"},
+		{"missing selection", Request{Query: "{ movie(id: 1) }"}, Options{}, CodeInvalidQuery, "must have a selection"},
+		{"leaf selection", Request{Query: "{ movie(id: 1) { id { x } } }"}, Options{}, CodeInvalidQuery, "must not have a selection"},
+		{"conflicting fields", Request{Query: "{ movie(id: 1) { id } movie(id: 2) { id } }"}, Options{}, CodeInvalidQuery, "conflict"},
+		{"unknown fragment", Request{Query: "{ movie(id: 1) { ...f } }"}, Options{}, CodeInvalidQuery, `unknown fragment "f"`},
+		{"fragment cycle", Request{Query: "{ movie(id: 1) { ...a } } fragment a on Movie { ...b } fragment b on Movie { ...a }"},
+			Options{}, CodeInvalidQuery, "within itself"},
+		{"fragment on wrong type", Request{Query: "{ movie(id: 1) { ... on Query { fail } } }"}, Options{}, CodeInvalidQuery, "cannot be spread"},
+		{"undefined variable", Request{Query: "{ movie(id: $id) { id } }"}, Options{}, CodeInvalidQuery, "$id is not defined"},
+		{"variable type", Request{Query: "query($id: ID) { movie(id: $id) { id } }"}, Options{}, CodeInvalidQuery, "used in position expecting ID!"},
+		{"missing variable", Request{Query: "query($id: ID!) { movie(id: $id) { id } }"}, Options{}, CodeInvalidVariables, "was not provided"},
+		{"bad variable", Request{Query: "query($n: Int) { echo(n: $n) }", Variables: map[string]interface{}{"n": "x"}},
+			Options{}, CodeInvalidVariables, "Int cannot represent"},
+		{"unknown operation", Request{Query: "query a { fail } query b { fail }", OperationName: "c"}, Options{}, CodeInvalidQuery, ""},
+		{"ambiguous operation", Request{Query: "query a { fail } query b { fail }"}, Options{}, CodeInvalidQuery, ""},
+		{"mutation over GET", Request{Query: "mutation { touch }"}, Options{QueryOnly: true}, CodeOperationNotAllowed, "POST"},
+		{"too deep", Request{Query: "{ movie(id: 1) { sequel { sequel { id } } } }"}, Options{MaxDepth: 3}, CodeQueryTooDeep, "3 fields deep"},
+		{"too complex", Request{Query: "{ movies(limit: 50) { id title sequel { id } } }"}, Options{MaxComplexity: 100}, CodeQueryTooComplex, "100"},
+		{"too complex by aliases", Request{Query: "{ a: movies(limit: 30) { id } b: movies(limit: 30) { id } c: movies(limit: 30) { id } d: movies(limit: 30) { id } }"},
+			Options{MaxComplexity: 100}, CodeQueryTooComplex, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			js, resp := run(t, tt.req, tt.opts)
+			if resp.Data != nil {
+				t.Errorf("the request ran: %s", js)
+			}
+			if len(resp.Errors) == 0 {
+				t.Fatalf("no errors: %s", js)
+			}
+			e := resp.Errors[0]
+			if e.Extensions["code"] != tt.code {
+				t.Errorf("got code %v, want %s: %s", e.Extensions["code"], tt.code, js)
+			}
+			if !strings.Contains(e.Message, tt.match) {
+				t.Errorf("got message %q, want it to contain %q", e.Message, tt.match)
+			}
+			for _, loc := range e.Locations {
+				if loc.Line < 1 || loc.Column < 1 {
+					t.Errorf("got location %+v", loc)
+				}
+			}
+		})
+	}
+}
+
+func TestLimitsAllowWithin(t *testing.T) {
+	opts := Options{MaxDepth: 3, MaxComplexity: 100}
+	for _, q := range []string{
+		"{ movie(id: 1) { sequel { id } } }",
+		"{ movies(limit: 10) { id title sequel { id } } }",
+	} {
+		js, resp := run(t, Request{Query: q}, opts)
+		if len(resp.Errors) > 0 {
+			t.Errorf("%s: %s", q, js)
+		}
+	}
+}
+
+func TestErrorLocation(t *testing.T) {
+	_, resp := run(t, Request{Query: "{\n  movie(id: 1) {\n    nope\n  }\n}"}, Options{})
+	if len(resp.Errors) != 1 {
+		t.Fatalf("got %d errors", len(resp.Errors))
+	}
+	if loc := resp.Errors[0].Locations[0]; loc != (Location{Line: 3, Column: 5}) {
+		t.Errorf("got location %+v, want 3:5", loc)
+	}
+}
@@ -0,0 +1,754 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The parser reads executable documents: operations and fragments,
+// with variables, aliases, arguments and the skip and include
+// directives. Type system definitions aren't accepted.
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokPunct
+	tokName
+	tokInt
+	tokFloat
+	tokString
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+// syntaxError is a parse failure at pos in the source.
+type syntaxError struct {
+	pos int
+	msg string
+}
+
+func (e *syntaxError) Error() string {
+	return "Syntax Error: " + e.msg
+}
+
+type lexer struct {
+	src string
+	pos int
+	tok token
+}
+
+func (l *lexer) errorf(pos int, format string, args ...interface{}) error {
+	return &syntaxError{pos: pos, msg: fmt.Sprintf(format, args...)}
+}
+
+// next reads the next token into l.tok, skipping whitespace, commas
+// and comments.
+func (l *lexer) next() error {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			l.pos++
+			continue
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' && l.src[l.pos] != '\r' {
+				l.pos++
+			}
+			continue
+		case strings.HasPrefix(l.src[l.pos:], "\uFEFF"):
+			l.pos += len("\uFEFF")
+			continue
+		}
+		break
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		l.tok = token{kind: tokEOF, pos: start}
+		return nil
+	}
+	c := l.src[l.pos]
+	switch {
+	case strings.IndexByte("!$()&:=@[]{}|", c) >= 0:
+		l.pos++
+		l.tok = token{kind: tokPunct, value: string(c), pos: start}
+		return nil
+	case c == '.':
+		if !strings.HasPrefix(l.src[l.pos:], "...") {
+			return l.errorf(start, "unexpected %q", ".")
+		}
+		l.pos += 3
+		l.tok = token{kind: tokPunct, value: "...", pos: start}
+		return nil
+	case c == '_' || isLetter(c):
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		l.tok = token{kind: tokName, value: l.src[start:l.pos], pos: start}
+		return nil
+	case c == '-' || isDigit(c):
+		return l.number()
+	case c == '"':
+		if strings.HasPrefix(l.src[l.pos:], `"""`) {
+			return l.blockString()
+		}
+		return l.string()
+	}
+	r, _ := utf8.DecodeRuneInString(l.src[l.pos:])
+	return l.errorf(start, "unexpected character %q", r)
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (l *lexer) digits() bool {
+	start := l.pos
+	for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+		l.pos++
+	}
+	return l.pos > start
+}
+
+func (l *lexer) number() error {
+	start := l.pos
+	kind := tokInt
+	if l.src[l.pos] == '-' {
+		l.pos++
+	}
+	intStart := l.pos
+	if !l.digits() {
+		return l.errorf(start, "invalid number")
+	}
+	if l.src[intStart] == '0' && l.pos-intStart > 1 {
+		return l.errorf(start, "invalid number, unexpected digit after 0")
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '.' {
+		kind = tokFloat
+		l.pos++
+		if !l.digits() {
+			return l.errorf(start, "invalid number, expected digit after \".\"")
+		}
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		kind = tokFloat
+		l.pos++
+		if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+			l.pos++
+		}
+		if !l.digits() {
+			return l.errorf(start, "invalid number, expected digit in exponent")
+		}
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == '_' || l.src[l.pos] == '.' || isLetter(l.src[l.pos])) {
+		return l.errorf(l.pos, "invalid number, unexpected %q", l.src[l.pos])
+	}
+	l.tok = token{kind: kind, value: l.src[start:l.pos], pos: start}
+	return nil
+}
+
+func (l *lexer) string() error {
+	start := l.pos
+	l.pos++
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '"':
+			l.pos++
+			l.tok = token{kind: tokString, value: b.String(), pos: start}
+			return nil
+		case c == '\n' || c == '\r':
+			return l.errorf(l.pos, "unterminated string")
+		case c == '\\':
+			if l.pos+1 >= len(l.src) {
+				return l.errorf(l.pos, "unterminated string")
+			}
+			esc := l.src[l.pos+1]
+			l.pos += 2
+			switch esc {
+			case '"', '\\', '/':
+				b.WriteByte(esc)
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if l.pos+4 > len(l.src) {
+					return l.errorf(l.pos, "invalid unicode escape")
+				}
+				n, err := strconv.ParseUint(l.src[l.pos:l.pos+4], 16, 16)
+				if err != nil {
+					return l.errorf(l.pos, "invalid unicode escape")
+				}
+				b.WriteRune(rune(n))
+				l.pos += 4
+			default:
+				return l.errorf(l.pos-2, "invalid escape \\%c", esc)
+			}
+		default:
+			b.WriteByte(c)
+			l.pos++
+		}
+	}
+	return l.errorf(start, "unterminated string")
+}
+
+// blockString reads a """ string, dropping the indentation common to
+// its lines and its leading and trailing blank lines.
+func (l *lexer) blockString() error {
+	start := l.pos
+	l.pos += 3
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		switch {
+		case strings.HasPrefix(l.src[l.pos:], `\"""`):
+			b.WriteString(`"""`)
+			l.pos += 4
+		case strings.HasPrefix(l.src[l.pos:], `"""`):
+			l.pos += 3
+			l.tok = token{kind: tokString, value: blockStringValue(b.String()), pos: start}
+			return nil
+		default:
+			b.WriteByte(l.src[l.pos])
+			l.pos++
+		}
+	}
+	return l.errorf(start, "unterminated block string")
+}
+
+func blockStringValue(raw string) string {
+	lines := strings.Split(strings.ReplaceAll(strings.ReplaceAll(raw, "\r\n", "\n"), "\r", "\n"), "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" {
+			continue
+		}
+		if n := len(line) - len(trimmed); indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	if indent > 0 {
+		for i := 1; i < len(lines); i++ {
+			if len(lines[i]) >= indent {
+				lines[i] = lines[i][indent:]
+			} else {
+				lines[i] = ""
+			}
+		}
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[0], " \t") == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[len(lines)-1], " \t") == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// The syntax tree. Values are int64, float64, string, bool, nil,
+// []interface{}, map[string]interface{}, enumValue or variable.
+
+type document struct {
+	operations []*operation
+	fragments  map[string]*fragment
+}
+
+type operation struct {
+	kind       string
+	name       string
+	vars       []*varDef
+	selections []selection
+	pos        int
+}
+
+type varDef struct {
+	name       string
+	typ        *typeRef
+	def        interface{}
+	hasDefault bool
+	pos        int
+}
+
+// typeRef is a type as written in a variable definition.
+type typeRef struct {
+	name    string
+	elem    *typeRef
+	nonNull bool
+}
+
+func (t *typeRef) String() string {
+	s := t.name
+	if t.elem != nil {
+		s = "[" + t.elem.String() + "]"
+	}
+	if t.nonNull {
+		s += "!"
+	}
+	return s
+}
+
+type selection interface{}
+
+type field struct {
+	alias      string
+	name       string
+	args       []*argument
+	directives []*directive
+	selections []selection
+	pos        int
+}
+
+func (f *field) responseKey() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+type argument struct {
+	name  string
+	value interface{}
+	pos   int
+}
+
+type directive struct {
+	name string
+	args []*argument
+	pos  int
+}
+
+type fragmentSpread struct {
+	name       string
+	directives []*directive
+	pos        int
+}
+
+type inlineFragment struct {
+	typeCond   string
+	directives []*directive
+	selections []selection
+	pos        int
+}
+
+type fragment struct {
+	name       string
+	typeCond   string
+	selections []selection
+	pos        int
+}
+
+type variable string
+
+type enumValue string
+
+type parser struct {
+	lexer
+}
+
+func parse(src string) (*document, error) {
+	p := &parser{lexer{src: src}}
+	err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	doc := &document{fragments: make(map[string]*fragment)}
+	for p.tok.kind != tokEOF {
+		switch {
+		case p.peek(tokPunct, "{"):
+			pos := p.tok.pos
+			ss, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &operation{kind: "query", selections: ss, pos: pos})
+		case p.peek(tokName, "query"), p.peek(tokName, "mutation"), p.peek(tokName, "subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.peek(tokName, "fragment"):
+			f, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := doc.fragments[f.name]; ok {
+				return nil, p.errorf(f.pos, "there can be only one fragment named %q", f.name)
+			}
+			doc.fragments[f.name] = f
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, p.errorf(0, "the document has no operation")
+	}
+	return doc, nil
+}
+
+func (p *parser) peek(kind tokenKind, value string) bool {
+	return p.tok.kind == kind && p.tok.value == value
+}
+
+func (p *parser) unexpected() error {
+	if p.tok.kind == tokEOF {
+		return p.errorf(p.tok.pos, "unexpected end of document")
+	}
+	return p.errorf(p.tok.pos, "unexpected %q", p.tok.value)
+}
+
+// skip consumes the punctuator value if it's next.
+func (p *parser) skip(value string) (bool, error) {
+	if !p.peek(tokPunct, value) {
+		return false, nil
+	}
+	return true, p.next()
+}
+
+func (p *parser) expect(value string) error {
+	if !p.peek(tokPunct, value) {
+		return p.errorf(p.tok.pos, "expected %q, found %s", value, p.describe())
+	}
+	return p.next()
+}
+
+func (p *parser) describe() string {
+	if p.tok.kind == tokEOF {
+		return "end of document"
+	}
+	return strconv.Quote(p.tok.value)
+}
+
+func (p *parser) name() (string, error) {
+	if p.tok.kind != tokName {
+		return "", p.errorf(p.tok.pos, "expected a name, found %s", p.describe())
+	}
+	name := p.tok.value
+	return name, p.next()
+}
+
+func (p *parser) operation() (*operation, error) {
+	op := &operation{kind: p.tok.value, pos: p.tok.pos}
+	err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind == tokName {
+		op.name, err = p.name()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ok, err := p.skip("("); err != nil {
+		return nil, err
+	} else if ok {
+		for !p.peek(tokPunct, ")") {
+			v, err := p.varDef()
+			if err != nil {
+				return nil, err
+			}
+			op.vars = append(op.vars, v)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	op.selections, err = p.selectionSet()
+	return op, err
+}
+
+func (p *parser) fragment() (*fragment, error) {
+	f := &fragment{pos: p.tok.pos}
+	err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if f.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if f.name == "on" {
+		return nil, p.errorf(f.pos, "a fragment can't be named \"on\"")
+	}
+	if !p.peek(tokName, "on") {
+		return nil, p.errorf(p.tok.pos, "expected \"on\", found %s", p.describe())
+	}
+	if err = p.next(); err != nil {
+		return nil, err
+	}
+	if f.typeCond, err = p.name(); err != nil {
+		return nil, err
+	}
+	if _, err = p.directives(); err != nil {
+		return nil, err
+	}
+	f.selections, err = p.selectionSet()
+	return f, err
+}
+
+func (p *parser) varDef() (*varDef, error) {
+	v := &varDef{pos: p.tok.pos}
+	err := p.expect("$")
+	if err != nil {
+		return nil, err
+	}
+	if v.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if err = p.expect(":"); err != nil {
+		return nil, err
+	}
+	if v.typ, err = p.typeRef(); err != nil {
+		return nil, err
+	}
+	if ok, err := p.skip("="); err != nil {
+		return nil, err
+	} else if ok {
+		v.hasDefault = true
+		if v.def, err = p.value(true); err != nil {
+			return nil, err
+		}
+	}
+	_, err = p.directives()
+	return v, err
+}
+
+func (p *parser) typeRef() (*typeRef, error) {
+	t := &typeRef{}
+	if ok, err := p.skip("["); err != nil {
+		return nil, err
+	} else if ok {
+		if t.elem, err = p.typeRef(); err != nil {
+			return nil, err
+		}
+		if err = p.expect("]"); err != nil {
+			return nil, err
+		}
+	} else if t.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	ok, err := p.skip("!")
+	t.nonNull = ok
+	return t, err
+}
+
+func (p *parser) selectionSet() ([]selection, error) {
+	err := p.expect("{")
+	if err != nil {
+		return nil, err
+	}
+	var ss []selection
+	for !p.peek(tokPunct, "}") {
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, s)
+	}
+	if len(ss) == 0 {
+		return nil, p.errorf(p.tok.pos, "a selection set must not be empty")
+	}
+	return ss, p.next()
+}
+
+func (p *parser) selection() (selection, error) {
+	pos := p.tok.pos
+	if ok, err := p.skip("..."); err != nil {
+		return nil, err
+	} else if ok {
+		if p.tok.kind == tokName && p.tok.value != "on" {
+			s := &fragmentSpread{pos: pos}
+			if s.name, err = p.name(); err != nil {
+				return nil, err
+			}
+			s.directives, err = p.directives()
+			return s, err
+		}
+		s := &inlineFragment{pos: pos}
+		if p.peek(tokName, "on") {
+			if err = p.next(); err != nil {
+				return nil, err
+			}
+			if s.typeCond, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if s.directives, err = p.directives(); err != nil {
+			return nil, err
+		}
+		s.selections, err = p.selectionSet()
+		return s, err
+	}
+
+	f := &field{pos: pos}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := p.skip(":"); err != nil {
+		return nil, err
+	} else if ok {
+		f.alias = name
+		if name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	f.name = name
+	if f.args, err = p.arguments(); err != nil {
+		return nil, err
+	}
+	if f.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if p.peek(tokPunct, "{") {
+		f.selections, err = p.selectionSet()
+	}
+	return f, err
+}
+
+func (p *parser) arguments() ([]*argument, error) {
+	ok, err := p.skip("(")
+	if err != nil || !ok {
+		return nil, err
+	}
+	var args []*argument
+	for !p.peek(tokPunct, ")") {
+		a := &argument{pos: p.tok.pos}
+		if a.name, err = p.name(); err != nil {
+			return nil, err
+		}
+		for _, other := range args {
+			if other.name == a.name {
+				return nil, p.errorf(a.pos, "there can be only one argument named %q", a.name)
+			}
+		}
+		if err = p.expect(":"); err != nil {
+			return nil, err
+		}
+		if a.value, err = p.value(false); err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+	}
+	return args, p.next()
+}
+
+func (p *parser) directives() ([]*directive, error) {
+	var ds []*directive
+	for p.peek(tokPunct, "@") {
+		d := &directive{pos: p.tok.pos}
+		err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if d.name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if d.args, err = p.arguments(); err != nil {
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// value reads a value literal, const ones can't hold variables.
+func (p *parser) value(isConst bool) (interface{}, error) {
+	tok := p.tok
+	switch tok.kind {
+	case tokInt:
+		n, err := strconv.ParseInt(tok.value, 10, 64)
+		if err != nil {
+			return nil, p.errorf(tok.pos, "integer %s out of range", tok.value)
+		}
+		return n, p.next()
+	case tokFloat:
+		f, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			return nil, p.errorf(tok.pos, "invalid float %s", tok.value)
+		}
+		return f, p.next()
+	case tokString:
+		return tok.value, p.next()
+	case tokName:
+		var v interface{}
+		switch tok.value {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			v = enumValue(tok.value)
+		}
+		return v, p.next()
+	case tokPunct:
+		switch tok.value {
+		case "$":
+			if isConst {
+				return nil, p.errorf(tok.pos, "unexpected variable in a constant value")
+			}
+			err := p.next()
+			if err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			return variable(name), err
+		case "[":
+			err := p.next()
+			if err != nil {
+				return nil, err
+			}
+			list := []interface{}{}
+			for !p.peek(tokPunct, "]") {
+				v, err := p.value(isConst)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			}
+			return list, p.next()
+		case "{":
+			err := p.next()
+			if err != nil {
+				return nil, err
+			}
+			obj := make(map[string]interface{})
+			for !p.peek(tokPunct, "}") {
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err = p.expect(":"); err != nil {
+					return nil, err
+				}
+				if obj[name], err = p.value(isConst); err != nil {
+					return nil, err
+				}
+			}
+			return obj, p.next()
+		}
+	}
+	return nil, p.unexpected()
+}
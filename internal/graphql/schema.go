@@ -0,0 +1,265 @@
+package graphql
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Type is a GraphQL type: a *Scalar, an *Object, or a *List or *NonNull
+// wrapping another type.
+type Type interface {
+	String() string
+}
+
+// Scalar is a leaf type. Coerce turns an input value, a literal of the
+// query or a JSON-decoded variable, into the value resolvers see.
+// Serialize, when set, turns a resolved value into the response's.
+type Scalar struct {
+	Name      string
+	Coerce    func(v interface{}) (interface{}, error)
+	Serialize func(v interface{}) interface{}
+}
+
+func (s *Scalar) String() string { return s.Name }
+
+// Object is a type with fields, whose values are chosen by selections.
+type Object struct {
+	Name   string
+	Fields map[string]*Field
+}
+
+func (o *Object) String() string { return o.Name }
+
+// List is a list of Of.
+type List struct {
+	Of Type
+}
+
+func (l *List) String() string { return "[" + l.Of.String() + "]" }
+
+// NonNull is an Of that can't be null.
+type NonNull struct {
+	Of Type
+}
+
+func (n *NonNull) String() string { return n.Of.String() + "!" }
+
+// ResolveFunc returns the value of a field. Errors it returns are
+// reported at the field's path, and the field is null.
+type ResolveFunc func(p ResolveParams) (interface{}, error)
+
+// ResolveParams are what a field is resolved from: the value of the
+// object it's on, and its coerced arguments.
+type ResolveParams struct {
+	Context context.Context
+	Source  interface{}
+	Args    map[string]interface{}
+}
+
+// Field is a field of an Object. A nil Resolve reads the field of the
+// same name from a map[string]interface{} source. Multiplier estimates
+// how many values a list field returns, from its arguments, for the
+// complexity of a query.
+type Field struct {
+	Type       Type
+	Args       []*Arg
+	Resolve    ResolveFunc
+	Multiplier func(args map[string]interface{}) int
+}
+
+// Arg is an argument of a field. A nil Default means none.
+type Arg struct {
+	Name    string
+	Type    Type
+	Default interface{}
+}
+
+// Schema is the entry points of every operation.
+type Schema struct {
+	Query    *Object
+	Mutation *Object
+
+	once  sync.Once
+	named map[string]Type
+}
+
+// The built-in scalars.
+var (
+	Int = &Scalar{
+		Name: "Int",
+		Coerce: func(v interface{}) (interface{}, error) {
+			var n float64
+			switch v := v.(type) {
+			case int64:
+				n = float64(v)
+			case float64:
+				n = v
+			default:
+				return nil, fmt.Errorf("Int cannot represent non-integer value: %s", describe(v))
+			}
+			if n != math.Trunc(n) || n > math.MaxInt32 || n < math.MinInt32 {
+				return nil, fmt.Errorf("Int cannot represent non 32-bit signed integer value: %s", describe(v))
+			}
+			return int(n), nil
+		},
+	}
+	Float = &Scalar{
+		Name: "Float",
+		Coerce: func(v interface{}) (interface{}, error) {
+			switch v := v.(type) {
+			case int64:
+				return float64(v), nil
+			case float64:
+				return v, nil
+			}
+			return nil, fmt.Errorf("Float cannot represent non numeric value: %s", describe(v))
+		},
+	}
+	String = &Scalar{
+		Name: "String",
+		Coerce: func(v interface{}) (interface{}, error) {
+			if s, ok := v.(string); ok {
+				return s, nil
+			}
+			return nil, fmt.Errorf("String cannot represent a non string value: %s", describe(v))
+		},
+	}
+	Boolean = &Scalar{
+		Name: "Boolean",
+		Coerce: func(v interface{}) (interface{}, error) {
+			if b, ok := v.(bool); ok {
+				return b, nil
+			}
+			return nil, fmt.Errorf("Boolean cannot represent a non boolean value: %s", describe(v))
+		},
+	}
+	// ID is coerced to a string, and serialized as one.
+	ID = &Scalar{
+		Name: "ID",
+		Coerce: func(v interface{}) (interface{}, error) {
+			switch v := v.(type) {
+			case string:
+				return v, nil
+			case int64:
+				return strconv.FormatInt(v, 10), nil
+			case float64:
+				if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+					return strconv.FormatInt(int64(v), 10), nil
+				}
+			}
+			return nil, fmt.Errorf("ID cannot represent value: %s", describe(v))
+		},
+		Serialize: func(v interface{}) interface{} {
+			switch v := v.(type) {
+			case int64:
+				return strconv.FormatInt(v, 10)
+			case int:
+				return strconv.Itoa(v)
+			case int32:
+				return strconv.FormatInt(int64(v), 10)
+			}
+			return v
+		},
+	}
+)
+
+var builtinScalars = map[string]*Scalar{
+	"Int": Int, "Float": Float, "String": String, "Boolean": Boolean, "ID": ID,
+}
+
+func describe(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(v)
+	case enumValue:
+		return string(v)
+	case variable:
+		return "$" + string(v)
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, e := range v {
+			parts[i] = describe(e)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		parts := make([]string, len(keys))
+		for i, k := range keys {
+			parts[i] = k + ": " + describe(v[k])
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	}
+	return fmt.Sprint(v)
+}
+
+func isNonNull(t Type) bool {
+	_, ok := t.(*NonNull)
+	return ok
+}
+
+// namedType strips the wrappers off t.
+func namedType(t Type) Type {
+	for {
+		switch w := t.(type) {
+		case *NonNull:
+			t = w.Of
+		case *List:
+			t = w.Of
+		default:
+			return t
+		}
+	}
+}
+
+// coerceInput turns v, a literal or a variable's value, into a value
+// of type t. vars are the operation's coerced variables, a variable
+// missing from them is null.
+func coerceInput(t Type, v interface{}, vars map[string]interface{}) (interface{}, error) {
+	if name, ok := v.(variable); ok {
+		v = vars[string(name)]
+		if v == nil && isNonNull(t) {
+			return nil, fmt.Errorf("variable $%s of type %s must not be null", name, t)
+		}
+		// a variable's value is already coerced to its own type
+		return v, nil
+	}
+	if nn, ok := t.(*NonNull); ok {
+		if v == nil {
+			return nil, fmt.Errorf("expected a value of type %s, found null", t)
+		}
+		return coerceInput(nn.Of, v, vars)
+	}
+	if v == nil {
+		return nil, nil
+	}
+	switch t := t.(type) {
+	case *List:
+		items, ok := v.([]interface{})
+		if !ok {
+			items = []interface{}{v}
+		}
+		list := make([]interface{}, len(items))
+		for i, item := range items {
+			c, err := coerceInput(t.Of, item, vars)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = c
+		}
+		return list, nil
+	case *Scalar:
+		return t.Coerce(v)
+	}
+	return nil, fmt.Errorf("%s is not an input type", t)
+}
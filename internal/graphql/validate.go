@@ -0,0 +1,282 @@
+package graphql
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// types returns the named types reachable from the schema.
+func (s *Schema) types() map[string]Type {
+	s.once.Do(func() {
+		s.named = make(map[string]Type)
+		for name, sc := range builtinScalars {
+			s.named[name] = sc
+		}
+		var walk func(t Type)
+		walk = func(t Type) {
+			t = namedType(t)
+			if _, ok := s.named[t.String()]; ok {
+				return
+			}
+			s.named[t.String()] = t
+			if o, ok := t.(*Object); ok {
+				for _, f := range o.Fields {
+					walk(f.Type)
+					for _, a := range f.Args {
+						walk(a.Type)
+					}
+				}
+			}
+		}
+		for _, root := range []*Object{s.Query, s.Mutation} {
+			if root != nil {
+				walk(root)
+			}
+		}
+	})
+	return s.named
+}
+
+// inputType finds the type a variable is declared with.
+func (s *Schema) inputType(ref *typeRef) (Type, error) {
+	var t Type
+	if ref.elem != nil {
+		elem, err := s.inputType(ref.elem)
+		if err != nil {
+			return nil, err
+		}
+		t = &List{Of: elem}
+	} else {
+		named, ok := s.types()[ref.name]
+		if !ok {
+			return nil, fmt.Errorf("unknown type %q", ref.name)
+		}
+		if _, ok := named.(*Scalar); !ok {
+			return nil, fmt.Errorf("type %q is not an input type", ref.name)
+		}
+		t = named
+	}
+	if ref.nonNull {
+		t = &NonNull{Of: t}
+	}
+	return t, nil
+}
+
+// checker validates the selections of an operation against the schema
+// before it runs, coercing the arguments of its fields on the way, and
+// works out its depth and complexity.
+type checker struct {
+	src    string
+	schema *Schema
+	doc    *document
+	vars   map[string]interface{}
+	defs   map[string]*varDef
+	opts   Options
+	args   map[*field]map[string]interface{}
+	frags  map[string]bool
+	errs   []*Error
+	// tooBig stops the walk once a limit is crossed, so a query can't
+	// make it do much more work than the limits allow.
+	tooBig bool
+}
+
+func (c *checker) errorf(code string, pos int, format string, args ...interface{}) {
+	c.errs = append(c.errs, newError(c.src, code, pos, format, args...))
+}
+
+// selectionSet checks the selections on type t, depth fields deep, and
+// returns their cost.
+func (c *checker) selectionSet(t *Object, ss []selection, depth int) int {
+	cost := 0
+	c.collect(t, ss, depth, make(map[string]*field), &cost)
+	return cost
+}
+
+func (c *checker) collect(t *Object, ss []selection, depth int, keys map[string]*field, cost *int) {
+	for _, s := range ss {
+		if c.tooBig {
+			return
+		}
+		switch s := s.(type) {
+		case *field:
+			c.directives(s.directives)
+			c.field(t, s, depth, keys, cost)
+		case *inlineFragment:
+			c.directives(s.directives)
+			if s.typeCond != "" && !c.typeCondition(t, s.typeCond, s.pos) {
+				continue
+			}
+			c.collect(t, s.selections, depth, keys, cost)
+		case *fragmentSpread:
+			c.directives(s.directives)
+			f, ok := c.doc.fragments[s.name]
+			if !ok {
+				c.errorf(CodeInvalidQuery, s.pos, "unknown fragment %q", s.name)
+				continue
+			}
+			if c.frags[s.name] {
+				c.errorf(CodeInvalidQuery, s.pos, "cannot spread fragment %q within itself", s.name)
+				continue
+			}
+			if !c.typeCondition(t, f.typeCond, s.pos) {
+				continue
+			}
+			c.frags[s.name] = true
+			c.collect(t, f.selections, depth, keys, cost)
+			delete(c.frags, s.name)
+		}
+	}
+}
+
+// typeCondition checks a fragment on type name can be spread on t. With
+// no interfaces or unions in the schema, only t itself can be.
+func (c *checker) typeCondition(t *Object, name string, pos int) bool {
+	cond, ok := c.schema.types()[name]
+	switch {
+	case !ok:
+		c.errorf(CodeInvalidQuery, pos, "unknown type %q", name)
+		return false
+	case cond != Type(t):
+		c.errorf(CodeInvalidQuery, pos, "fragment on %q cannot be spread here, as objects of type %q can never be of type %q",
+			name, t.Name, name)
+		return false
+	}
+	return true
+}
+
+func (c *checker) field(t *Object, f *field, depth int, keys map[string]*field, cost *int) {
+	key := f.responseKey()
+	if prev, ok := keys[key]; ok && (prev.name != f.name || argsKey(prev.args) != argsKey(f.args)) {
+		c.errorf(CodeInvalidQuery, f.pos, "fields %q conflict because they select different fields or arguments, use aliases", key)
+		return
+	}
+	keys[key] = f
+	if c.opts.MaxDepth > 0 && depth > c.opts.MaxDepth {
+		c.errorf(CodeQueryTooDeep, f.pos, "the query is nested more than %d fields deep", c.opts.MaxDepth)
+		c.tooBig = true
+		return
+	}
+
+	fieldCost := 1
+	defer func() {
+		*cost += fieldCost
+		if c.opts.MaxComplexity > 0 && *cost > c.opts.MaxComplexity && !c.tooBig {
+			c.errorf(CodeQueryTooComplex, f.pos, "the query costs more than the maximum of %d", c.opts.MaxComplexity)
+			c.tooBig = true
+		}
+	}()
+
+	if f.name == "__typename" {
+		if len(f.args) > 0 || f.selections != nil {
+			c.errorf(CodeInvalidQuery, f.pos, "field \"__typename\" takes no arguments or selections")
+		}
+		return
+	}
+	def, ok := t.Fields[f.name]
+	if !ok {
+		c.errorf(CodeInvalidQuery, f.pos, "cannot query field %q on type %q", f.name, t.Name)
+		return
+	}
+	for _, a := range f.args {
+		for _, d := range def.Args {
+			if d.Name == a.name {
+				c.variables(d.Type, a.value, a.pos, true)
+			}
+		}
+	}
+	args, err := coerceArgs(def.Args, f.args, c.vars)
+	if err != nil {
+		c.errorf(CodeInvalidQuery, f.pos, "field %q: %v", f.name, err)
+		return
+	}
+	c.args[f] = args
+
+	obj, isObj := namedType(def.Type).(*Object)
+	switch {
+	case isObj && f.selections == nil:
+		c.errorf(CodeInvalidQuery, f.pos, "field %q of type %q must have a selection of subfields", f.name, def.Type)
+	case !isObj && f.selections != nil:
+		c.errorf(CodeInvalidQuery, f.pos, "field %q must not have a selection since type %q has no subfields", f.name, def.Type)
+	case isObj:
+		n := 1
+		if def.Multiplier != nil {
+			n = def.Multiplier(args)
+		}
+		if n < 1 {
+			n = 1
+		}
+		child := c.selectionSet(obj, f.selections, depth+1)
+		if c.opts.MaxComplexity > 0 && n > c.opts.MaxComplexity {
+			n = c.opts.MaxComplexity
+		}
+		fieldCost += n * child
+	}
+}
+
+func (c *checker) directives(ds []*directive) {
+	for _, d := range ds {
+		for _, a := range d.args {
+			c.variables(conditionArgs[0].Type, a.value, a.pos, true)
+		}
+	}
+	if _, err := included(ds, c.vars); err != nil {
+		c.errorf(CodeInvalidQuery, ds[0].pos, "%v", err)
+	}
+}
+
+// variables checks the variables used in v, a value for a place of
+// type t, are defined with a type that fits it.
+func (c *checker) variables(t Type, v interface{}, pos int, top bool) {
+	switch v := v.(type) {
+	case variable:
+		d, ok := c.defs[string(v)]
+		if !ok {
+			c.errorf(CodeInvalidQuery, pos, "variable $%s is not defined", v)
+			return
+		}
+		ref := d.typ
+		// a default stands in for null where one isn't allowed
+		if top && !ref.nonNull && isNonNull(t) && d.hasDefault && d.def != nil {
+			ref = &typeRef{name: ref.name, elem: ref.elem, nonNull: true}
+		}
+		if !fits(ref, t) {
+			c.errorf(CodeInvalidQuery, pos, "variable $%s of type %s used in position expecting %s", v, d.typ, t)
+		}
+	case []interface{}:
+		if nn, ok := t.(*NonNull); ok {
+			t = nn.Of
+		}
+		if l, ok := t.(*List); ok {
+			for _, item := range v {
+				c.variables(l.Of, item, pos, false)
+			}
+		}
+	}
+}
+
+// fits reports whether a variable declared as ref can be used where a
+// t is expected.
+func fits(ref *typeRef, t Type) bool {
+	if nn, ok := t.(*NonNull); ok {
+		return ref.nonNull && fits(&typeRef{name: ref.name, elem: ref.elem}, nn.Of)
+	}
+	if ref.nonNull {
+		return fits(&typeRef{name: ref.name, elem: ref.elem}, t)
+	}
+	if l, ok := t.(*List); ok {
+		return ref.elem != nil && fits(ref.elem, l.Of)
+	}
+	return ref.elem == nil && ref.name == t.String()
+}
+
+// argsKey identifies a set of arguments, to tell whether two fields
+// with the same response key can be merged.
+func argsKey(args []*argument) string {
+	parts := make([]string, len(args))
+	for i, a := range args {
+		parts[i] = a.name + ":" + describe(a.value)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
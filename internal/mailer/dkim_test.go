@@ -0,0 +1,201 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func writeKey(t *testing.T, block *pem.Block) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "dkim.pem")
+	err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func testSigners(t *testing.T) map[string]*DKIMSigner {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"rsa-sha256": writeKey(t, &pem.Block{
+			Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}),
+		"ed25519-sha256": writeKey(t, &pem.Block{Type: "PRIVATE KEY", Bytes: edDER}),
+	}
+	signers := make(map[string]*DKIMSigner)
+	for alg, file := range files {
+		s, err := NewDKIMSigner(file, "greenlight.example.com", "mail")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.algorithm() != alg {
+			t.Fatalf("got algorithm %s, want %s", s.algorithm(), alg)
+		}
+		signers[alg] = s
+	}
+	return signers
+}
+
+// signedWelcome sends the sample welcome mail signed by s.
+func signedWelcome(t *testing.T, s *DKIMSigner) []byte {
+	t.Helper()
+	transport := NewMemoryTransport()
+	m, err := New(transport, testSender, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Send("bob@example.com", "en", "user_welcome.tmpl", m.SampleData("user_welcome.tmpl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transport.Last().Raw
+}
+
+func TestDKIMSignVerify(t *testing.T) {
+	for alg, s := range testSigners(t) {
+		t.Run(alg, func(t *testing.T) {
+			raw := signedWelcome(t, s)
+			if !bytes.HasPrefix(raw, []byte("DKIM-Signature: v=1; a="+alg)) {
+				t.Fatalf("message is not signed:\n%s", raw)
+			}
+			err := VerifyDKIM(raw, s.PublicKey())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			other := testSigners(t)[alg]
+			err = VerifyDKIM(raw, other.PublicKey())
+			if !errors.Is(err, ErrDKIMSignature) {
+				t.Errorf("verified with the wrong key: %v", err)
+			}
+
+			tampered := bytes.Replace(raw, []byte("your user ID number is 1"), []byte("your user ID number is 2"), 1)
+			err = VerifyDKIM(tampered, s.PublicKey())
+			if !errors.Is(err, ErrDKIMBodyHash) {
+				t.Errorf("tampered body: got %v, want %v", err, ErrDKIMBodyHash)
+			}
+
+			tampered = bytes.Replace(raw, []byte("Subject: Welcome"), []byte("Subject: Farewell"), 1)
+			err = VerifyDKIM(tampered, s.PublicKey())
+			if !errors.Is(err, ErrDKIMSignature) {
+				t.Errorf("tampered subject: got %v, want %v", err, ErrDKIMSignature)
+			}
+
+			// a Subject added below the signed one is the one a
+			// verifier checks, so it must break the signature
+			i := bytes.Index(raw, []byte("\r\n\r\n"))
+			added := append(append(append([]byte{}, raw[:i]...), "\r\nSubject: Farewell"...), raw[i:]...)
+			err = VerifyDKIM(added, s.PublicKey())
+			if !errors.Is(err, ErrDKIMSignature) {
+				t.Errorf("added subject: got %v, want %v", err, ErrDKIMSignature)
+			}
+		})
+	}
+}
+
+func TestDKIMUnsigned(t *testing.T) {
+	raw := signedWelcome(t, nil)
+	err := VerifyDKIM(raw, nil)
+	if !errors.Is(err, ErrDKIMNoSignature) {
+		t.Errorf("got %v, want %v", err, ErrDKIMNoSignature)
+	}
+}
+
+func TestDNSRecord(t *testing.T) {
+	for alg, s := range testSigners(t) {
+		record, err := s.DNSRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "v=DKIM1; k=" + strings.TrimSuffix(alg, "-sha256") + "; p="
+		if !strings.HasPrefix(record, want) {
+			t.Errorf("got %q, want prefix %q", record, want)
+		}
+	}
+}
+
+func TestFindHeaderTakesLast(t *testing.T) {
+	headers := []string{"Subject: first", "To: bob@example.com", "subject: last"}
+	h, ok := findHeader(headers, "Subject")
+	if !ok || h != "subject: last" {
+		t.Errorf("findHeader = %q, %v", h, ok)
+	}
+	h, ok = firstHeader(headers, "Subject")
+	if !ok || h != "Subject: first" {
+		t.Errorf("firstHeader = %q, %v", h, ok)
+	}
+	if _, ok := findHeader(headers, "From"); ok {
+		t.Error("found a missing header")
+	}
+}
+
+func TestListUnsubscribe(t *testing.T) {
+	for alg, s := range testSigners(t) {
+		t.Run(alg, func(t *testing.T) {
+			transport := NewMemoryTransport()
+			m, err := New(transport, testSender, s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.templates["newsletter.tmpl"] = template.Must(template.New("email").Parse(
+				`{{define "subject"}}News{{end}}` +
+					`{{define "plainBody"}}news{{end}}` +
+					`{{define "htmlBody"}}<p>news</p>{{end}}` +
+					`{{define "listUnsubscribe"}} <https://greenlight.example.com/unsubscribe/{{.token}}> {{end}}`))
+			err = m.Send("bob@example.com", "en", "newsletter.tmpl", map[string]interface{}{"token": "abc"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := transport.Last()
+			if msg.ListUnsubscribe != "<https://greenlight.example.com/unsubscribe/abc>" {
+				t.Errorf("got ListUnsubscribe %q", msg.ListUnsubscribe)
+			}
+			for _, h := range []string{
+				"List-Unsubscribe: <https://greenlight.example.com/unsubscribe/abc>\r\n",
+				"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n",
+			} {
+				if !bytes.Contains(msg.Raw, []byte(h)) {
+					t.Errorf("missing header %q in:\n%s", h, msg.Raw)
+				}
+			}
+			if !strings.Contains(string(msg.Raw[:bytes.Index(msg.Raw, []byte("\r\n"))]), "list-unsubscribe:list-unsubscribe-post") {
+				t.Error("List-Unsubscribe headers are not signed")
+			}
+			err = VerifyDKIM(msg.Raw, s.PublicKey())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			transport.Reset()
+			err = m.Send("bob@example.com", "en", "user_welcome.tmpl", m.SampleData("user_welcome.tmpl"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(transport.Last().Raw, []byte("List-Unsubscribe")) {
+				t.Error("transactional mail has a List-Unsubscribe header")
+			}
+		})
+	}
+}
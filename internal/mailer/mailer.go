@@ -3,66 +3,318 @@ package mailer
 import (
 	"bytes"
 	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
 	"text/template"
 	"time"
-
-	"github.com/go-mail/mail/v2"
 )
 
 //go:embed "templates"
 var templateFS embed.FS
 
-// Mailer contains a mail.Dialer instance (used to
-// connect to a SMTP server) and the sender information
-type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+// DefaultLocale is the locale of the un-suffixed templates,
+// e.g. user_welcome.tmpl.
+const DefaultLocale = "en"
+
+// dateLayouts are the token expiry formats per language,
+// anything missing falls back to the DefaultLocale layout.
+var dateLayouts = map[string]string{
+	"en": "January 2, 2006 at 15:04 MST",
+	"zh": "2006年1月2日 15:04 MST",
+}
+
+// blocks are the templates every mail template must define.
+var blocks = []string{"subject", "plainBody", "htmlBody"}
+
+// RenderError reports which template and block failed to render.
+type RenderError struct {
+	Template string
+	Block    string
+	Err      error
 }
 
-// New a Mailer instance
-func New(host string, port int, username, password, sender string) Mailer {
-	dialer := mail.NewDialer(host, port, username, password)
-	dialer.Timeout = 5 * time.Second
-	return Mailer{
-		dialer: dialer,
-		sender: sender,
+func (e *RenderError) Error() string {
+	if e.Block == "" {
+		return fmt.Sprintf("%s: %v", e.Template, e.Err)
 	}
+	return fmt.Sprintf("%s: %s: %v", e.Template, e.Block, e.Err)
+}
+
+func (e *RenderError) Unwrap() error {
+	return e.Err
+}
+
+// TemplateInfo describes an embedded template and its translations.
+type TemplateInfo struct {
+	Name    string   `json:"name"`
+	Locales []string `json:"locales"`
 }
 
-func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
-	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+// Message is a rendered email, ready to be handed to a Transport.
+// ListUnsubscribe is only set for non-transactional mail, whose
+// template defines a "listUnsubscribe" block; the embedded templates
+// are all transactional so none does yet. Raw is the final MIME
+// encoding, DKIM signature included, filled in by Mailer.Deliver.
+type Message struct {
+	From            string
+	To              string
+	Subject         string
+	PlainBody       string
+	HTMLBody        string
+	MessageID       string
+	Date            time.Time
+	ListUnsubscribe string
+	Raw             []byte
+}
+
+// Transport delivers rendered messages.
+type Transport interface {
+	Send(msg *Message) error
+}
+
+// Mailer renders the embedded templates and hands the
+// result to a Transport along with the sender information
+type Mailer struct {
+	transport Transport
+	sender    string
+	signer    *DKIMSigner
+	templates map[string]*template.Template
+}
+
+// New a Mailer instance. Every embedded template is parsed once here,
+// checked for the subject, plainBody and htmlBody blocks and rendered
+// against its sample data, so a broken template stops the server from
+// starting instead of failing a user's request later. signer may be
+// nil to send unsigned mail.
+func New(transport Transport, sender string, signer *DKIMSigner) (Mailer, error) {
+	m := Mailer{
+		transport: transport,
+		sender:    sender,
+		signer:    signer,
+		templates: make(map[string]*template.Template),
+	}
+	entries, err := fs.ReadDir(templateFS, "templates")
 	if err != nil {
-		return err
+		return Mailer{}, err
 	}
-	subject := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(subject, "subject", data)
+	for _, e := range entries {
+		name := e.Name()
+		tmpl, err := parseTemplate(name)
+		if err != nil {
+			return Mailer{}, err
+		}
+		m.templates[name] = tmpl
+
+		sample, ok := sampleData[baseName(name)]
+		if !ok {
+			return Mailer{}, &RenderError{Template: name, Err: errors.New("no sample data declared")}
+		}
+		_, err = m.execute(name, "", sample)
+		if err != nil {
+			return Mailer{}, err
+		}
+	}
+	return m, nil
+}
+
+// parseTemplate parses one file of templateFS, with formatDate
+// bound to the locale the file is written in.
+func parseTemplate(name string) (*template.Template, error) {
+	funcs := template.FuncMap{"formatDate": formatDate(fileLocale(name))}
+	tmpl, err := template.New("email").Funcs(funcs).Option("missingkey=error").
+		ParseFS(templateFS, "templates/"+name)
 	if err != nil {
-		return err
+		return nil, &RenderError{Template: name, Err: err}
+	}
+	for _, block := range blocks {
+		if tmpl.Lookup(block) == nil {
+			return nil, &RenderError{Template: name, Block: block, Err: errors.New("block is not defined")}
+		}
+	}
+	return tmpl, nil
+}
+
+// baseName maps user_welcome.zh.tmpl to user_welcome.tmpl.
+func baseName(name string) string {
+	parts := strings.Split(name, ".")
+	if len(parts) == 3 {
+		return parts[0] + ".tmpl"
+	}
+	return name
+}
+
+func fileLocale(name string) string {
+	parts := strings.Split(name, ".")
+	if len(parts) == 3 {
+		return parts[1]
+	}
+	return DefaultLocale
+}
+
+// Locales lists every locale at least one template is translated to,
+// including DefaultLocale.
+func (m Mailer) Locales() []string {
+	seen := map[string]bool{DefaultLocale: true}
+	for name := range m.templates {
+		seen[fileLocale(name)] = true
 	}
-	plainBody := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
+	locales := make([]string, 0, len(seen))
+	for l := range seen {
+		locales = append(locales, l)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Templates lists the embedded templates by their default file
+// name, along with the locales each one is available in.
+func (m Mailer) Templates() []TemplateInfo {
+	byName := make(map[string][]string)
+	for name := range m.templates {
+		base := baseName(name)
+		byName[base] = append(byName[base], fileLocale(name))
+	}
+	infos := make([]TemplateInfo, 0, len(byName))
+	for name, locales := range byName {
+		sort.Strings(locales)
+		infos = append(infos, TemplateInfo{Name: name, Locales: locales})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// HasTemplate reports whether templateFile exists in its default locale.
+func (m Mailer) HasTemplate(templateFile string) bool {
+	_, ok := m.templates[templateFile]
+	return ok && baseName(templateFile) == templateFile
+}
+
+// SampleData returns the data templateFile is checked against at
+// startup, a copy the caller may change.
+func (m Mailer) SampleData(templateFile string) map[string]interface{} {
+	sample := make(map[string]interface{})
+	for k, v := range sampleData[baseName(templateFile)] {
+		sample[k] = v
+	}
+	return sample
+}
+
+// resolveTemplate picks the most specific translation of templateFile
+// for locale: "pt-br" tries name.pt-br.tmpl, then name.pt.tmpl, then
+// the default name.tmpl.
+func (m Mailer) resolveTemplate(templateFile, locale string) string {
+	base := strings.TrimSuffix(templateFile, ".tmpl")
+	locale = strings.ToLower(locale)
+	for locale != "" && locale != DefaultLocale {
+		name := base + "." + locale + ".tmpl"
+		if _, ok := m.templates[name]; ok {
+			return name
+		}
+		i := strings.LastIndex(locale, "-")
+		if i < 0 {
+			break
+		}
+		locale = locale[:i]
+	}
+	return templateFile
+}
+
+// formatDate renders t, or an RFC 3339 string of it as stored in the
+// outbox, in the date layout of locale.
+func formatDate(locale string) func(interface{}) string {
+	layout, ok := dateLayouts[strings.ToLower(locale)]
+	if !ok {
+		layout, ok = dateLayouts[strings.SplitN(strings.ToLower(locale), "-", 2)[0]]
+	}
+	if !ok {
+		layout = dateLayouts[DefaultLocale]
+	}
+	return func(v interface{}) string {
+		switch t := v.(type) {
+		case time.Time:
+			return t.Format(layout)
+		case string:
+			parsed, err := time.Parse(time.RFC3339Nano, t)
+			if err != nil {
+				return t
+			}
+			return parsed.Format(layout)
+		default:
+			return ""
+		}
+	}
+}
+
+func (m Mailer) execute(name, recipient string, data interface{}) (*Message, error) {
+	tmpl, ok := m.templates[name]
+	if !ok {
+		return nil, &RenderError{Template: name, Err: errors.New("template does not exist")}
+	}
+	out := make(map[string]string, len(blocks)+1)
+	for _, block := range append(blocks, "listUnsubscribe") {
+		if tmpl.Lookup(block) == nil {
+			continue
+		}
+		buf := new(bytes.Buffer)
+		err := tmpl.ExecuteTemplate(buf, block, data)
+		if err != nil {
+			return nil, &RenderError{Template: name, Block: block, Err: err}
+		}
+		out[block] = buf.String()
+	}
+	return &Message{
+		From:            m.sender,
+		To:              recipient,
+		Subject:         out["subject"],
+		PlainBody:       out["plainBody"],
+		HTMLBody:        out["htmlBody"],
+		ListUnsubscribe: strings.TrimSpace(out["listUnsubscribe"]),
+	}, nil
+}
+
+// Render executes the subject, plainBody and htmlBody blocks of the
+// locale's translation of templateFile against data. Fields missing
+// from data are an error rather than "<no value>". Failures are
+// returned as a *RenderError.
+func (m Mailer) Render(recipient, locale, templateFile string, data interface{}) (*Message, error) {
+	return m.execute(m.resolveTemplate(templateFile, locale), recipient, data)
+}
+
+func (m Mailer) Send(recipient, locale, templateFile string, data interface{}) error {
+	msg, err := m.Render(recipient, locale, templateFile, data)
 	if err != nil {
 		return err
 	}
-	htmlBody := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
+	return m.Deliver(msg)
+}
+
+// Deliver stamps a rendered message with its Message-ID and Date,
+// encodes and DKIM signs it, then hands it to the transport.
+func (m Mailer) Deliver(msg *Message) error {
+	if msg.MessageID == "" {
+		id, err := messageID(msg.From)
+		if err != nil {
+			return err
+		}
+		msg.MessageID = id
+	}
+	if msg.Date.IsZero() {
+		msg.Date = time.Now()
+	}
+	buf := new(bytes.Buffer)
+	_, err := mimeMessage(msg).WriteTo(buf)
 	if err != nil {
 		return err
 	}
-
-	msg := mail.NewMessage()
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
-
-	for i := 1; i <= 3; i++ {
-		err = m.dialer.DialAndSend(msg)
-		if nil == err {
-			return nil
+	msg.Raw = buf.Bytes()
+	if m.signer != nil {
+		msg.Raw, err = m.signer.Sign(msg.Raw)
+		if err != nil {
+			return err
 		}
-		time.Sleep(500 * time.Millisecond)
 	}
-	return err
+	return m.transport.Send(msg)
 }
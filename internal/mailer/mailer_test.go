@@ -0,0 +1,115 @@
+package mailer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testSender = "Greenlight <no-reply@greenlight.example.com>"
+
+func newTestMailer(t *testing.T) (Mailer, *MemoryTransport) {
+	t.Helper()
+	transport := NewMemoryTransport()
+	m, err := New(transport, testSender, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, transport
+}
+
+func TestSendRendersTemplates(t *testing.T) {
+	m, transport := newTestMailer(t)
+	tests := []struct {
+		template string
+		locale   string
+		subject  string
+		contains []string
+	}{
+		{"user_welcome.tmpl", "en", "Welcome to Greenlight!",
+			[]string{"your user ID number is 1", "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU", "June 16, 2021 at 09:30 UTC"}},
+		{"user_welcome.tmpl", "zh", "欢迎加入 Greenlight！",
+			[]string{"您的用户 ID 是 1", "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU", "2021年6月16日 09:30 UTC"}},
+		{"token_activation.tmpl", "en", "Activate your Greenlight account",
+			[]string{"Y3QMGX3PJ3WLRL2YRTQGQ6KRHU", "June 16, 2021 at 09:30 UTC"}},
+		{"token_password_reset.tmpl", "zh-CN", "重置您的 Greenlight 密码",
+			[]string{"Y3QMGX3PJ3WLRL2YRTQGQ6KRHU", "2021年6月16日 09:30 UTC"}},
+		{"user_invitation.tmpl", "fr", "You have been invited to Greenlight",
+			[]string{"Alice Smith", "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template+"/"+tt.locale, func(t *testing.T) {
+			transport.Reset()
+			err := m.Send("bob@example.com", tt.locale, tt.template, m.SampleData(tt.template))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := transport.Last()
+			if msg == nil {
+				t.Fatal("no message was sent")
+			}
+			if msg.To != "bob@example.com" || msg.From != testSender {
+				t.Errorf("got To %q From %q", msg.To, msg.From)
+			}
+			if msg.Subject != tt.subject {
+				t.Errorf("got subject %q, want %q", msg.Subject, tt.subject)
+			}
+			if !strings.Contains(msg.HTMLBody, "<html>") {
+				t.Errorf("html body is not HTML:\n%s", msg.HTMLBody)
+			}
+			if strings.Contains(msg.PlainBody, "<p>") {
+				t.Errorf("plain body contains HTML:\n%s", msg.PlainBody)
+			}
+			for _, want := range tt.contains {
+				if !strings.Contains(msg.PlainBody, want) {
+					t.Errorf("plain body misses %q:\n%s", want, msg.PlainBody)
+				}
+				if !strings.Contains(msg.HTMLBody, want) {
+					t.Errorf("html body misses %q:\n%s", want, msg.HTMLBody)
+				}
+			}
+			if msg.MessageID == "" || msg.Date.IsZero() || len(msg.Raw) == 0 {
+				t.Errorf("message was not stamped and encoded: %+v", msg)
+			}
+		})
+	}
+}
+
+func TestRenderMissingField(t *testing.T) {
+	m, _ := newTestMailer(t)
+	_, err := m.Render("bob@example.com", "en", "user_welcome.tmpl", map[string]interface{}{
+		"activationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+	})
+	var renderErr *RenderError
+	if !errors.As(err, &renderErr) {
+		t.Fatalf("got %v, want a *RenderError", err)
+	}
+	if renderErr.Template != "user_welcome.tmpl" || renderErr.Block == "" {
+		t.Errorf("got %+v", renderErr)
+	}
+}
+
+func TestRenderUnknownTemplate(t *testing.T) {
+	m, _ := newTestMailer(t)
+	_, err := m.Render("bob@example.com", "en", "nope.tmpl", nil)
+	var renderErr *RenderError
+	if !errors.As(err, &renderErr) {
+		t.Fatalf("got %v, want a *RenderError", err)
+	}
+}
+
+func TestResolveTemplate(t *testing.T) {
+	m, _ := newTestMailer(t)
+	tests := map[string]string{
+		"":      "user_welcome.tmpl",
+		"en":    "user_welcome.tmpl",
+		"zh":    "user_welcome.zh.tmpl",
+		"ZH-tw": "user_welcome.zh.tmpl",
+		"de-at": "user_welcome.tmpl",
+	}
+	for locale, want := range tests {
+		if got := m.resolveTemplate("user_welcome.tmpl", locale); got != want {
+			t.Errorf("resolveTemplate(%q) = %q, want %q", locale, got, want)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package mailer
+
+import "time"
+
+var sampleExpiry = time.Date(2021, time.June, 16, 9, 30, 0, 0, time.UTC)
+
+// sampleData declares the fields each template is rendered with, every
+// template and its translations are dry-run against it by New. A new
+// template must be added here, or the server refuses to start.
+var sampleData = map[string]map[string]interface{}{
+	"token_activation.tmpl": {
+		"activationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"tokenExpiry":     sampleExpiry,
+	},
+	"token_password_reset.tmpl": {
+		"passwordResetToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"tokenExpiry":        sampleExpiry,
+	},
+	"user_invitation.tmpl": {
+		"invitationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"inviterName":     "Alice Smith",
+		"tokenExpiry":     sampleExpiry,
+	},
+	"user_welcome.tmpl": {
+		"activationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"tokenExpiry":     sampleExpiry,
+		"userID":          int64(1),
+	},
+}
@@ -0,0 +1,171 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-mail/mail/v2"
+)
+
+// mimeMessage builds the MIME representation of msg.
+func mimeMessage(msg *Message) *mail.Message {
+	mm := mail.NewMessage()
+	mm.SetHeader("To", msg.To)
+	mm.SetHeader("From", msg.From)
+	mm.SetHeader("Subject", msg.Subject)
+	mm.SetHeader("Message-ID", msg.MessageID)
+	mm.SetDateHeader("Date", msg.Date)
+	if msg.ListUnsubscribe != "" {
+		mm.SetHeader("List-Unsubscribe", msg.ListUnsubscribe)
+		if strings.Contains(msg.ListUnsubscribe, "<https://") {
+			mm.SetHeader("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+		}
+	}
+	mm.SetBody("text/plain", msg.PlainBody)
+	mm.AddAlternative("text/html", msg.HTMLBody)
+	return mm
+}
+
+type rawMessage []byte
+
+func (r rawMessage) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(r)
+	return int64(n), err
+}
+
+// SMTPTransport sends messages through an SMTP server.
+type SMTPTransport struct {
+	dialer *mail.Dialer
+}
+
+// NewSMTPTransport creates a SMTPTransport
+func NewSMTPTransport(host string, port int, username, password string) *SMTPTransport {
+	dialer := mail.NewDialer(host, port, username, password)
+	dialer.Timeout = 5 * time.Second
+	return &SMTPTransport{dialer: dialer}
+}
+
+func (t *SMTPTransport) Send(msg *Message) error {
+	from, err := netmail.ParseAddress(msg.From)
+	if err != nil {
+		return err
+	}
+	to, err := netmail.ParseAddress(msg.To)
+	if err != nil {
+		return err
+	}
+	s, err := t.dialer.Dial()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.Send(from.Address, []string{to.Address}, rawMessage(msg.Raw))
+}
+
+// FileTransport writes each message as an .eml file
+// in a directory, handy during development.
+type FileTransport struct {
+	dir string
+	seq uint64
+}
+
+// NewFileTransport creates dir if needed and returns a FileTransport writing into it.
+func NewFileTransport(dir string) (*FileTransport, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileTransport{dir: dir}, nil
+}
+
+func (t *FileTransport) Send(msg *Message) error {
+	n := atomic.AddUint64(&t.seq, 1)
+	to := strings.NewReplacer("@", "_at_", "/", "_", "\\", "_").Replace(msg.To)
+	name := fmt.Sprintf("%s-%04d-%s.eml", time.Now().UTC().Format("20060102T150405"), n, to)
+	f, err := os.Create(filepath.Join(t.dir, name))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(msg.Raw)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// WriterTransport writes each message in MIME format to
+// an io.Writer, e.g. os.Stdout.
+type WriterTransport struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// NewWriterTransport creates a WriterTransport
+func NewWriterTransport(out io.Writer) *WriterTransport {
+	return &WriterTransport{out: out}
+}
+
+func (t *WriterTransport) Send(msg *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err := t.out.Write(msg.Raw)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(t.out, "\r\n")
+	return err
+}
+
+// MemoryTransport keeps sent messages in memory so tests
+// can assert on the rendered subject and bodies.
+type MemoryTransport struct {
+	mu       sync.Mutex
+	messages []*Message
+}
+
+// NewMemoryTransport creates an empty MemoryTransport
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{}
+}
+
+func (t *MemoryTransport) Send(msg *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cp := *msg
+	t.messages = append(t.messages, &cp)
+	return nil
+}
+
+// Messages returns the messages sent so far, oldest first.
+func (t *MemoryTransport) Messages() []*Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	msgs := make([]*Message, len(t.messages))
+	copy(msgs, t.messages)
+	return msgs
+}
+
+// Last returns the most recent message, or nil.
+func (t *MemoryTransport) Last() *Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.messages) == 0 {
+		return nil
+	}
+	return t.messages[len(t.messages)-1]
+}
+
+// Reset drops every captured message.
+func (t *MemoryTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages = nil
+}
@@ -0,0 +1,327 @@
+// Package patch applies JSON Merge Patch (RFC 7396) and JSON Patch
+// (RFC 6902) documents to JSON values.
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ErrTestFailed is returned when a JSON Patch test operation doesn't
+// match, the document has changed since the client read it.
+var ErrTestFailed = errors.New("patch: test operation failed")
+
+// Operation is one step of a JSON Patch.
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// OpError is an operation that can't be applied to the document,
+// which is the client's doing rather than a malformed patch.
+type OpError struct {
+	Index int
+	Op    string
+	Path  string
+	Err   error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("operation %d (%s %s): %v", e.Index, e.Op, e.Path, e.Err)
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// Merge applies a JSON Merge Patch to doc: members of patch replace
+// those of doc, recursively for objects, and null members remove them.
+func Merge(doc, patch []byte) ([]byte, error) {
+	var target, p interface{}
+	err := json.Unmarshal(doc, &target)
+	if err != nil {
+		return nil, fmt.Errorf("patch: document: %w", err)
+	}
+	err = json.Unmarshal(patch, &p)
+	if err != nil {
+		return nil, fmt.Errorf("patch: merge patch: %w", err)
+	}
+	return json.Marshal(merge(target, p))
+}
+
+func merge(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = merge(t[k], v)
+	}
+	return t
+}
+
+// Apply applies a JSON Patch to doc. The operations apply in order and
+// all or nothing: the first that fails is returned as an *OpError,
+// wrapping ErrTestFailed for a test that didn't match.
+func Apply(doc, patch []byte) ([]byte, error) {
+	var target interface{}
+	err := json.Unmarshal(doc, &target)
+	if err != nil {
+		return nil, fmt.Errorf("patch: document: %w", err)
+	}
+	var ops []Operation
+	err = json.Unmarshal(patch, &ops)
+	if err != nil {
+		return nil, fmt.Errorf("patch: JSON patch must be an array of operations: %w", err)
+	}
+	for i, op := range ops {
+		target, err = apply(target, op)
+		if err != nil {
+			return nil, &OpError{Index: i, Op: op.Op, Path: op.Path, Err: err}
+		}
+	}
+	return json.Marshal(target)
+}
+
+func apply(doc interface{}, op Operation) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	value := func() (interface{}, error) {
+		if op.Value == nil {
+			return nil, errors.New("missing value")
+		}
+		var v interface{}
+		err := json.Unmarshal(op.Value, &v)
+		return v, err
+	}
+	switch op.Op {
+	case "add":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, v)
+	case "remove":
+		doc, _, err = remove(doc, path)
+		return doc, err
+	case "replace":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return v, nil
+		}
+		doc, _, err = remove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, v)
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, fmt.Errorf("from: %w", err)
+		}
+		var v interface{}
+		if op.Op == "move" {
+			if strings.HasPrefix(op.Path, op.From+"/") {
+				return nil, errors.New("can't move a value into itself")
+			}
+			doc, v, err = remove(doc, from)
+		} else {
+			v, err = get(doc, from)
+			if err == nil {
+				v, err = deepCopy(v)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("from: %w", err)
+		}
+		return add(doc, path, v)
+	case "test":
+		want, err := value()
+		if err != nil {
+			return nil, err
+		}
+		got, err := get(doc, path)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			return nil, ErrTestFailed
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its unescaped
+// reference tokens, "" being the whole document.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// index parses an array index token, "-" meaning past the end, which
+// only add allows.
+func index(token string, n int, end bool) (int, error) {
+	if token == "-" && end {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	last := n - 1
+	if end {
+		last = n
+	}
+	if i > last {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+func get(doc interface{}, path []string) (interface{}, error) {
+	for _, t := range path {
+		switch c := doc.(type) {
+		case map[string]interface{}:
+			v, ok := c[t]
+			if !ok {
+				return nil, fmt.Errorf("no member %q", t)
+			}
+			doc = v
+		case []interface{}:
+			i, err := index(t, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = c[i]
+		default:
+			return nil, fmt.Errorf("can't look up %q in a scalar", t)
+		}
+	}
+	return doc, nil
+}
+
+// add sets the value at path, inserting into arrays rather than
+// overwriting, and returns the document, which is v for the root.
+func add(doc interface{}, path []string, v interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return v, nil
+	}
+	t := path[0]
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			c[t] = v
+			return c, nil
+		}
+		child, ok := c[t]
+		if !ok {
+			return nil, fmt.Errorf("no member %q", t)
+		}
+		child, err := add(child, path[1:], v)
+		if err != nil {
+			return nil, err
+		}
+		c[t] = child
+		return c, nil
+	case []interface{}:
+		if len(path) == 1 {
+			i, err := index(t, len(c), true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = v
+			return c, nil
+		}
+		i, err := index(t, len(c), false)
+		if err != nil {
+			return nil, err
+		}
+		child, err := add(c[i], path[1:], v)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = child
+		return c, nil
+	}
+	return nil, fmt.Errorf("can't add %q to a scalar", t)
+}
+
+// remove takes the value at path out of the document, returning what's
+// left and what was removed.
+func remove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.New("can't remove the whole document")
+	}
+	t := path[0]
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		child, ok := c[t]
+		if !ok {
+			return nil, nil, fmt.Errorf("no member %q", t)
+		}
+		if len(path) == 1 {
+			delete(c, t)
+			return c, child, nil
+		}
+		child, removed, err := remove(child, path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		c[t] = child
+		return c, removed, nil
+	case []interface{}:
+		i, err := index(t, len(c), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(path) == 1 {
+			removed := c[i]
+			return append(c[:i], c[i+1:]...), removed, nil
+		}
+		child, removed, err := remove(c[i], path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		c[i] = child
+		return c, removed, nil
+	}
+	return nil, nil, fmt.Errorf("can't remove %q from a scalar", t)
+}
+
+func deepCopy(v interface{}) (interface{}, error) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var c interface{}
+	err = json.Unmarshal(js, &c)
+	return c, err
+}
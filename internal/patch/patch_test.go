@@ -0,0 +1,139 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func jsonEqual(t *testing.T, got []byte, want string) bool {
+	t.Helper()
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(g, w)
+}
+
+// The examples of RFC 7396 appendix A.
+func TestMerge(t *testing.T) {
+	tests := []struct{ doc, patch, want string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, tt := range tests {
+		got, err := Merge([]byte(tt.doc), []byte(tt.patch))
+		if err != nil {
+			t.Errorf("Merge(%s, %s): %v", tt.doc, tt.patch, err)
+			continue
+		}
+		if !jsonEqual(t, got, tt.want) {
+			t.Errorf("Merge(%s, %s) = %s, want %s", tt.doc, tt.patch, got, tt.want)
+		}
+	}
+	if _, err := Merge([]byte(`{`), []byte(`{}`)); err == nil {
+		t.Error("merged into a malformed document")
+	}
+	if _, err := Merge([]byte(`{}`), []byte(`{`)); err == nil {
+		t.Error("merged a malformed patch")
+	}
+}
+
+// Mostly the examples of RFC 6902 appendix A.
+func TestApply(t *testing.T) {
+	tests := []struct{ name, doc, patch, want string }{
+		{"add member", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{"add element", `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{"append", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc"]}]`, `{"foo":["bar",["abc"]]}`},
+		{"remove member", `{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{"remove element", `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{"replace", `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{"replace root", `{"a":1}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`},
+		{"move member", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{"move element", `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+			`{"foo":["all","cows","eat","grass"]}`},
+		{"copy", `{"a":{"b":[1]}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"add","path":"/c/b/-","value":2}]`,
+			`{"a":{"b":[1]},"c":{"b":[1,2]}}`},
+		{"test", `{"baz":"qux","foo":["a",2,"c"]}`,
+			`[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+			`{"baz":"qux","foo":["a",2,"c"]}`},
+		{"escaped pointer", `{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10},{"op":"remove","path":"/~1"}]`, `{"~1":10}`},
+		{"add null", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":null}]`, `{"baz":null,"foo":"bar"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Apply([]byte(tt.doc), []byte(tt.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !jsonEqual(t, got, tt.want) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	tests := []struct {
+		name, doc, patch string
+		index            int
+	}{
+		{"missing parent", `{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, 0},
+		{"index out of range", `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/3","value":"qux"}]`, 0},
+		{"leading zero", `{"foo":["bar","baz"]}`, `[{"op":"remove","path":"/foo/01"}]`, 0},
+		{"remove missing", `{"foo":"bar"}`, `[{"op":"test","path":"/foo","value":"bar"},{"op":"remove","path":"/baz"}]`, 1},
+		{"remove root", `{"foo":"bar"}`, `[{"op":"remove","path":""}]`, 0},
+		{"missing value", `{"foo":"bar"}`, `[{"op":"add","path":"/baz"}]`, 0},
+		{"unknown op", `{"foo":"bar"}`, `[{"op":"frob","path":"/foo"}]`, 0},
+		{"bad pointer", `{"foo":"bar"}`, `[{"op":"remove","path":"foo"}]`, 0},
+		{"move into itself", `{"a":{"b":1}}`, `[{"op":"move","from":"/a","path":"/a/c"}]`, 0},
+		{"scalar", `{"foo":"bar"}`, `[{"op":"add","path":"/foo/x","value":1}]`, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Apply([]byte(tt.doc), []byte(tt.patch))
+			var opErr *OpError
+			if !errors.As(err, &opErr) {
+				t.Fatalf("got %v, want an *OpError", err)
+			}
+			if opErr.Index != tt.index {
+				t.Errorf("got index %d, want %d", opErr.Index, tt.index)
+			}
+		})
+	}
+
+	_, err := Apply([]byte(`{"baz":"qux"}`), []byte(`[{"op":"test","path":"/baz","value":"bar"}]`))
+	if !errors.Is(err, ErrTestFailed) {
+		t.Errorf("got %v, want %v", err, ErrTestFailed)
+	}
+	// a number that differs only by type is not equal to a string
+	_, err = Apply([]byte(`{"a":"1"}`), []byte(`[{"op":"test","path":"/a","value":1}]`))
+	if !errors.Is(err, ErrTestFailed) {
+		t.Errorf("got %v, want %v", err, ErrTestFailed)
+	}
+
+	_, err = Apply([]byte(`{}`), []byte(`{"op":"add"}`))
+	var opErr *OpError
+	if err == nil || errors.As(err, &opErr) {
+		t.Errorf("a patch that isn't an array: got %v", err)
+	}
+}
@@ -7,14 +7,29 @@ var (
 	EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 )
 
-// Validator contains a map of validation errors
+// Codes name what is wrong with a field, for clients to switch on
+// instead of matching the message.
+const (
+	CodeInvalid       = "invalid"
+	CodeRequired      = "required"
+	CodeTooShort      = "too_short"
+	CodeTooSmall      = "too_small"
+	CodeTooLong       = "too_long"
+	CodeTooLarge      = "too_large"
+	CodeInvalidFormat = "invalid_format"
+	CodeDuplicate     = "duplicate"
+	CodeAlreadyExists = "already_exists"
+)
+
+// Validator contains a map of validation errors, and the code of each
 type Validator struct {
 	Errors map[string]string
+	Codes  map[string]string
 }
 
 // New is a helper which creates a new empty Validator
 func New() *Validator {
-	return &Validator{Errors: make(map[string]string)}
+	return &Validator{Errors: make(map[string]string), Codes: make(map[string]string)}
 }
 
 func (v *Validator) Valid() bool {
@@ -22,9 +37,36 @@ func (v *Validator) Valid() bool {
 }
 
 func (v *Validator) AddErr(key, msg string) {
+	v.AddErrCode(key, CodeInvalid, msg)
+}
+
+// AddErrCode is AddErr with the code of the error.
+func (v *Validator) AddErrCode(key, code, msg string) {
 	if _, exists := v.Errors[key]; !exists {
 		v.Errors[key] = msg
+		v.Codes[key] = code
+	}
+}
+
+// AppendErr adds msg to the error of key, after the message already
+// there if any, where AddErr would keep only the first. The first
+// error's code stays.
+func (v *Validator) AppendErr(key, code, msg string) {
+	if prev, exists := v.Errors[key]; exists {
+		v.Errors[key] = prev + "; " + msg
+		return
 	}
+	v.Errors[key] = msg
+	v.Codes[key] = code
+}
+
+// Code returns the code of the error of key, "invalid" for errors
+// added to Errors directly.
+func (v *Validator) Code(key string) string {
+	if code, ok := v.Codes[key]; ok {
+		return code
+	}
+	return CodeInvalid
 }
 
 func (v *Validator) Check(ok bool, key, msg string) {
@@ -33,6 +75,13 @@ func (v *Validator) Check(ok bool, key, msg string) {
 	}
 }
 
+// CheckCode is Check with the code of the error.
+func (v *Validator) CheckCode(ok bool, key, code, msg string) {
+	if !ok {
+		v.AddErrCode(key, code, msg)
+	}
+}
+
 // In returns true if a specific value is in the list
 func In(value string, list ...string) bool {
 	for i := range list {
@@ -0,0 +1,102 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenAddress is a delivery to an address receivers can't be
+// on, such as loopback or a private network.
+var ErrForbiddenAddress = errors.New("webhook: forbidden address")
+
+var forbiddenNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // this network
+		"10.0.0.0/8",     // private
+		"100.64.0.0/10",  // carrier grade NAT
+		"127.0.0.0/8",    // loopback
+		"169.254.0.0/16", // link local, cloud metadata services
+		"172.16.0.0/12",  // private
+		"192.0.0.0/24",   // IETF protocol assignments
+		"192.168.0.0/16", // private
+		"198.18.0.0/15",  // benchmarking
+		"224.0.0.0/4",    // multicast
+		"240.0.0.0/4",    // reserved, broadcast
+		"::/128",         // unspecified
+		"::1/128",        // loopback
+		"64:ff9b::/96",   // NAT64
+		"fc00::/7",       // unique local
+		"fe80::/10",      // link local
+		"ff00::/8",       // multicast
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// forbiddenIP reports whether ip is in a range webhooks may not reach.
+// An IPv4 mapped IPv6 address is checked as the IPv4 one.
+func forbiddenIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range forbiddenNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAddress is a net.Dialer Control func refusing connections to
+// forbidden addresses. It sees the address after name resolution, so a
+// host resolving to a private address, however it does, is refused.
+func checkAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || forbiddenIP(ip) {
+		return fmt.Errorf("%w %s", ErrForbiddenAddress, host)
+	}
+	return nil
+}
+
+// NewClient returns the client deliveries go out with. It doesn't use
+// a proxy, nor follow redirects, a redirect counts as a failed
+// delivery. Unless allowPrivate, which is for development, it refuses
+// to connect to loopback, private, link local and other addresses not
+// on the public internet, so a webhook can't be aimed at the network
+// the server runs in.
+func NewClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+	}
+	if !allowPrivate {
+		dialer.Control = checkAddress
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -0,0 +1,148 @@
+// Package webhook delivers signed event notifications over HTTP, and
+// verifies them for receivers.
+//
+// A delivery is a POST of the JSON encoded Event. Its SignatureHeader
+// is "t=<unix seconds>,v1=<hex HMAC-SHA256>", the HMAC being of the
+// timestamp, a dot and the body, keyed with the subscription's secret.
+// Signing the timestamp lets receivers reject replayed deliveries.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SignatureHeader = "Greenlight-Signature"
+	EventHeader     = "Greenlight-Event"
+	DeliveryHeader  = "Greenlight-Delivery"
+)
+
+var (
+	ErrNoSignature      = errors.New("webhook: no signature")
+	ErrInvalidSignature = errors.New("webhook: signature doesn't match")
+	ErrTooOld           = errors.New("webhook: timestamp outside the tolerance")
+)
+
+// Event is what a delivery's body holds.
+type Event struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Sign returns the signature header value for body sent at t.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac(secret, ts, body))
+}
+
+func mac(secret, ts string, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// Verify checks header, the signature a delivery of body came with, was
+// made with secret no further than tolerance from now.
+func Verify(secret, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	var (
+		ts   string
+		sigs [][]byte
+	)
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "v1":
+			sig, err := hex.DecodeString(kv[1])
+			if err == nil {
+				sigs = append(sigs, sig)
+			}
+		}
+	}
+	if ts == "" || len(sigs) == 0 {
+		return ErrNoSignature
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrNoSignature
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > tolerance || d < -tolerance {
+		return ErrTooOld
+	}
+	want := mac(secret, ts, body)
+	for _, sig := range sigs {
+		if hmac.Equal(sig, want) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// Result is the outcome of one delivery attempt.
+type Result struct {
+	StatusCode int
+	Duration   time.Duration
+	// Response is the start of the receiver's response body
+	Response string
+}
+
+// maxResponse is how much of the receiver's response body is kept.
+const maxResponse = 1024
+
+// Deliver posts ev to url signed with secret. Anything but a 2xx
+// response is an error, the returned Result is filled in as far as the
+// attempt got.
+func Deliver(ctx context.Context, client *http.Client, url, secret string, ev Event) (*Result, error) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Greenlight-Webhooks/1")
+	req.Header.Set(EventHeader, ev.Type)
+	req.Header.Set(DeliveryHeader, ev.ID)
+	req.Header.Set(SignatureHeader, Sign(secret, time.Now(), body))
+
+	res := &Result{}
+	start := time.Now()
+	resp, err := client.Do(req)
+	res.Duration = time.Since(start)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	res.StatusCode = resp.StatusCode
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	res.Response = string(b)
+	// drain what's left so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return res, fmt.Errorf("webhook: %s answered %d", url, resp.StatusCode)
+	}
+	return res, nil
+}
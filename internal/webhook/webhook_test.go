@@ -0,0 +1,222 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSecret = "s3cret"
+
+func testEvent() Event {
+	return Event{
+		ID:        "0123456789abcdef",
+		Type:      "movie.created",
+		CreatedAt: time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+		Data:      json.RawMessage(`{"id":1,"title":"Moana"}`),
+	}
+}
+
+// receiver records the deliveries it gets and answers with the next of
+// statuses, 200 once they run out.
+type receiver struct {
+	mu         sync.Mutex
+	statuses   []int
+	deliveries []delivery
+}
+
+type delivery struct {
+	header http.Header
+	body   []byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.deliveries = append(rc.deliveries, delivery{header: r.Header.Clone(), body: body})
+	status := http.StatusOK
+	if len(rc.statuses) > 0 {
+		status, rc.statuses = rc.statuses[0], rc.statuses[1:]
+	}
+	w.WriteHeader(status)
+	w.Write([]byte("got it"))
+}
+
+func TestDeliverIsVerifiable(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	ev := testEvent()
+	res, err := Deliver(context.Background(), srv.Client(), srv.URL, testSecret, ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || res.Response != "got it" {
+		t.Errorf("result = %+v", res)
+	}
+	if len(rc.deliveries) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(rc.deliveries))
+	}
+	d := rc.deliveries[0]
+	if got := d.header.Get(EventHeader); got != ev.Type {
+		t.Errorf("%s = %q, want %q", EventHeader, got, ev.Type)
+	}
+	if got := d.header.Get(DeliveryHeader); got != ev.ID {
+		t.Errorf("%s = %q, want %q", DeliveryHeader, got, ev.ID)
+	}
+	var got Event
+	err = json.Unmarshal(d.body, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != ev.ID || got.Type != ev.Type || string(got.Data) != string(ev.Data) {
+		t.Errorf("body = %s", d.body)
+	}
+
+	sig := d.header.Get(SignatureHeader)
+	err = Verify(testSecret, sig, d.body, 5*time.Minute, time.Now())
+	if err != nil {
+		t.Errorf("Verify = %v", err)
+	}
+	err = Verify("other", sig, d.body, 5*time.Minute, time.Now())
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify with another secret = %v, want ErrInvalidSignature", err)
+	}
+	tampered := append([]byte(nil), d.body...)
+	tampered[len(tampered)-2] = 'X'
+	err = Verify(testSecret, sig, tampered, 5*time.Minute, time.Now())
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify of another body = %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestDeliverFailureCanBeRetried(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusInternalServerError, http.StatusFound}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	client := NewClient(time.Second, true)
+
+	ev := testEvent()
+	for _, want := range []int{http.StatusInternalServerError, http.StatusFound} {
+		res, err := Deliver(context.Background(), client, srv.URL, testSecret, ev)
+		if err == nil {
+			t.Fatalf("a %d answer didn't fail the delivery", want)
+		}
+		if res == nil || res.StatusCode != want {
+			t.Errorf("result = %+v, want status %d", res, want)
+		}
+	}
+	_, err := Deliver(context.Background(), client, srv.URL, testSecret, ev)
+	if err != nil {
+		t.Fatalf("third attempt: %v", err)
+	}
+	// every attempt carries the same delivery id, so a receiver can
+	// tell a retry of a delivery it already handled
+	if len(rc.deliveries) != 3 {
+		t.Fatalf("got %d deliveries, want 3", len(rc.deliveries))
+	}
+	for i, d := range rc.deliveries {
+		if got := d.header.Get(DeliveryHeader); got != ev.ID {
+			t.Errorf("attempt %d: %s = %q, want %q", i+1, DeliveryHeader, got, ev.ID)
+		}
+		if err := Verify(testSecret, d.header.Get(SignatureHeader), d.body, time.Minute, time.Now()); err != nil {
+			t.Errorf("attempt %d: Verify = %v", i+1, err)
+		}
+	}
+}
+
+func TestDeliverUnreachable(t *testing.T) {
+	srv := httptest.NewServer(&receiver{})
+	url := srv.URL
+	srv.Close()
+	res, err := Deliver(context.Background(), srv.Client(), url, testSecret, testEvent())
+	if err == nil {
+		t.Fatal("delivering to a closed server succeeded")
+	}
+	if res == nil || res.StatusCode != 0 {
+		t.Errorf("result = %+v, want one without a status", res)
+	}
+}
+
+func TestVerifyTolerance(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	sent := time.Unix(1_600_000_000, 0)
+	sig := Sign(testSecret, sent, body)
+	tests := []struct {
+		name string
+		now  time.Time
+		want error
+	}{
+		{"on time", sent.Add(30 * time.Second), nil},
+		{"at the limit", sent.Add(5 * time.Minute), nil},
+		{"too late", sent.Add(5*time.Minute + time.Second), ErrTooOld},
+		{"from the future", sent.Add(-6 * time.Minute), ErrTooOld},
+	}
+	for _, tt := range tests {
+		err := Verify(testSecret, sig, body, 5*time.Minute, tt.now)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: Verify = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestVerifyHeader(t *testing.T) {
+	body := []byte(`{}`)
+	now := time.Now()
+	good := Sign(testSecret, now, body)
+	ts := strings.SplitN(good, ",", 2)[0]
+	tests := []struct {
+		name   string
+		header string
+		want   error
+	}{
+		{"empty", "", ErrNoSignature},
+		{"no timestamp", strings.SplitN(good, ",", 2)[1], ErrNoSignature},
+		{"no signature", ts, ErrNoSignature},
+		{"bad timestamp", "t=soon,v1=00", ErrNoSignature},
+		{"wrong signature", ts + ",v1=00ff", ErrInvalidSignature},
+		// receivers accept any of several signatures, for secret rotation
+		{"one of several", ts + ",v1=00ff," + strings.SplitN(good, ",", 2)[1], nil},
+	}
+	for _, tt := range tests {
+		err := Verify(testSecret, tt.header, body, time.Minute, now)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: Verify = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestClientRefusesPrivateAddresses(t *testing.T) {
+	srv := httptest.NewServer(&receiver{})
+	defer srv.Close()
+	_, err := Deliver(context.Background(), NewClient(time.Second, false), srv.URL, testSecret, testEvent())
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("delivering to %s = %v, want ErrForbiddenAddress", srv.URL, err)
+	}
+}
+
+func TestForbiddenIP(t *testing.T) {
+	for _, addr := range []string{
+		"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254",
+		"100.64.0.1", "0.0.0.0", "::1", "::", "fe80::1", "fd00::1", "::ffff:127.0.0.1",
+	} {
+		if !forbiddenIP(net.ParseIP(addr)) {
+			t.Errorf("%s is allowed", addr)
+		}
+	}
+	for _, addr := range []string{"93.184.216.34", "8.8.8.8", "172.32.0.1", "2606:4700::1111"} {
+		if forbiddenIP(net.ParseIP(addr)) {
+			t.Errorf("%s is forbidden", addr)
+		}
+	}
+}
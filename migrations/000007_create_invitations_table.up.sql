@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS invitations (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    email citext NOT NULL,
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    invited_by bigint REFERENCES users ON DELETE SET NULL,
+    permissions text[] NOT NULL DEFAULT '{}',
+    expiry timestamp(0) with time zone NOT NULL,
+    accepted_at timestamp(0) with time zone,
+    revoked_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS invitations_user_id_idx ON invitations (user_id);
+
+INSERT INTO permissions (code)
+VALUES
+    ('users:invite');
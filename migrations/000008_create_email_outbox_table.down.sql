@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code = 'mail:admin';
+DROP TABLE IF EXISTS email_outbox;
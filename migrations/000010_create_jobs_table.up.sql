@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS jobs (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    kind text NOT NULL,
+    payload jsonb NOT NULL DEFAULT '{}',
+    unique_key text,
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    max_attempts integer NOT NULL DEFAULT 5,
+    run_at timestamp with time zone NOT NULL DEFAULT NOW(),
+    locked_until timestamp with time zone,
+    last_error text NOT NULL DEFAULT '',
+    finished_at timestamp with time zone
+);
+
+CREATE INDEX IF NOT EXISTS jobs_runnable_idx ON jobs (run_at) WHERE status IN ('pending', 'running');
+CREATE INDEX IF NOT EXISTS jobs_status_idx ON jobs (status, kind);
+CREATE UNIQUE INDEX IF NOT EXISTS jobs_unique_key_idx ON jobs (unique_key) WHERE status IN ('pending', 'running');
+
+INSERT INTO permissions (code)
+VALUES
+    ('jobs:admin');
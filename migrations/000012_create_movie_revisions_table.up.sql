@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS movie_revisions (
+    id bigserial PRIMARY KEY,
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    version integer NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    action text NOT NULL,
+    reverted_from integer,
+    title text NOT NULL,
+    year integer NOT NULL,
+    runtime integer NOT NULL,
+    genres text[] NOT NULL,
+    deleted bool NOT NULL DEFAULT false,
+    UNIQUE (movie_id, version)
+);
+
+-- Existing movies start their history at their current version.
+INSERT INTO movie_revisions (movie_id, version, created_at, action, title, year, runtime, genres, deleted)
+SELECT id, version, created_at, 'create', title, year, runtime, genres, deleted_at IS NOT NULL
+FROM movies
+ON CONFLICT DO NOTHING;
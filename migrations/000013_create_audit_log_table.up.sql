@@ -0,0 +1,34 @@
+-- before and after are json, not jsonb, so they read back byte for
+-- byte and the hash chain can be recomputed.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id bigserial PRIMARY KEY,
+    created_at timestamp with time zone NOT NULL,
+    actor_id bigint,
+    client_ip text NOT NULL DEFAULT '',
+    request_id text NOT NULL DEFAULT '',
+    action text NOT NULL,
+    resource_type text NOT NULL,
+    resource_id text NOT NULL DEFAULT '',
+    before json,
+    after json,
+    prev_hash bytea NOT NULL,
+    hash bytea NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON audit_log (actor_id, created_at);
+CREATE INDEX IF NOT EXISTS audit_log_resource_idx ON audit_log (resource_type, resource_id, created_at);
+CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON audit_log (created_at);
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_append_only
+BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+FOR EACH STATEMENT EXECUTE PROCEDURE audit_log_append_only();
+
+INSERT INTO permissions (code)
+VALUES
+    ('audit:read');
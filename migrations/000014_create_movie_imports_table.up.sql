@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS movie_imports (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    format text NOT NULL,
+    dry_run bool NOT NULL DEFAULT false,
+    status text NOT NULL DEFAULT 'pending',
+    payload bytea NOT NULL,
+    report jsonb,
+    error text NOT NULL DEFAULT '',
+    finished_at timestamp(0) with time zone
+);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS movie_events (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    type text NOT NULL,
+    movie_id bigint NOT NULL,
+    version integer NOT NULL,
+    title text NOT NULL,
+    year integer NOT NULL,
+    runtime integer NOT NULL,
+    genres text[] NOT NULL,
+    deleted_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS movie_events_created_at_idx ON movie_events (created_at);
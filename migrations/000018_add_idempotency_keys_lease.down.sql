@@ -0,0 +1,3 @@
+DELETE FROM idempotency_keys WHERE fingerprint IS NULL;
+ALTER TABLE idempotency_keys DROP COLUMN IF EXISTS locked_until;
+ALTER TABLE idempotency_keys ALTER COLUMN fingerprint SET NOT NULL;
@@ -0,0 +1,2 @@
+-- audit entries chain per resource, an append looks up the last one
+CREATE INDEX IF NOT EXISTS audit_log_chain_idx ON audit_log (resource_type, resource_id, id);
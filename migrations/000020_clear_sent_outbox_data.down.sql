@@ -0,0 +1 @@
+-- the cleared template data can't be brought back
@@ -0,0 +1,2 @@
+-- sent messages no longer need their template data, which may hold tokens
+UPDATE email_outbox SET data = '{}' WHERE status = 'sent' AND data <> '{}';
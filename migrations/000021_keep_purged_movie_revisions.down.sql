@@ -0,0 +1,3 @@
+DELETE FROM movie_revisions r WHERE NOT EXISTS (SELECT 1 FROM movies m WHERE m.id = r.movie_id);
+ALTER TABLE movie_revisions ADD CONSTRAINT movie_revisions_movie_id_fkey
+    FOREIGN KEY (movie_id) REFERENCES movies ON DELETE CASCADE;
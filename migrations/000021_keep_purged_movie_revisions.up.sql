@@ -0,0 +1,2 @@
+-- a purged movie's history outlives it, like its events and audit entries
+ALTER TABLE movie_revisions DROP CONSTRAINT IF EXISTS movie_revisions_movie_id_fkey;
@@ -0,0 +1,3 @@
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS client text NOT NULL DEFAULT '';
+ALTER TABLE idempotency_keys DROP CONSTRAINT IF EXISTS idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (user_id, client, key);
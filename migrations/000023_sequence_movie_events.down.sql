@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS movie_events_unsequenced_idx;
+DROP INDEX IF EXISTS movie_events_position_idx;
+ALTER TABLE movie_events DROP COLUMN IF EXISTS position;
+DROP SEQUENCE IF EXISTS movie_events_position_seq;
@@ -0,0 +1,7 @@
+ALTER TABLE movie_events ADD COLUMN IF NOT EXISTS position bigint;
+CREATE SEQUENCE IF NOT EXISTS movie_events_position_seq OWNED BY movie_events.position;
+-- events so far were written under a lock, in the order they committed
+UPDATE movie_events SET position = id;
+SELECT setval('movie_events_position_seq', COALESCE((SELECT MAX(id) FROM movie_events), 0) + 1, false);
+CREATE UNIQUE INDEX IF NOT EXISTS movie_events_position_idx ON movie_events (position);
+CREATE INDEX IF NOT EXISTS movie_events_unsequenced_idx ON movie_events (id) WHERE position IS NULL;
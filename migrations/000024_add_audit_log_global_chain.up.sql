@@ -0,0 +1,3 @@
+-- entries link onto the previous entry of the whole log as well as of
+-- their resource, those from before have no chain_hash
+ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS chain_hash bytea;